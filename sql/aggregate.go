@@ -0,0 +1,200 @@
+package sql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	AggregateCount = "COUNT"
+	AggregateSum   = "SUM"
+	AggregateMin   = "MIN"
+	AggregateMax   = "MAX"
+)
+
+// AggregateQuery CmdCountMulti的请求数据，nil表示COUNT(*)。
+// Func为空时为COUNT，COUNT的Column为空时为COUNT(*)；SUM只能用于数字列
+type AggregateQuery struct {
+	Func   string
+	Column string
+	Where  string
+	Params []string
+}
+
+// AggregateResult 聚合的结果，SUM、MIN、MAX没有满足条件的行时Null为true
+type AggregateResult struct {
+	Value string
+	Null  bool
+}
+
+func (r *AggregateResult) Int64() int64 {
+	if i, err := strconv.ParseInt(r.Value, 10, 64); err == nil {
+		return i
+	}
+
+	f, _ := strconv.ParseFloat(r.Value, 64)
+	return int64(f)
+}
+
+func (r *AggregateResult) Float64() float64 {
+	f, _ := strconv.ParseFloat(r.Value, 64)
+	return f
+}
+
+// aggregatePlan 按schema检查并转换后的AggregateQuery
+type aggregatePlan struct {
+	fn     string
+	column *ColumnSchema
+	where  string
+	params []string
+	parser *Parser
+}
+
+func (q *AggregateQuery) plan(schema *TableSchema, shard string) (*aggregatePlan, error) {
+	if q == nil {
+		q = &AggregateQuery{}
+	}
+
+	ap := &aggregatePlan{fn: strings.ToUpper(q.Func), where: q.Where, params: q.Params}
+	if ap.fn == "" {
+		ap.fn = AggregateCount
+	}
+
+	if q.Column != "" {
+		if ap.column = schema.GetColumnSchema(q.Column); ap.column == nil {
+			return nil, fmt.Errorf("invalid column: %s", q.Column)
+		}
+	}
+
+	switch ap.fn {
+	case AggregateCount:
+	case AggregateSum:
+		if ap.column == nil || !ap.column.IsNumber {
+			return nil, fmt.Errorf("invalid aggregate column: %s", q.Column)
+		}
+
+	case AggregateMin, AggregateMax:
+		if ap.column == nil {
+			return nil, fmt.Errorf("invalid aggregate column: %s", q.Column)
+		}
+
+	default:
+		return nil, fmt.Errorf("nonsupport aggregate function: %s", q.Func)
+	}
+
+	if q.Where != "" {
+		var err error
+		if ap.parser, err = CreateParser(schema, shard, q.Where, q.Params); err != nil {
+			return nil, err
+		}
+	}
+
+	return ap, nil
+}
+
+// apply 在内存中计算，NULL的值不参与计算
+func (ap *aggregatePlan) apply(schema *TableSchema, rows [][]byte) *AggregateResult {
+	var count, sumInt int64
+	var sumFloat float64
+	var best exprValue
+	var bestText string
+
+	for _, rowData := range rows {
+		if ap.parser != nil && !ap.parser.Check(rowData) {
+			continue
+		}
+
+		if ap.column == nil {
+			count++
+			continue
+		}
+
+		value, null := rowValue(schema, rowData, ap.column.Index)
+		if null {
+			continue
+		}
+
+		count++
+		switch ap.fn {
+		case AggregateSum:
+			v := columnValue(value, ap.column.Type, ap.column.Collation)
+			sumInt += v.i
+			sumFloat += v.f
+
+		case AggregateMin, AggregateMax:
+			v := columnValue(value, ap.column.Type, ap.column.Collation)
+			if count > 1 {
+				c, _ := compareValue(v, best)
+				if (ap.fn == AggregateMin && c >= 0) || (ap.fn == AggregateMax && c <= 0) {
+					continue
+				}
+			}
+
+			best = v
+			bestText = value
+		}
+	}
+
+	if ap.fn == AggregateCount {
+		return &AggregateResult{Value: strconv.FormatInt(count, 10)}
+	}
+
+	if count == 0 {
+		return &AggregateResult{Null: true}
+	}
+
+	if ap.fn == AggregateSum {
+		if ap.column.Type == ColumnTypeFloat {
+			return &AggregateResult{Value: strconv.FormatFloat(sumFloat, 'f', -1, 64)}
+		}
+
+		return &AggregateResult{Value: strconv.FormatInt(sumInt, 10)}
+	}
+
+	return &AggregateResult{Value: bestText}
+}
+
+// writeSql 生成聚合的语句，返回追加了参数的params
+func (ap *aggregatePlan) writeSql(builder *strings.Builder, schema *TableSchema, params []interface{}) []interface{} {
+	builder.WriteString("SELECT ")
+	builder.WriteString(ap.fn)
+	if ap.column == nil {
+		builder.WriteString("(*)")
+	} else {
+		builder.WriteString("(`")
+		builder.WriteString(ap.column.Name)
+		builder.WriteString("`)")
+	}
+
+	builder.WriteString(" FROM ")
+	builder.WriteString(schema.tableName)
+	builder.WriteString(" WHERE `")
+	builder.WriteString(schema.ShardKey)
+	builder.WriteString("`=?")
+
+	if ap.where != "" {
+		builder.WriteString(" AND (")
+		builder.WriteString(ap.where)
+		builder.WriteByte(')')
+		for _, param := range ap.params {
+			params = append(params, param)
+		}
+	}
+
+	return params
+}
+
+// Aggregate 从完整加载的shard中计算，ti的状态不是TableRowStateValid时返回false，需要查询数据库
+func (ti *TableRowIndex) Aggregate(table *Table, query *AggregateQuery) (*AggregateResult, bool, error) {
+	if ti.State != TableRowStateValid {
+		return nil, false, nil
+	}
+
+	ap, err := query.plan(table.Schema, ti.ShardKey)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return ap.apply(table.Schema, ti.rows(table)), true, nil
+}
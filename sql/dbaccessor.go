@@ -1,73 +1,694 @@
 package sql
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 type DBAccessor struct {
 	processor *Processor
 	req       chan *DBRequest
 	rtn       chan *DBRequest
+
+	//pool模式，nWorker > 1时Run把请求分配到workers上并行执行
+	nWorker  int
+	workers  []*DBAccessor
+	pool     *DBAccessor
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pins     map[*RowContext]*rowPin
+	nPending atomic.Int32
+
+	stop    chan struct{}
+	done    chan struct{}
+	stopCtx context.Context
+	//Processor执行请求的ctx，Stop的ctx结束时取消，cause为Stop的ctx的错误
+	cancelRun context.CancelCauseFunc
+	//停止时还没有送到rtn的请求
+	undelivered []*DBRequest
+	//recover得到的、不属于某个请求的panic，以及WAL的错误
+	errs []error
+
+	wal *WAL
+	//ReplayWAL恢复的请求，Run时在读取req之前执行
+	replay []*DBRequest
+	//等待一组请求的成员时读取到的其他请求，在读取req之前处理
+	held []*DBRequest
+	//等待PreReq的后续请求和TxGroup其他成员的最长时间
+	memberWait time.Duration
+}
+
+// DefaultMemberWait 默认等待PreReq的后续请求和TxGroup其他成员的最长时间
+const DefaultMemberWait = 5 * time.Second
+
+// ErrTxGroupIncomplete TxGroup的成员没有在等待时间内到齐(或者已经停止)，已经读取和之后到达的成员都返回包装了它的错误，不会重试
+var ErrTxGroupIncomplete = errors.New("tx group incomplete")
+
+// rowPin 一行还没返回的请求都在同一个worker上执行，保证同一个RowContext的顺序
+type rowPin struct {
+	worker int
+	n      int
+}
+
+func NewDBAccessor(driver Driver, req chan *DBRequest, rtn chan *DBRequest) *DBAccessor {
+	return &DBAccessor{
+		processor:  NewProcessor(driver),
+		req:        req,
+		rtn:        rtn,
+		memberWait: DefaultMemberWait,
+	}
+}
+
+// SetWorkerNum 按TableSchema.Name和shard值把请求分配到n个Processor并行执行，需要在Run之前调用；
+// worker使用同一个Driver，Driver需要支持并发访问
+func (dba *DBAccessor) SetWorkerNum(n int) {
+	dba.nWorker = n
+}
+
+// Processor 单goroutine模式下的Processor，用于设置批量、超时和重试等参数；pool模式下设置会在Run时复制到每个worker
+func (dba *DBAccessor) Processor() *Processor {
+	return dba.processor
+}
+
+// SetMemberWait 设置等待PreReq的后续请求和TxGroup其他成员的最长时间，需要在Run之前调用
+func (dba *DBAccessor) SetMemberWait(d time.Duration) {
+	dba.memberWait = d
+}
+
+// SetWAL Send的写请求先记录到wal再加入req，执行完成后记录完成，需要在Run之前调用。
+// 直接写入req的请求在读取时才记录，之前崩溃会丢失
+func (dba *DBAccessor) SetWAL(wal *WAL) {
+	dba.wal = wal
+}
+
+// Send 把请求加入req，设置了WAL时写请求先记录到WAL，返回nil之后崩溃重启时由ReplayWAL重新执行；
+// 记录失败时返回错误，请求不会执行。ctx结束时放弃加入，记录标记为完成
+func (dba *DBAccessor) Send(ctx context.Context, req *DBRequest) error {
+	if dba.wal != nil {
+		if err := dba.wal.Append(req); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case dba.req <- req:
+		return nil
+
+	case <-ctx.Done():
+		err := ctx.Err()
+		if dba.wal != nil {
+			err = errors.Join(err, dba.wal.Done(req))
+		}
+		return err
+	}
+}
+
+// ReplayWAL 把WAL中未完成的请求重新加入，Run时在读取新的请求之前执行，需要在SetWAL之后、Run之前调用。
+// 重放的请求Replayed为true，结果同样送到rtn；DeleteMulti的WHERE按当前的表结构重新编译。
+// 表结构加载或者WHERE编译失败的请求留在WAL中，返回错误
+func (dba *DBAccessor) ReplayWAL(tsm *TableSchemaManager) (int, error) {
+	if dba.wal == nil {
+		return 0, errors.New("wal is not set")
+	}
+
+	var errs []error
+	rcs := make(map[string]*RowContext)
+	groups := make(map[uint64]*TxGroup)
+	for _, rec := range dba.wal.records() {
+		schema, err := tsm.LoadSchema(rec.table)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("replay %s: %w", rec.table, err))
+			continue
+		}
+
+		if data, ok := rec.data.(*MultiRequestData); ok {
+			if int(rec.shardId) >= len(rec.keys) {
+				errs = append(errs, fmt.Errorf("replay %s: invalid shard", rec.table))
+				continue
+			}
+
+			//Parser没有记录到WAL
+			data.Parser, err = CreateParser(schema, rec.keys[rec.shardId], data.Where, data.Params)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("replay %s: %w", rec.table, err))
+				continue
+			}
+		}
+
+		rowKey := walRowKey(rec)
+		rc := rcs[rowKey]
+		if rc == nil {
+			rc = NewRowContext()
+			rcs[rowKey] = rc
+		}
+
+		req := &DBRequest{
+			Command:    rec.command,
+			CanMerge:   rec.flags&walFlagCanMerge != 0,
+			Sync:       rec.flags&walFlagSync != 0,
+			Schema:     schema,
+			ShardId:    rec.shardId,
+			Keys:       rec.keys,
+			Data:       rec.data,
+			RowContext: rc,
+			Replayed:   true,
+			lsn:        rec.lsn,
+		}
+
+		if rec.group != 0 {
+			//崩溃时部分成员可能已经完成，事务只包含恢复的成员
+			group := groups[rec.group]
+			if group == nil {
+				group = NewTxGroup(0, rec.mustAffect)
+				groups[rec.group] = group
+			}
+			group.Num++
+			req.TxGroup = group
+		}
+
+		dba.replay = append(dba.replay, req)
+	}
+
+	return len(dba.replay), errors.Join(errs...)
 }
 
 func (dba *DBAccessor) Run() {
+	dba.stop = make(chan struct{})
+	dba.done = make(chan struct{})
+	dba.processor.ctx, dba.cancelRun = context.WithCancelCause(context.Background())
+	if dba.nWorker > 1 {
+		dba.runPool()
+		return
+	}
+
+	go func() {
+		defer close(dba.done)
+		dba.held, dba.replay = dba.replay, nil
+
+		for !dba.stopping() {
+			dba.processRequest(dba.processor.Idle())
+		}
+
+		dba.drain()
+	}()
+}
+
+// Stop 停止读取新的请求，把已经读取的和channel中已有的请求执行完并送到rtn；ctx结束时放弃剩余的请求，
+// 返回没有送到rtn的请求(Reply为nil的没有执行)，以及recover得到的panic
+func (dba *DBAccessor) Stop(ctx context.Context) ([]*DBRequest, error) {
+	if dba.stop == nil || dba.stopping() {
+		return nil, errors.New("db accessor is not running")
+	}
+
+	dba.stopCtx = ctx
+	close(dba.stop)
 	go func() {
+		select {
+		case <-ctx.Done():
+			dba.cancelRun(ctx.Err())
+			if dba.cond != nil {
+				//唤醒pin中的等待
+				dba.mu.Lock()
+				dba.cond.Broadcast()
+				dba.mu.Unlock()
+			}
+
+		case <-dba.done:
+		}
+	}()
+
+	<-dba.done
+	defer dba.cancelRun(nil)
+
+	//dispatcher已经退出，不会再有请求分配到worker
+	ret := dba.undelivered
+	errs := dba.errs
+	for _, w := range dba.workers {
+		reqs, err := w.Stop(ctx)
+		ret = append(ret, reqs...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if dba.pool == nil && len(ret) > 0 {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("%d requests unflushed: %w", len(ret), err))
+
+		} else {
+			errs = append(errs, fmt.Errorf("%d requests unflushed", len(ret)))
+		}
+	}
+
+	return ret, errors.Join(errs...)
+}
+
+func (dba *DBAccessor) stopping() bool {
+	select {
+	case <-dba.stop:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// drain 停止后执行剩余的请求，直到全部送到rtn或者stopCtx结束
+func (dba *DBAccessor) drain() {
+	ctx := dba.stopCtx
+	processor := dba.processor
+
+	defer func() {
+		if r := recover(); r != nil {
+			dba.errs = append(dba.errs, fmt.Errorf("%w: %v", ErrPanic, r))
+		}
+
+		dba.undelivered = append(dba.undelivered, processor.TakePending()...)
+		dba.undelivered = append(dba.undelivered, dba.held...)
+		dba.held = nil
+	}()
+
+	pending := dba.undelivered
+	dba.undelivered = nil
+	for i, req := range pending {
+		if !dba.deliver(req, ctx.Done()) {
+			dba.undelivered = append(dba.undelivered, pending[i+1:]...)
+			return
+		}
+	}
+
+	for {
+		if _, ok := dba.appendRequest(false); !ok {
+			break
+		}
+	}
+
+	for !processor.Empty() && ctx.Err() == nil {
+		if !dba.execute(ctx.Done()) {
+			return
+		}
+
+		retryAt := processor.NextRetryTime()
+		if !processor.Idle() || retryAt.IsZero() {
+			//没有RetryPolicy时立即重试
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(retryAt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+	}
+}
+
+func (dba *DBAccessor) runPool() {
+	dba.cond = sync.NewCond(&dba.mu)
+	dba.pins = make(map[*RowContext]*rowPin)
+	dba.workers = make([]*DBAccessor, dba.nWorker)
+
+	nBuf := cap(dba.req)
+	if nBuf < 256 {
+		nBuf = 256
+	}
+
+	for i := range dba.workers {
+		p := NewProcessor(dba.processor.driver)
+		p.batchSize = dba.processor.batchSize
+		p.timeout = dba.processor.timeout
+		p.retry = dba.processor.retry
+
+		w := &DBAccessor{
+			processor:  p,
+			req:        make(chan *DBRequest, nBuf),
+			rtn:        dba.rtn,
+			pool:       dba,
+			wal:        dba.wal,
+			memberWait: dba.memberWait,
+		}
+		dba.workers[i] = w
+		w.Run()
+	}
+
+	go func() {
+		defer close(dba.done)
+		dba.held, dba.replay = dba.replay, nil
 		for {
-			dba.processRequest(dba.Empty())
+			req := dba.takeHeld()
+			if req == nil {
+				select {
+				case req = <-dba.req:
+
+				case <-dba.stop:
+					//channel中已有的请求
+					req = dba.getReq()
+				}
+			}
+
+			if req == nil {
+				return
+			}
+
+			dba.dispatch(dba.readUnit(req))
 		}
 	}()
 }
 
+// dispatch 把一组必须在同一个worker上执行的请求(PreReq和它的后续请求，TxGroup的全部成员)分配到worker
+func (dba *DBAccessor) dispatch(unit []*DBRequest) {
+	for _, r := range unit {
+		dba.logRequest(r)
+	}
+
+	w := dba.workers[dba.pin(unit)]
+	for i, r := range unit {
+		select {
+		case w.req <- r:
+
+		case <-dba.processor.ctx.Done():
+			dba.undelivered = append(dba.undelivered, unit[i:]...)
+			return
+		}
+	}
+}
+
+// partition 按表名和shard值选择worker
+func (dba *DBAccessor) partition(req *DBRequest) int {
+	if req.Schema == nil || int(req.ShardId) >= len(req.Keys) {
+		return 0
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(req.Schema.Name))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(req.Keys[req.ShardId]))
+	return int(h.Sum32() % uint32(len(dba.workers)))
+}
+
+// pin 选择unit执行的worker，unit中的行已经在不同的worker上有请求时，等待它们返回；
+// Stop的ctx结束时不再等待，worker停止时把没有执行的请求返回
+func (dba *DBAccessor) pin(unit []*DBRequest) int {
+	dba.mu.Lock()
+	defer dba.mu.Unlock()
+
+	var w int
+	for {
+		conflict := false
+		w = -1
+		for _, req := range unit {
+			if req.RowContext == nil {
+				continue
+			}
+
+			if pin := dba.pins[req.RowContext]; pin != nil {
+				if w >= 0 && w != pin.worker {
+					conflict = true
+					break
+				}
+				w = pin.worker
+			}
+		}
+
+		if !conflict || dba.processor.ctx.Err() != nil {
+			break
+		}
+		dba.cond.Wait()
+	}
+
+	if w < 0 {
+		w = dba.partition(unit[0])
+	}
+
+	for _, req := range unit {
+		if req.RowContext == nil {
+			continue
+		}
+
+		pin := dba.pins[req.RowContext]
+		if pin == nil {
+			pin = &rowPin{worker: w}
+			dba.pins[req.RowContext] = pin
+		}
+		pin.n++
+	}
+
+	dba.nPending.Add(int32(len(unit)))
+	return w
+}
+
+// release worker返回请求时调用
+func (dba *DBAccessor) release(req *DBRequest) {
+	if rc := req.RowContext; rc != nil {
+		dba.mu.Lock()
+		if pin := dba.pins[rc]; pin != nil {
+			pin.n--
+			if pin.n == 0 {
+				delete(dba.pins, rc)
+				dba.cond.Broadcast()
+			}
+		}
+		dba.mu.Unlock()
+	}
+
+	dba.nPending.Add(-1)
+}
+
 func (dba *DBAccessor) Driver() Driver {
 	return dba.processor.Driver()
 }
 
+// PendingReqNum pool模式下返回已分配、还没有返回的请求数(不考虑合并)
 func (dba *DBAccessor) PendingReqNum() int32 {
+	if dba.workers != nil {
+		return dba.nPending.Load()
+	}
+
 	return dba.processor.PendingReqNum()
 }
 
 func (dba *DBAccessor) Empty() bool {
+	if dba.workers != nil {
+		return dba.nPending.Load() == 0
+	}
+
 	return dba.processor.Empty()
 }
 
-func (dba *DBAccessor) getReq(wait bool) *DBRequest {
-	if wait {
-		return <-dba.req
+func (dba *DBAccessor) getReq() *DBRequest {
+	select {
+	case req := <-dba.req:
+		return req
+
+	default:
+		return nil
+	}
+}
+
+// waitReq 等待新的请求，有请求等待重试时最多等到重试的时间
+func (dba *DBAccessor) waitReq() *DBRequest {
+	retryAt := dba.processor.NextRetryTime()
+	if retryAt.IsZero() {
+		select {
+		case req := <-dba.req:
+			return req
+
+		case <-dba.stop:
+			return nil
+		}
 	}
 
+	timer := time.NewTimer(time.Until(retryAt))
+	defer timer.Stop()
+
 	select {
 	case req := <-dba.req:
 		return req
 
-	default:
+	case <-timer.C:
+		return nil
+
+	case <-dba.stop:
+		return nil
+	}
+}
+
+// waitMember 等待PreReq的后续请求或TxGroup的其他成员，最多等到deadline；停止后只读取channel中已有的请求。
+// 返回nil表示没有等到
+func (dba *DBAccessor) waitMember(deadline time.Time) *DBRequest {
+	if req := dba.takeHeld(); req != nil {
+		return req
+	}
+
+	if req := dba.getReq(); req != nil || dba.stopping() {
+		return req
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case req := <-dba.req:
+		return req
+
+	case <-timer.C:
 		return nil
+
+	case <-dba.stop:
+		return dba.getReq()
 	}
 }
 
+func (dba *DBAccessor) takeHeld() *DBRequest {
+	if len(dba.held) == 0 {
+		return nil
+	}
+
+	req := dba.held[0]
+	dba.held = dba.held[1:]
+	return req
+}
+
+// readUnit 读取req之后必须连续执行的请求(PreReq的后续请求，TxGroup的其他成员)。
+// 等待期间读取到的其他请求放入held，在unit之后处理；成员没有到齐时设置TxGroup的失败结果，
+// 已经读取的成员仍然加入unit，由Processor直接返回失败
+func (dba *DBAccessor) readUnit(req *DBRequest) []*DBRequest {
+	unit := []*DBRequest{req}
+	deadline := time.Now().Add(dba.memberWait)
+	if req.PreReq {
+		if follower := dba.waitMember(deadline); follower != nil {
+			unit = append(unit, follower)
+		}
+	}
+
+	group := req.TxGroup
+	if group == nil || group.failed != nil {
+		return unit
+	}
+
+	n := 0
+	for _, r := range unit {
+		if r.TxGroup == group {
+			n++
+		}
+	}
+
+	var others []*DBRequest
+	for n < group.Num {
+		r := dba.waitMember(deadline)
+		if r == nil {
+			group.failed = &DBReply{Data: int64(0), Err: fmt.Errorf("%w: %d of %d", ErrTxGroupIncomplete, n, group.Num)}
+			break
+		}
+
+		if r.TxGroup == group {
+			unit = append(unit, r)
+			n++
+
+		} else {
+			others = append(others, r)
+		}
+	}
+
+	if others != nil {
+		dba.held = append(others, dba.held...)
+	}
+
+	return unit
+}
+
 func (dba *DBAccessor) appendRequest(wait bool) (int32, bool) {
 	processor := dba.processor
-	req := dba.getReq(wait)
+	req := dba.takeHeld()
+	if req == nil && wait {
+		req = dba.waitReq()
+
+	} else if req == nil {
+		req = dba.getReq()
+	}
+
 	if req == nil {
 		return processor.PendingReqNum(), false
 	}
 
-	nAppending := processor.AppendRequest(req)
-	if req.PreReq {
-		req := dba.getReq(true)
-		nAppending = processor.AppendRequest(req)
+	//事务中的请求必须全部到齐才能执行
+	var nAppending int32
+	for _, r := range dba.readUnit(req) {
+		nAppending = dba.append(r)
 	}
 
 	return nAppending, true
 }
 
-func (dba *DBAccessor) execute() {
+// append 记录WAL之后加入Processor
+func (dba *DBAccessor) append(req *DBRequest) int32 {
+	dba.logRequest(req)
+	return dba.processor.AppendRequest(req)
+}
+
+func (dba *DBAccessor) logRequest(req *DBRequest) {
+	if dba.wal != nil && req != nil {
+		if err := dba.wal.Append(req); err != nil {
+			dba.errs = append(dba.errs, err)
+		}
+	}
+}
+
+// execute 返回false表示cancel结束，结果没有全部送出
+func (dba *DBAccessor) execute(cancel <-chan struct{}) bool {
 	processor := dba.processor
 	req := processor.Execute()
 	for req != nil {
-		dba.rtn <- req
+		//Execute返回的请求已经执行完成，没有送到rtn的由Stop返回，不需要重放
+		if dba.wal != nil {
+			if err := dba.wal.Done(req); err != nil {
+				dba.errs = append(dba.errs, err)
+			}
+		}
+
+		if !dba.deliver(req, cancel) {
+			return false
+		}
+
 		req = processor.Execute()
 	}
+
+	return true
+}
+
+// deliver 把请求送到rtn，cancel结束时放弃，请求由Stop返回
+func (dba *DBAccessor) deliver(req *DBRequest, cancel <-chan struct{}) bool {
+	select {
+	case dba.rtn <- req:
+
+	default:
+		select {
+		case dba.rtn <- req:
+
+		case <-cancel:
+			dba.undelivered = append(dba.undelivered, req)
+			return false
+		}
+	}
+
+	//返回之后才允许同一行的请求分配到其他worker，保证结果按顺序返回
+	if dba.pool != nil {
+		dba.pool.release(req)
+	}
+
+	return true
 }
 
 func (dba *DBAccessor) processRequest(wait bool) {
 	defer func() {
-		if err := recover(); err != nil {
+		//请求执行中的panic已经由Processor转换为请求的结果，这里只记录其他的panic
+		if r := recover(); r != nil {
+			dba.errs = append(dba.errs, fmt.Errorf("%w: %v", ErrPanic, r))
 		}
 	}()
 
@@ -80,5 +701,5 @@ func (dba *DBAccessor) processRequest(wait bool) {
 		}
 	}
 
-	dba.execute()
+	dba.execute(dba.stop)
 }
@@ -0,0 +1,225 @@
+package sql
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBAccessor_Pool(t *testing.T) {
+	schema := newTestSchema()
+	driver := NewDBStub()
+	req := make(chan *DBRequest, 64)
+	rtn := make(chan *DBRequest, 64)
+	dba := NewDBAccessor(driver, req, rtn)
+	dba.Processor().SetBatchSize(8)
+	dba.SetWorkerNum(4)
+	dba.Run()
+
+	nRow, nIncr := 32, 10
+	total := nRow*(nIncr+1) + 2
+	done := make(chan map[string][]int64)
+	go func() {
+		//每行的结果按发送的顺序返回
+		seq := make(map[string][]int64, nRow)
+		for i := 0; i < total; i++ {
+			r := <-rtn
+			if r.Custom != nil {
+				seq[r.Keys[1]] = append(seq[r.Keys[1]], r.Custom.(int64))
+			}
+		}
+		done <- seq
+	}()
+
+	rcs := make([]*RowContext, nRow)
+	for i := range rcs {
+		rcs[i] = NewRowContext()
+		id := strconv.Itoa(i)
+		r := newTestRequest(schema, CmdInsert, rcs[i], []string{"1", id}, []string{"uid", "1", "id", id, "gold", "0"})
+		r.Custom = int64(0)
+		r.CanMerge = false
+		req <- r
+	}
+
+	for j := 1; j <= nIncr; j++ {
+		for i := range rcs {
+			r := newTestRequest(schema, CmdIncrBySingle, rcs[i], []string{"1", strconv.Itoa(i)},
+				&IncrByData{Column: "gold", Delta: 1})
+			r.Custom = int64(j)
+			r.CanMerge = false
+			req <- r
+		}
+	}
+
+	//跨行的事务在同一个worker上执行
+	group := NewTxGroup(2, true)
+	req <- &DBRequest{Command: CmdIncrBySingle, Schema: schema, Keys: []string{"1", "0"},
+		Data: &IncrByData{Column: "gold", Delta: 100}, RowContext: rcs[0], TxGroup: group}
+	req <- &DBRequest{Command: CmdIncrBySingle, Schema: schema, Keys: []string{"1", "1"},
+		Data: &IncrByData{Column: "gold", Delta: 100}, RowContext: rcs[1], TxGroup: group}
+
+	seq := <-done
+	require.Len(t, seq, nRow)
+	for id, s := range seq {
+		require.Len(t, s, nIncr+1, id)
+		for j, v := range s {
+			require.Equal(t, int64(j), v, id)
+		}
+	}
+
+	for i := range rcs {
+		reply := driver.SelectSingle(schema, "1", []string{"1", strconv.Itoa(i)})
+		expected := nIncr
+		if i < 2 {
+			expected += 100
+		}
+		require.Equal(t, strconv.Itoa(expected), GetValueByIndex(schema, reply.Data.([]byte), 3))
+	}
+
+	require.True(t, dba.Empty())
+}
+
+func TestDBAccessor_Stop(t *testing.T) {
+	schema := newTestSchema()
+	driver := NewDBStub()
+	req := make(chan *DBRequest, 16)
+	rtn := make(chan *DBRequest, 16)
+	dba := NewDBAccessor(driver, req, rtn)
+	dba.Run()
+
+	//channel中已有的请求在Stop时执行完
+	for i := 0; i < 8; i++ {
+		id := strconv.Itoa(i)
+		req <- newTestRequest(schema, CmdInsert, NewRowContext(), []string{"1", id}, []string{"uid", "1", "id", id})
+	}
+
+	reqs, err := dba.Stop(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, reqs)
+	require.Len(t, rtn, 8)
+	require.True(t, dba.Empty())
+
+	_, err = dba.Stop(context.Background())
+	require.Error(t, err)
+}
+
+func TestDBAccessor_StopTimeout(t *testing.T) {
+	schema := newTestSchema()
+	req := make(chan *DBRequest, 16)
+	//没有人读取结果
+	rtn := make(chan *DBRequest)
+	dba := NewDBAccessor(&stuckDriver{DBStub: NewDBStub()}, req, rtn)
+	dba.Run()
+
+	req <- newTestRequest(schema, CmdInsert, NewRowContext(), []string{"1", "1"}, []string{"uid", "1", "id", "1"})
+	req <- newTestRequest(schema, CmdUpdateSingle, NewRowContext(), []string{"1", "2"}, []string{"gold", "1"})
+
+	//等待Insert开始执行
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	//卡住的Insert在ctx结束时取消
+	reqs, err := dba.Stop(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, reqs, 2)
+	require.ErrorIs(t, reqs[0].Reply.Err, ErrTimeout)
+	require.Equal(t, CmdUpdateSingle, reqs[1].Command)
+	require.Nil(t, reqs[1].Reply)
+}
+
+func TestDBAccessor_PoolStop(t *testing.T) {
+	schema := newTestSchema()
+	req := make(chan *DBRequest, 64)
+	rtn := make(chan *DBRequest, 64)
+	dba := NewDBAccessor(NewDBStub(), req, rtn)
+	dba.SetWorkerNum(4)
+	dba.Run()
+
+	for i := 0; i < 32; i++ {
+		id := strconv.Itoa(i)
+		req <- newTestRequest(schema, CmdInsert, NewRowContext(), []string{"1", id}, []string{"uid", "1", "id", id})
+	}
+
+	reqs, err := dba.Stop(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, reqs)
+	require.Len(t, rtn, 32)
+	require.True(t, dba.Empty())
+}
+
+func TestDBAccessor_TxGroupWait(t *testing.T) {
+	schema := newTestSchema()
+	driver := NewDBStub()
+	req := make(chan *DBRequest, 16)
+	rtn := make(chan *DBRequest, 16)
+	dba := NewDBAccessor(driver, req, rtn)
+	dba.SetMemberWait(50 * time.Millisecond)
+	dba.Run()
+	defer dba.Stop(context.Background())
+
+	insert := func(id string, group *TxGroup) *DBRequest {
+		r := newTestRequest(schema, CmdInsert, NewRowContext(), []string{"1", id}, []string{"uid", "1", "id", id})
+		r.TxGroup = group
+		return r
+	}
+
+	//请求在成员之间插入时，事务仍然执行，其他请求在事务之后返回
+	group := NewTxGroup(2, true)
+	req <- insert("1", group)
+	req <- insert("2", nil)
+	req <- insert("3", group)
+	for _, id := range []string{"1", "3", "2"} {
+		r := <-rtn
+		require.Equal(t, id, r.Keys[1])
+		require.NoError(t, r.Reply.Err)
+		require.Equal(t, int64(1), r.Reply.Data)
+	}
+
+	//成员没有到齐时失败，不阻塞之后的请求
+	group = NewTxGroup(2, true)
+	req <- insert("4", group)
+	r := <-rtn
+	require.ErrorIs(t, r.Reply.Err, ErrTxGroupIncomplete)
+
+	req <- insert("5", nil)
+	r = <-rtn
+	require.Equal(t, "5", r.Keys[1])
+	require.NoError(t, r.Reply.Err)
+
+	//迟到的成员同样失败
+	req <- insert("6", group)
+	r = <-rtn
+	require.ErrorIs(t, r.Reply.Err, ErrTxGroupIncomplete)
+	require.Nil(t, driver.SelectSingle(schema, "1", []string{"1", "4"}).Data)
+	require.Nil(t, driver.SelectSingle(schema, "1", []string{"1", "6"}).Data)
+}
+
+func TestDBAccessor_StopWaitingMember(t *testing.T) {
+	schema := newTestSchema()
+	for _, nWorker := range []int{1, 4} {
+		req := make(chan *DBRequest, 16)
+		rtn := make(chan *DBRequest, 16)
+		dba := NewDBAccessor(NewDBStub(), req, rtn)
+		dba.SetWorkerNum(nWorker)
+		dba.SetMemberWait(time.Hour)
+		dba.Run()
+
+		//等待事务的其他成员时Stop不会阻塞
+		r := newTestRequest(schema, CmdInsert, NewRowContext(), []string{"1", "1"}, []string{"uid", "1", "id", "1"})
+		r.TxGroup = NewTxGroup(2, true)
+		req <- r
+		time.Sleep(10 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		reqs, err := dba.Stop(ctx)
+		cancel()
+		require.NoError(t, err, nWorker)
+		require.Empty(t, reqs, nWorker)
+		require.Len(t, rtn, 1, nWorker)
+		require.ErrorIs(t, (<-rtn).Reply.Err, ErrTxGroupIncomplete, nWorker)
+	}
+}
@@ -1,36 +1,66 @@
 package sql
 
 import (
+	"context"
 	"fmt"
 	"strconv"
+	"sync"
 )
 
+// DBStub 可以被多个goroutine同时访问，每次操作对所有表加锁
 type DBStub struct {
 	fakeReply bool
 	schema    *TableSchema
 	schemaErr error
 	reply     *DBReply
+	mu        *sync.Mutex
 	tables    map[string]map[string][]byte
+	//事务中修改前的行，Rollback时逆序恢复
+	undo   []stubUndo
+	inTx   bool
+	closed bool
+}
+
+// stubTx 与DBStub共享数据，修改立即对其他连接可见，Rollback只恢复事务自己修改的行
+type stubTx struct {
+	*DBStub
+}
+
+type stubUndo struct {
+	table string
+	key   string
+	//nil表示修改前不存在
+	row []byte
 }
 
 func NewDBStub() *DBStub {
 	return &DBStub{
+		mu:     &sync.Mutex{},
 		tables: make(map[string]map[string][]byte),
 	}
 }
 
 func (db *DBStub) SetFakeSchemaReply(schema *TableSchema, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	db.schema = schema
 	db.schemaErr = err
 	db.fakeReply = true
 }
 
 func (db *DBStub) SetFakeReply(reply *DBReply) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	db.reply = reply
 	db.fakeReply = true
 }
 
 func (db *DBStub) LoadTableSchema(_ string) (*TableSchema, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	if db.fakeReply {
 		db.fakeReply = false
 		return db.schema, db.schemaErr
@@ -39,7 +69,70 @@ func (db *DBStub) LoadTableSchema(_ string) (*TableSchema, error) {
 	return nil, fmt.Errorf("can not fake schema")
 }
 
+func (db *DBStub) Begin() (Tx, error) {
+	return &stubTx{DBStub: &DBStub{
+		mu:     db.mu,
+		tables: db.tables,
+		undo:   make([]stubUndo, 0, 4),
+		inTx:   true,
+	}}, nil
+}
+
+func (tx *stubTx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.closed {
+		return fmt.Errorf("transaction has been committed or rolled back")
+	}
+
+	tx.closed = true
+	tx.undo = nil
+	return nil
+}
+
+func (tx *stubTx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.closed {
+		return fmt.Errorf("transaction has been committed or rolled back")
+	}
+
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		u := &tx.undo[i]
+		table := tx.tables[u.table]
+		if u.row == nil {
+			delete(table, u.key)
+
+		} else {
+			table[u.key] = u.row
+		}
+	}
+
+	tx.closed = true
+	tx.undo = nil
+	return nil
+}
+
+// setRow row为nil时删除
+func (db *DBStub) setRow(name string, table map[string][]byte, key string, row []byte) {
+	if db.inTx {
+		db.undo = append(db.undo, stubUndo{table: name, key: key, row: table[key]})
+	}
+
+	if row == nil {
+		delete(table, key)
+
+	} else {
+		table[key] = row
+	}
+}
+
 func (db *DBStub) Insert(schema *TableSchema, _ string, fields []string) *DBReply {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	if db.fakeReply {
 		db.fakeReply = false
 		return db.reply
@@ -61,11 +154,47 @@ func (db *DBStub) Insert(schema *TableSchema, _ string, fields []string) *DBRepl
 		return &DBReply{Data: int64(0), Msg: "duplicate key"}
 	}
 
-	table[key] = row
+	db.setRow(schema.Name, table, key, row)
+	return &DBReply{Data: int64(1)}
+}
+
+func (db *DBStub) Upsert(schema *TableSchema, _ string, fields []string) *DBReply {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.fakeReply {
+		db.fakeReply = false
+		return db.reply
+	}
+
+	row := NewRowDataFromSlice(schema, fields)
+	if row == nil {
+		return &DBReply{Data: int64(0), Msg: "invalid fields"}
+	}
+
+	key := GetRowKey(schema, row)
+	table, ok := db.tables[schema.Name]
+	if !ok {
+		table = make(map[string][]byte)
+		db.tables[schema.Name] = table
+	}
+
+	if prev, ok := table[key]; ok {
+		mFields := rowData2Map(schema, prev, true)
+		for i := 0; i < len(fields); i += 2 {
+			mFields[fields[i]] = fields[i+1]
+		}
+		row = NewRowDataFromMap(schema, mFields)
+	}
+
+	db.setRow(schema.Name, table, key, row)
 	return &DBReply{Data: int64(1)}
 }
 
 func (db *DBStub) DeleteSingle(schema *TableSchema, _ string, keys []string) *DBReply {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	if db.fakeReply {
 		db.fakeReply = false
 		return db.reply
@@ -82,7 +211,7 @@ func (db *DBStub) DeleteSingle(schema *TableSchema, _ string, keys []string) *DB
 	}
 
 	if _, ok = table[key]; ok {
-		delete(table, key)
+		db.setRow(schema.Name, table, key, nil)
 		return &DBReply{Data: int64(1)}
 	}
 
@@ -90,6 +219,9 @@ func (db *DBStub) DeleteSingle(schema *TableSchema, _ string, keys []string) *DB
 }
 
 func (db *DBStub) UpdateSingle(schema *TableSchema, _ string, keys []string, fields []string) *DBReply {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	if db.fakeReply {
 		db.fakeReply = false
 		return db.reply
@@ -105,6 +237,15 @@ func (db *DBStub) UpdateSingle(schema *TableSchema, _ string, keys []string, fie
 		return &DBReply{Data: int64(0), Msg: "invalid fields"}
 	}
 
+	var version string
+	if schema.versioned() {
+		var ok bool
+		if fields, version, ok = schema.splitVersion(fields); !ok {
+			return &DBReply{Data: int64(0), Msg: "missing version"}
+		}
+		nField = len(fields)
+	}
+
 	table, ok := db.tables[schema.Name]
 	if !ok {
 		return &DBReply{Data: int64(0)}
@@ -115,7 +256,11 @@ func (db *DBStub) UpdateSingle(schema *TableSchema, _ string, keys []string, fie
 		return &DBReply{Data: int64(0)}
 	}
 
-	mFields := RowData2Map(schema, row)
+	mFields := rowData2Map(schema, row, true)
+	if reply := incrVersion(schema, mFields, version); reply != nil {
+		return reply
+	}
+
 	for i := 0; i < nField; i += 2 {
 		mFields[fields[i]] = fields[i+1]
 	}
@@ -125,12 +270,15 @@ func (db *DBStub) UpdateSingle(schema *TableSchema, _ string, keys []string, fie
 		return &DBReply{Data: int64(0), Msg: "invalid fields"}
 	}
 
-	table[key] = row
+	db.setRow(schema.Name, table, key, row)
 	return &DBReply{Data: int64(1)}
 
 }
 
 func (db *DBStub) IncrBySingle(schema *TableSchema, shard string, keys []string, data *IncrByData) *DBReply {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	if db.fakeReply {
 		db.fakeReply = false
 		return db.reply
@@ -151,6 +299,11 @@ func (db *DBStub) IncrBySingle(schema *TableSchema, shard string, keys []string,
 		return &DBReply{Data: int64(0)}
 	}
 
+	mFields := rowData2Map(schema, row, true)
+	if reply := incrVersion(schema, mFields, data.Version); reply != nil {
+		return reply
+	}
+
 	parser, err := CreateParser(schema, shard, data.Where, nil)
 	if err != nil {
 		return &DBReply{Data: int64(0), Msg: err.Error()}
@@ -159,28 +312,62 @@ func (db *DBStub) IncrBySingle(schema *TableSchema, shard string, keys []string,
 		return &DBReply{Data: int64(0)}
 	}
 
-	mFields := RowData2Map(schema, row)
-	v, ok := mFields[data.Column]
-	if !ok {
-		return &DBReply{Data: int64(0), Msg: "invalid field"}
+	deltas := data.ColumnDeltas()
+	if len(deltas) == 0 {
+		return &DBReply{Data: int64(0), Msg: "invalid fields"}
 	}
 
-	iv, err := strconv.ParseInt(v, 10, 64)
-	if err != nil {
-		return &DBReply{Data: int64(0), Msg: "invalid field"}
+	values := make(map[string]int64, len(deltas))
+	for _, cd := range deltas {
+		v, ok := mFields[cd.Column]
+		if !ok {
+			return &DBReply{Data: int64(0), Msg: "invalid field"}
+		}
+
+		iv, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return &DBReply{Data: int64(0), Msg: "invalid field"}
+		}
+
+		values[cd.Column] = iv + cd.Delta
 	}
 
-	mFields[data.Column] = strconv.FormatInt(iv+data.Delta, 10)
+	for i := range data.Guards {
+		guard := &data.Guards[i]
+		if !guard.valid() {
+			return &DBReply{Data: int64(0), Msg: "invalid guard"}
+		}
+
+		v, ok := values[guard.Column]
+		if !ok {
+			iv, err := strconv.ParseInt(mFields[guard.Column], 10, 64)
+			if err != nil {
+				return &DBReply{Data: int64(0), Msg: "invalid field"}
+			}
+			v = iv
+		}
+
+		if !guard.check(v) {
+			return &DBReply{Data: int64(0)}
+		}
+	}
+
+	for column, v := range values {
+		mFields[column] = strconv.FormatInt(v, 10)
+	}
 	row = NewRowDataFromMap(schema, mFields)
 	if row == nil {
 		return &DBReply{Data: int64(0), Msg: "invalid fields"}
 	}
 
-	table[key] = row
+	db.setRow(schema.Name, table, key, row)
 	return &DBReply{Data: int64(1)}
 }
 
 func (db *DBStub) SelectSingle(schema *TableSchema, _ string, keys []string) *DBReply {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	if db.fakeReply {
 		db.fakeReply = false
 		return db.reply
@@ -201,7 +388,10 @@ func (db *DBStub) SelectSingle(schema *TableSchema, _ string, keys []string) *DB
 	return &DBReply{Data: rowData}
 }
 
-func (db *DBStub) SelectMulti(schema *TableSchema, shard string) *DBReply {
+func (db *DBStub) SelectMulti(schema *TableSchema, shard string, query *SelectQuery) *DBReply {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	if db.fakeReply {
 		db.fakeReply = false
 		return db.reply
@@ -220,10 +410,45 @@ func (db *DBStub) SelectMulti(schema *TableSchema, shard string) *DBReply {
 		}
 	}
 
+	if query != nil {
+		sp, err := query.plan(schema, shard)
+		if err != nil {
+			return &DBReply{Data: [][]byte(nil), Msg: err.Error()}
+		}
+		multiRowData = sp.apply(schema, multiRowData)
+	}
+
 	return &DBReply{Data: multiRowData}
 }
 
+func (db *DBStub) AggregateMulti(schema *TableSchema, shard string, query *AggregateQuery) *DBReply {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.fakeReply {
+		db.fakeReply = false
+		return db.reply
+	}
+
+	ap, err := query.plan(schema, shard)
+	if err != nil {
+		return &DBReply{Data: (*AggregateResult)(nil), Msg: err.Error()}
+	}
+
+	var rows [][]byte
+	for _, rowData := range db.tables[schema.Name] {
+		if shard == GetValueByIndex(schema, rowData, schema.ShardIndex) {
+			rows = append(rows, rowData)
+		}
+	}
+
+	return &DBReply{Data: ap.apply(schema, rows)}
+}
+
 func (db *DBStub) DeleteMulti(schema *TableSchema, shard string, data *MultiRequestData) *DBReply {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	if db.fakeReply {
 		db.fakeReply = false
 		return db.reply
@@ -256,8 +481,155 @@ func (db *DBStub) DeleteMulti(schema *TableSchema, shard string, data *MultiRequ
 	}
 
 	for _, k := range keys {
-		delete(table, k)
+		db.setRow(schema.Name, table, k, nil)
 	}
 
 	return &DBReply{Data: nRow}
 }
+
+// incrVersion 有版本列时检查版本并加1，不一致时返回冲突的结果
+func incrVersion(schema *TableSchema, mFields map[string]string, version string) *DBReply {
+	if !schema.versioned() {
+		return nil
+	}
+
+	if version == "" {
+		return &DBReply{Data: int64(0), Msg: "missing version"}
+	}
+
+	if mFields[schema.VersionColumn] != version {
+		return &DBReply{Data: int64(0), Err: ErrVersionConflict}
+	}
+
+	v, _ := strconv.ParseInt(version, 10, 64)
+	mFields[schema.VersionColumn] = strconv.FormatInt(v+1, 10)
+	return nil
+}
+
+func (db *DBStub) Batch(schema *TableSchema, cmd DBCommand, items []BatchItem) []*DBReply {
+	replies := make([]*DBReply, len(items))
+	for i := range items {
+		item := &items[i]
+		switch cmd {
+		case CmdInsert:
+			replies[i] = db.Insert(schema, item.Shard, item.Fields)
+
+		case CmdUpdateSingle:
+			replies[i] = db.UpdateSingle(schema, item.Shard, item.Keys, item.Fields)
+
+		default:
+			replies[i] = &DBReply{Err: fmt.Errorf("nonsupport batch cmd: %d", cmd)}
+		}
+	}
+
+	return replies
+}
+
+// ctxReply ctx已经结束时返回的失败结果，DBStub不会阻塞，只在执行前检查
+func ctxReply(ctx context.Context) *DBReply {
+	if err := ctx.Err(); err != nil {
+		return &DBReply{Data: int64(0), Err: err}
+	}
+
+	return nil
+}
+
+func (db *DBStub) LoadTableSchemaContext(ctx context.Context, tableName string) (*TableSchema, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return db.LoadTableSchema(tableName)
+}
+
+func (db *DBStub) BeginContext(ctx context.Context) (Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return db.Begin()
+}
+
+func (db *DBStub) InsertContext(ctx context.Context, schema *TableSchema, shard string, fields []string) *DBReply {
+	if reply := ctxReply(ctx); reply != nil {
+		return reply
+	}
+
+	return db.Insert(schema, shard, fields)
+}
+
+func (db *DBStub) UpsertContext(ctx context.Context, schema *TableSchema, shard string, fields []string) *DBReply {
+	if reply := ctxReply(ctx); reply != nil {
+		return reply
+	}
+
+	return db.Upsert(schema, shard, fields)
+}
+
+func (db *DBStub) DeleteSingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string) *DBReply {
+	if reply := ctxReply(ctx); reply != nil {
+		return reply
+	}
+
+	return db.DeleteSingle(schema, shard, keys)
+}
+
+func (db *DBStub) UpdateSingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string, fields []string) *DBReply {
+	if reply := ctxReply(ctx); reply != nil {
+		return reply
+	}
+
+	return db.UpdateSingle(schema, shard, keys, fields)
+}
+
+func (db *DBStub) IncrBySingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string, data *IncrByData) *DBReply {
+	if reply := ctxReply(ctx); reply != nil {
+		return reply
+	}
+
+	return db.IncrBySingle(schema, shard, keys, data)
+}
+
+func (db *DBStub) SelectSingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string) *DBReply {
+	if reply := ctxReply(ctx); reply != nil {
+		return reply
+	}
+
+	return db.SelectSingle(schema, shard, keys)
+}
+
+func (db *DBStub) SelectMultiContext(ctx context.Context, schema *TableSchema, shard string, query *SelectQuery) *DBReply {
+	if reply := ctxReply(ctx); reply != nil {
+		return reply
+	}
+
+	return db.SelectMulti(schema, shard, query)
+}
+
+func (db *DBStub) AggregateMultiContext(ctx context.Context, schema *TableSchema, shard string, query *AggregateQuery) *DBReply {
+	if reply := ctxReply(ctx); reply != nil {
+		return reply
+	}
+
+	return db.AggregateMulti(schema, shard, query)
+}
+
+func (db *DBStub) DeleteMultiContext(ctx context.Context, schema *TableSchema, shard string, data *MultiRequestData) *DBReply {
+	if reply := ctxReply(ctx); reply != nil {
+		return reply
+	}
+
+	return db.DeleteMulti(schema, shard, data)
+}
+
+func (db *DBStub) BatchContext(ctx context.Context, schema *TableSchema, cmd DBCommand, items []BatchItem) []*DBReply {
+	if err := ctx.Err(); err != nil {
+		replies := make([]*DBReply, len(items))
+		for i := range replies {
+			replies[i] = &DBReply{Data: int64(0), Err: err}
+		}
+		return replies
+	}
+
+	return db.Batch(schema, cmd, items)
+}
@@ -1,10 +1,12 @@
 package sql
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"go-learner/slice"
 	"math"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +18,21 @@ var ColumnTimeTypes map[string]ColumnType
 // PrimaryKeySeparator ASCII HT = 9
 const PrimaryKeySeparator byte = 9
 
+// NullValue 在fields、map和NewRowData的fieldData中表示SQL NULL，
+// Insert/UpdateSingle等请求的值为NullValue时以NULL作为参数
+const NullValue = "\x00NULL\x00"
+
+// 行数据的第一个字节是格式的各个位：rowFormatNullable在列的偏移量之前有NULL位图，没有NULL的行不设置；
+// rowFormatBinaryInt/rowFormatBinaryFloat表示非主键的整数/浮点数列以8字节二进制保存，由TableSchema.SetBinaryEncoding开启
+const (
+	rowFormatPlain       byte = 0
+	rowFormatNullable    byte = 1
+	rowFormatBinaryInt   byte = 2
+	rowFormatBinaryFloat byte = 4
+
+	rowFormatMask = rowFormatNullable | rowFormatBinaryInt | rowFormatBinaryFloat
+)
+
 type ColumnType uint8
 
 const (
@@ -25,15 +42,63 @@ const (
 	ColumnTypeTime
 )
 
-type Driver interface {
-	LoadTableSchema(tableName string) (*TableSchema, error)
+// Collation 字符串列的排序规则，缓存中的比较、LIKE、MIN/MAX和排序按它与数据库保持一致
+type Collation uint8
+
+const (
+	// CollationBinary 区分大小写，按字节比较：Postgres，MySQL的_bin、_cs和二进制类型
+	CollationBinary Collation = iota
+	// CollationNoCase 不区分大小写，包括LIKE：MySQL的_ci
+	CollationNoCase
+	// CollationBinaryLikeNoCase 比较区分大小写，LIKE不区分ASCII字母的大小写：SQLite默认的BINARY
+	CollationBinaryLikeNoCase
+)
+
+// Executor 单条请求的执行接口，Driver和Tx都实现了它；
+// XxxContext在ctx结束时放弃等待并在DBReply.Err中返回ctx的错误，不带ctx的方法等同于使用context.Background()
+type Executor interface {
 	Insert(schema *TableSchema, shard string, fields []string) *DBReply
+	// Upsert fields与Insert相同，行已存在时更新其中的非主键列，成功时Data为1
+	Upsert(schema *TableSchema, shard string, fields []string) *DBReply
 	DeleteSingle(schema *TableSchema, shard string, keys []string) *DBReply
 	UpdateSingle(schema *TableSchema, shard string, keys []string, fields []string) *DBReply
 	IncrBySingle(schema *TableSchema, shard string, keys []string, data *IncrByData) *DBReply
 	SelectSingle(schema *TableSchema, shard string, keys []string) *DBReply
-	SelectMulti(schema *TableSchema, shard string) *DBReply
+	// SelectMulti query为nil时返回shard的所有行
+	SelectMulti(schema *TableSchema, shard string, query *SelectQuery) *DBReply
 	DeleteMulti(schema *TableSchema, shard string, data *MultiRequestData) *DBReply
+	// AggregateMulti DBReply.Data为*AggregateResult，query为nil时为COUNT(*)
+	AggregateMulti(schema *TableSchema, shard string, query *AggregateQuery) *DBReply
+
+	InsertContext(ctx context.Context, schema *TableSchema, shard string, fields []string) *DBReply
+	UpsertContext(ctx context.Context, schema *TableSchema, shard string, fields []string) *DBReply
+	DeleteSingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string) *DBReply
+	UpdateSingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string, fields []string) *DBReply
+	IncrBySingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string, data *IncrByData) *DBReply
+	SelectSingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string) *DBReply
+	SelectMultiContext(ctx context.Context, schema *TableSchema, shard string, query *SelectQuery) *DBReply
+	DeleteMultiContext(ctx context.Context, schema *TableSchema, shard string, data *MultiRequestData) *DBReply
+	AggregateMultiContext(ctx context.Context, schema *TableSchema, shard string, query *AggregateQuery) *DBReply
+}
+
+type Driver interface {
+	Executor
+	LoadTableSchema(tableName string) (*TableSchema, error)
+	// Batch 批量执行同一个表的Insert或UpdateSingle，返回的结果与items一一对应
+	Batch(schema *TableSchema, cmd DBCommand, items []BatchItem) []*DBReply
+	// Begin 开启事务，Tx中的请求在Commit之前对其他连接不可见
+	Begin() (Tx, error)
+
+	LoadTableSchemaContext(ctx context.Context, tableName string) (*TableSchema, error)
+	BatchContext(ctx context.Context, schema *TableSchema, cmd DBCommand, items []BatchItem) []*DBReply
+	// BeginContext ctx结束前事务没有Commit时自动回滚
+	BeginContext(ctx context.Context) (Tx, error)
+}
+
+type Tx interface {
+	Executor
+	Commit() error
+	Rollback() error
 }
 
 type TableSchemaManager struct {
@@ -49,10 +114,122 @@ type MultiRequestData struct {
 	Parser *Parser
 }
 
+type BatchItem struct {
+	Shard  string
+	Keys   []string
+	Fields []string
+}
+
+// IncrByData Column/Delta和Deltas中的列同时增加；Guards是增加之后的值必须满足的条件，
+// 不满足时不修改，影响行数为0。带Guards或者Where的请求不合并。
+// Version为有版本列的表中行当前的版本，与UpdateSingle的fields中的版本列相同
 type IncrByData struct {
+	Column  string
+	Delta   int64
+	Where   string
+	Deltas  []ColumnDelta
+	Guards  []IncrByGuard
+	Version string
+}
+
+type ColumnDelta struct {
 	Column string
 	Delta  int64
-	Where  string
+}
+
+// IncrByGuard 条件为 Column增加之后的值 Op Value，Op为>=、>、<=、<
+type IncrByGuard struct {
+	Column string
+	Op     string
+	Value  int64
+}
+
+// ColumnDeltas 返回所有增加的列，同一列出现多次时累加
+func (data *IncrByData) ColumnDeltas() []ColumnDelta {
+	if data.Column == "" {
+		return data.Deltas
+	}
+
+	if len(data.Deltas) == 0 {
+		return []ColumnDelta{{Column: data.Column, Delta: data.Delta}}
+	}
+
+	deltas := make([]ColumnDelta, 0, len(data.Deltas)+1)
+	deltas = append(deltas, ColumnDelta{Column: data.Column, Delta: data.Delta})
+	return addColumnDeltas(deltas, data.Deltas)
+}
+
+// DeltaOf 列column增加的值
+func (data *IncrByData) DeltaOf(column string) int64 {
+	var delta int64
+	if data.Column == column {
+		delta = data.Delta
+	}
+
+	for _, cd := range data.Deltas {
+		if cd.Column == column {
+			delta += cd.Delta
+		}
+	}
+
+	return delta
+}
+
+// check 检查增加之后的值
+func (g *IncrByGuard) check(v int64) bool {
+	switch g.Op {
+	case ">=":
+		return v >= g.Value
+	case ">":
+		return v > g.Value
+	case "<=":
+		return v <= g.Value
+	case "<":
+		return v < g.Value
+	default:
+		return false
+	}
+}
+
+func (g *IncrByGuard) valid() bool {
+	switch g.Op {
+	case ">=", ">", "<=", "<":
+		return true
+	default:
+		return false
+	}
+}
+
+func addColumnDeltas(deltas []ColumnDelta, add []ColumnDelta) []ColumnDelta {
+	for _, cd := range add {
+		exist := false
+		for i := range deltas {
+			if deltas[i].Column == cd.Column {
+				deltas[i].Delta += cd.Delta
+				exist = true
+				break
+			}
+		}
+
+		if !exist {
+			deltas = append(deltas, cd)
+		}
+	}
+
+	return deltas
+}
+
+// SchemaInstaller 需要知道哪些schema正在使用的Driver实现该接口，
+// TableSchemaManager第一次加载或者ReloadSchema替换schema后调用InstallSchema
+type SchemaInstaller interface {
+	InstallSchema(schema *TableSchema)
+}
+
+func NewTableSchemaManager(driver Driver) *TableSchemaManager {
+	return &TableSchemaManager{
+		schemas: make(map[string]*TableSchema),
+		driver:  driver,
+	}
 }
 
 func (tsm *TableSchemaManager) LoadSchema(name string) (*TableSchema, error) {
@@ -79,9 +256,15 @@ func (tsm *TableSchemaManager) LoadSchema(name string) (*TableSchema, error) {
 	}
 
 	tsm.schemas[name] = schema
+	if installer, ok := tsm.driver.(SchemaInstaller); ok {
+		installer.InstallSchema(schema)
+	}
+
 	return schema, nil
 }
 
+// ReloadSchema 从数据库重新加载schema，列没有变化并且force为false时返回nil；主键或shard列改变时返回错误。
+// 缓存中的行由Table.ReloadSchema迁移到新的schema
 func (tsm *TableSchemaManager) ReloadSchema(name string, force bool) (*TableSchema, error) {
 	tsm.Lock()
 	defer tsm.Unlock()
@@ -97,29 +280,29 @@ func (tsm *TableSchemaManager) ReloadSchema(name string, force bool) (*TableSche
 		return nil, err
 	}
 
-	if schema1.NumPrimaryKeys != schema2.NumPrimaryKeys {
-		// 这里没有作严格的检查，因为通常不允许有删除列的操作
-		return nil, fmt.Errorf("can not alter key")
+	diff, err := DiffSchema(schema1, schema2)
+	if err != nil {
+		return nil, err
 	}
 
-	if !force {
-		nL1 := len(schema1.Columns)
-		nL2 := len(schema2.Columns)
-		if nL1 == nL2 {
-			eq := true
-			for i := 0; i < nL1; i++ {
-				if !schema1.Columns[i].Equal(&schema2.Columns[i]) {
-					eq = false
-					break
-				}
-			}
-			if eq {
-				return nil, nil
-			}
-		}
+	if !force && diff.Empty() {
+		return nil, nil
 	}
 
+	if err = schema2.SetVersionColumn(schema1.VersionColumn); err != nil {
+		return nil, err
+	}
+	schema2.binaryFormat = schema1.binaryFormat
+
 	tsm.schemas[name] = schema2
+	if installer, ok := tsm.driver.(SchemaInstaller); ok {
+		installer.InstallSchema(schema2)
+	}
+	schema1.parsers.reset()
+	if invalidator, ok := tsm.driver.(SchemaInvalidator); ok {
+		invalidator.InvalidateSchema(schema1)
+	}
+
 	return schema2, nil
 }
 
@@ -136,8 +319,14 @@ type TableSchema struct {
 	NumPrimaryKeys    int
 	PrimaryKeyIndexes []int
 	AutoMTimeFields   []int
+	// VersionColumn 乐观锁的版本列，由SetVersionColumn设置，为空时不检查版本
+	VersionColumn string
+	versionIndex  int
+	// binaryFormat NewRowData使用的二进制编码，由SetBinaryEncoding设置
+	binaryFormat byte
 
 	m                 map[string]int
+	tableName         string
 	whereSingleClause string
 	selectSingle      string
 	selectMulti       string
@@ -146,6 +335,9 @@ type TableSchema struct {
 	insertClause2     string
 	deleteSingle      string
 	deleteMultiPrefix string
+
+	//WHERE的编译缓存，分表复制的schema共用
+	parsers *parserCache
 }
 
 type ColumnSchema struct {
@@ -155,6 +347,10 @@ type ColumnSchema struct {
 	Name         string
 	Type         ColumnType
 	DefaultValue string
+	// DefaultNull 列可以为NULL并且没有默认值，没有指定值时为NULL
+	DefaultNull bool
+	// Collation 字符串列的排序规则，由加载表结构的Driver按数据库设置
+	Collation Collation
 }
 
 func (inst *ColumnSchema) Equal(other *ColumnSchema) bool {
@@ -167,34 +363,59 @@ func (inst *ColumnSchema) Equal(other *ColumnSchema) bool {
 	if inst.Name != other.Name {
 		return false
 	}
-	if inst.DefaultValue != inst.DefaultValue {
+	if inst.DefaultValue != other.DefaultValue {
+		return false
+	}
+	if inst.DefaultNull != other.DefaultNull {
+		return false
+	}
+	if inst.Collation != other.Collation {
 		return false
 	}
 
 	return true
 }
 
+// NewRowData fieldData中等于NullValue的列为NULL
 func NewRowData(schema *TableSchema, fieldData [][]byte) []byte {
+	return NewNullableRowData(schema, fieldData, nil)
+}
+
+// NewNullableRowData nulls[i]为true的列为NULL，nulls为nil时与NewRowData相同
+func NewNullableRowData(schema *TableSchema, fieldData [][]byte, nulls []bool) []byte {
 	nColumn := len(fieldData)
 	if nColumn == 0 {
 		return nil
 	}
 
 	columns := schema.Columns
-	if len(columns) < nColumn {
+	if len(columns) < nColumn || (nulls != nil && len(nulls) < nColumn) {
 		return nil
 	}
 
+	format := rowFormatPlain
+	if schema.binaryFormat != 0 {
+		fieldData, format = encodeBinaryFields(schema, fieldData, nulls)
+	}
+
 	var nData int
+	hasNull := false
 	for i := 0; i < nColumn; i++ {
+		if isNullField(fieldData, nulls, i) {
+			hasNull = true
+			continue
+		}
 		nData += len(fieldData[i])
 	}
 
-	if nData == 0 {
+	if nData == 0 && !hasNull {
 		return nil
 	}
 
 	nHeader := nColumn*4 + 1
+	if hasNull {
+		nHeader += nullBitmapLen(nColumn)
+	}
 	nPrimaryKey := schema.NumPrimaryKeys
 	nData += nHeader + nPrimaryKey
 	if nData > math.MaxUint32 {
@@ -202,13 +423,22 @@ func NewRowData(schema *TableSchema, fieldData [][]byte) []byte {
 	}
 
 	rowData := make([]byte, nData)
-	rowData[0] = 0
+	rowData[0] = format
 
 	headerStart := uint32(1)
 	dataStart := uint32(nHeader)
+	if hasNull {
+		rowData[0] |= rowFormatNullable
+		headerStart += uint32(nullBitmapLen(nColumn))
+	}
 
 	for i := 0; i < nColumn; i++ {
 		data := fieldData[i]
+		if hasNull && isNullField(fieldData, nulls, i) {
+			rowData[1+i>>3] |= 1 << (i & 7)
+			data = nil
+		}
+
 		dataEnd := dataStart + uint32(len(data))
 		//primary keys will start with PrimaryKeySeparator
 		if columns[i].IsPrimaryKey {
@@ -228,6 +458,139 @@ func NewRowData(schema *TableSchema, fieldData [][]byte) []byte {
 	return rowData
 }
 
+func isNullField(fieldData [][]byte, nulls []bool, i int) bool {
+	if nulls != nil {
+		return nulls[i]
+	}
+
+	data := fieldData[i]
+	return len(data) == len(NullValue) && slice.ByteSlice2String(data) == NullValue
+}
+
+func nullBitmapLen(nColumn int) int {
+	return (nColumn + 7) >> 3
+}
+
+// rowHeader 返回列偏移量的起始位置，rowData不是完整的行数据时返回0
+func rowHeader(schema *TableSchema, rowData []byte) uint32 {
+	if len(rowData) < 2 || rowData[0]&^rowFormatMask != 0 {
+		return 0
+	}
+
+	if rowData[0]&rowFormatNullable != 0 {
+		return uint32(1 + nullBitmapLen(len(schema.Columns)))
+	}
+
+	return 1
+}
+
+// isNullColumn rowData必须是完整的行数据
+func isNullColumn(rowData []byte, idx int) bool {
+	return rowData[0]&rowFormatNullable != 0 && rowData[1+idx>>3]&(1<<(idx&7)) != 0
+}
+
+// columnRaw 返回列保存的数据，主键不包含PrimaryKeySeparator；base为rowHeader的结果，idx必须有效
+func columnRaw(schema *TableSchema, rowData []byte, base uint32, idx int) []byte {
+	headerStart := uint32(idx*4) + base
+	dataEnd := binary.LittleEndian.Uint32(rowData[headerStart : headerStart+4])
+
+	var dataStart uint32
+	if idx > 0 {
+		dataStart = binary.LittleEndian.Uint32(rowData[headerStart-4 : headerStart])
+
+	} else {
+		dataStart = uint32(len(schema.Columns)*4) + base
+	}
+
+	if schema.Columns[idx].IsPrimaryKey {
+		dataStart += 1
+	}
+
+	return rowData[dataStart:dataEnd]
+}
+
+// columnText 把列保存的数据转换为文本，二进制编码的数字列需要格式化
+func columnText(cs *ColumnSchema, format byte, raw []byte) string {
+	switch binaryColumnFormat(cs) & format {
+	case rowFormatBinaryInt:
+		if len(raw) == 8 {
+			return strconv.FormatInt(int64(binary.LittleEndian.Uint64(raw)), 10)
+		}
+
+	case rowFormatBinaryFloat:
+		if len(raw) == 8 {
+			return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(raw)), 'f', -1, 64)
+		}
+	}
+
+	return slice.ByteSlice2String(raw)
+}
+
+// binaryColumnFormat 列可以使用的二进制编码，主键总是保存为文本
+func binaryColumnFormat(cs *ColumnSchema) byte {
+	if cs.IsPrimaryKey {
+		return 0
+	}
+
+	switch cs.Type {
+	case ColumnTypeInt:
+		return rowFormatBinaryInt
+	case ColumnTypeFloat:
+		return rowFormatBinaryFloat
+	default:
+		return 0
+	}
+}
+
+// encodeBinaryFields 按schema.binaryFormat把数字列的文本转换为8字节二进制，不修改fieldData，返回行使用的格式；
+// 有值不是合法的数字时(如超过MaxInt64的bigint unsigned)，这一行中同类的列都以文本保存，行的格式去掉对应的位。
+// NULL和空值不转换
+func encodeBinaryFields(schema *TableSchema, fieldData [][]byte, nulls []bool) ([][]byte, byte) {
+	rowFormat := schema.binaryFormat
+	bits := make([]uint64, len(fieldData))
+	for i, data := range fieldData {
+		format := binaryColumnFormat(&schema.Columns[i]) & rowFormat
+		if format == 0 || len(data) == 0 || isNullField(fieldData, nulls, i) {
+			continue
+		}
+
+		if format == rowFormatBinaryInt {
+			v, err := strconv.ParseInt(slice.ByteSlice2String(data), 10, 64)
+			if err != nil {
+				rowFormat &^= rowFormatBinaryInt
+			}
+			bits[i] = uint64(v)
+
+		} else {
+			v, err := strconv.ParseFloat(slice.ByteSlice2String(data), 64)
+			if err != nil {
+				rowFormat &^= rowFormatBinaryFloat
+			}
+			bits[i] = math.Float64bits(v)
+		}
+	}
+
+	encoded := make([][]byte, len(fieldData))
+	copy(encoded, fieldData)
+
+	var buf []byte
+	for i, data := range fieldData {
+		format := binaryColumnFormat(&schema.Columns[i]) & rowFormat
+		if format == 0 || len(data) == 0 || isNullField(fieldData, nulls, i) {
+			continue
+		}
+
+		if len(buf) < 8 {
+			buf = make([]byte, 8*len(fieldData))
+		}
+		encoded[i] = buf[:8:8]
+		buf = buf[8:]
+		binary.LittleEndian.PutUint64(encoded[i], bits[i])
+	}
+
+	return encoded, rowFormat
+}
+
 func NewRowDataFromMap(schema *TableSchema, fields map[string]string) []byte {
 	columns := schema.Columns
 	nColumn := len(columns)
@@ -283,8 +646,15 @@ func NewRowDataFromSlice(schema *TableSchema, fields []string) []byte {
 	return NewRowData(schema, b)
 }
 
+// RowData2Map 空值和NULL列的值为列的默认值，NULL通过GetNullableValueByIndex、IsNullByIndex或RowView读取
 func RowData2Map(schema *TableSchema, rowData []byte) map[string]string {
-	if len(rowData) < 2 || rowData[0] != 0 {
+	return rowData2Map(schema, rowData, false)
+}
+
+// rowData2Map keepNull为true时NULL列的值为NullValue，用于修改后重新生成行数据
+func rowData2Map(schema *TableSchema, rowData []byte, keepNull bool) map[string]string {
+	headerStart := rowHeader(schema, rowData)
+	if headerStart == 0 {
 		return nil
 	}
 
@@ -292,8 +662,7 @@ func RowData2Map(schema *TableSchema, rowData []byte) map[string]string {
 	columns := schema.Columns
 
 	ret := make(map[string]string, nColumn)
-	headerStart := uint32(1)
-	dataStart := uint32(4*nColumn + 1)
+	dataStart := uint32(4*nColumn) + headerStart
 
 	for i := 0; i < nColumn; i++ {
 		headerEnd := headerStart + 4
@@ -307,9 +676,11 @@ func RowData2Map(schema *TableSchema, rowData []byte) map[string]string {
 			v = slice.ByteSlice2String(rowData[dataStart+1 : dataEnd])
 
 		} else {
-			v = slice.ByteSlice2String(rowData[dataStart:dataEnd])
+			v = columnText(cs, rowData[0], rowData[dataStart:dataEnd])
 		}
-		if v == "" {
+		if keepNull && isNullColumn(rowData, i) {
+			v = NullValue
+		} else if v == "" {
 			v = cs.DefaultValue
 		}
 
@@ -324,8 +695,15 @@ func RowData2Map(schema *TableSchema, rowData []byte) map[string]string {
 	return ret
 }
 
+// RowData2Slice 与RowData2Map相同，NULL列的值为列的默认值
 func RowData2Slice(schema *TableSchema, rowData []byte) []string {
-	if len(rowData) < 2 || rowData[0] != 0 {
+	return rowData2Slice(schema, rowData, false)
+}
+
+// rowData2Slice 与rowData2Map相同
+func rowData2Slice(schema *TableSchema, rowData []byte, keepNull bool) []string {
+	headerStart := rowHeader(schema, rowData)
+	if headerStart == 0 {
 		return nil
 	}
 
@@ -333,8 +711,7 @@ func RowData2Slice(schema *TableSchema, rowData []byte) []string {
 	columns := schema.Columns
 
 	ret := make([]string, nColumn<<1)
-	headerStart := uint32(1)
-	dataStart := uint32(4*nColumn + 1)
+	dataStart := uint32(4*nColumn) + headerStart
 
 	j := 0
 	for i := 0; i < nColumn; i++ {
@@ -351,9 +728,11 @@ func RowData2Slice(schema *TableSchema, rowData []byte) []string {
 			v = slice.ByteSlice2String(rowData[dataStart+1 : dataEnd])
 
 		} else {
-			v = slice.ByteSlice2String(rowData[dataStart:dataEnd])
+			v = columnText(cs, rowData[0], rowData[dataStart:dataEnd])
 		}
-		if v == "" {
+		if keepNull && isNullColumn(rowData, i) {
+			v = NullValue
+		} else if v == "" {
 			v = cs.DefaultValue
 		}
 		ret[j+1] = v
@@ -377,8 +756,13 @@ func GetRowKey(schema *TableSchema, rowData []byte) string {
 
 	//key is sorted
 	if schema.PrimaryKeyIndexes == nil {
-		headerStart := (schema.NumPrimaryKeys-1)*4 + 1
-		dataStart := uint32(4*len(schema.Columns) + 1)
+		base := rowHeader(schema, rowData)
+		if base == 0 {
+			return ""
+		}
+
+		headerStart := uint32(schema.NumPrimaryKeys-1)*4 + base
+		dataStart := uint32(4*len(schema.Columns)) + base
 		dataEnd := binary.LittleEndian.Uint32(rowData[headerStart : headerStart+4])
 
 		return slice.ByteSlice2String(rowData[dataStart:dataEnd])
@@ -464,34 +848,41 @@ func AssembleRowKey2(schema *TableSchema, keys []string) string {
 	return slice.ByteSlice2String(bValue)
 }
 
+// GetValueByIndex 空值和NULL都返回列的默认值，需要区分NULL时使用GetNullableValueByIndex
 func GetValueByIndex(schema *TableSchema, rowData []byte, idx int) string {
-	if len(rowData) < 2 || rowData[0] == PrimaryKeySeparator {
-		return ""
+	v, null := GetNullableValueByIndex(schema, rowData, idx)
+	if null {
+		return schema.Columns[idx].DefaultValue
 	}
 
-	//invoker need guarantee idx is valid
-	headerStart := idx*4 + 1
-	dataEnd := binary.LittleEndian.Uint32(rowData[headerStart : headerStart+4])
-
-	var dataStart uint32
-	if idx > 0 {
-		dataStart = binary.LittleEndian.Uint32(rowData[headerStart-4 : headerStart])
+	return v
+}
 
-	} else {
-		dataStart = uint32(len(schema.Columns)*4 + 1)
+// GetNullableValueByIndex 返回列的值和是否为NULL，NULL时值为空字符串；不是NULL的空值仍然返回默认值
+func GetNullableValueByIndex(schema *TableSchema, rowData []byte, idx int) (string, bool) {
+	base := rowHeader(schema, rowData)
+	if base == 0 {
+		return "", false
 	}
 
-	cs := &schema.Columns[idx]
-	if cs.IsPrimaryKey {
-		dataStart += 1
+	if isNullColumn(rowData, idx) {
+		return "", true
 	}
 
-	v := slice.ByteSlice2String(rowData[dataStart:dataEnd])
+	//invoker need guarantee idx is valid
+	cs := &schema.Columns[idx]
+	v := columnText(cs, rowData[0], columnRaw(schema, rowData, base, idx))
 	if v == "" {
 		v = cs.DefaultValue
 	}
 
-	return v
+	return v, false
+}
+
+// IsNullByIndex 列是否为NULL
+func IsNullByIndex(schema *TableSchema, rowData []byte, idx int) bool {
+	_, null := GetNullableValueByIndex(schema, rowData, idx)
+	return null
 }
 
 func CheckFields(schema *TableSchema, fields []string) bool {
@@ -513,6 +904,86 @@ func CheckFields(schema *TableSchema, fields []string) bool {
 	return true
 }
 
+func (ts *TableSchema) primaryKeyIndex(i int) int {
+	if ts.PrimaryKeyIndexes == nil {
+		return i
+	}
+
+	return ts.PrimaryKeyIndexes[i]
+}
+
+// SetVersionColumn 设置乐观锁的版本列，必须是非主键的整数列，name为空时取消；需要在schema被使用之前设置。
+// 设置后UpdateSingle的fields和IncrBySingle的IncrByData.Version必须带上行当前的版本，
+// 执行时检查版本并加1，版本不一致时DBReply.Err为ErrVersionConflict
+func (ts *TableSchema) SetVersionColumn(name string) error {
+	if name == "" {
+		ts.VersionColumn = ""
+		ts.versionIndex = 0
+		return nil
+	}
+
+	column := ts.GetColumnSchema(name)
+	if column == nil || column.IsPrimaryKey || column.Type != ColumnTypeInt {
+		return fmt.Errorf("invalid version column: %s", name)
+	}
+
+	ts.VersionColumn = name
+	ts.versionIndex = column.Index
+	return nil
+}
+
+// SetBinaryEncoding 之后NewRowData生成的行中，types类型的非主键列以8字节二进制保存，读取时不需要解析文本；
+// 只支持ColumnTypeInt和ColumnTypeFloat(时间列可能有0000-00-00这样的值，仍然保存为文本)，types为空时取消。
+// 行数据的格式中记录了编码，旧格式的行仍然可以读取；需要在schema被使用之前设置
+func (ts *TableSchema) SetBinaryEncoding(types ...ColumnType) error {
+	var format byte
+	for _, t := range types {
+		switch t {
+		case ColumnTypeInt:
+			format |= rowFormatBinaryInt
+		case ColumnTypeFloat:
+			format |= rowFormatBinaryFloat
+		default:
+			return fmt.Errorf("nonsupport binary encoding of column type %d", t)
+		}
+	}
+
+	ts.binaryFormat = format
+	return nil
+}
+
+func (ts *TableSchema) versioned() bool {
+	return ts.VersionColumn != ""
+}
+
+// nextVersion 检查rowData的版本与version相同，返回加1之后的版本；失败时返回原因
+func (ts *TableSchema) nextVersion(rowData []byte, version string) (string, string) {
+	if GetValueByIndex(ts, rowData, ts.versionIndex) != version {
+		return "", "version conflict"
+	}
+
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return "", err.Error()
+	}
+
+	return strconv.FormatInt(v+1, 10), ""
+}
+
+// splitVersion 从UpdateSingle的fields中取出版本列，返回其余的列和期望的版本
+func (ts *TableSchema) splitVersion(fields []string) ([]string, string, bool) {
+	for i := 0; i < len(fields); i += 2 {
+		if fields[i] == ts.VersionColumn {
+			rest := make([]string, 0, len(fields)-2)
+			rest = append(rest, fields[:i]...)
+			rest = append(rest, fields[i+2:]...)
+			return rest, fields[i+1], true
+		}
+	}
+
+	return fields, "", false
+}
+
 func (ts *TableSchema) GetColumnSchema(name string) *ColumnSchema {
 	if idx, ok := ts.m[name]; ok {
 		return &ts.Columns[idx]
@@ -0,0 +1,260 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testDriver 各Driver实现都需要通过的基本用例，schema的列为: uid, id, name, gold，主键为(uid, id)
+func testDriver(t *testing.T, db Driver, schema *TableSchema) {
+	keys := []string{"1", "1"}
+	reply := db.Insert(schema, "1", []string{"uid", "1", "id", "1", "name", "a", "gold", "10"})
+	require.NoError(t, reply.Err)
+	require.Equal(t, int64(1), reply.Data)
+
+	reply = db.Insert(schema, "1", []string{"uid", "1", "id", "1", "name", "a", "gold", "10"})
+	require.NoError(t, reply.Err)
+	require.Equal(t, int64(0), reply.Data)
+	require.NotEmpty(t, reply.Msg)
+
+	reply = db.UpdateSingle(schema, "1", keys, []string{"name", "b"})
+	require.NoError(t, reply.Err)
+	require.Equal(t, int64(1), reply.Data)
+
+	reply = db.IncrBySingle(schema, "1", keys, &IncrByData{Column: "gold", Delta: 5})
+	require.Equal(t, int64(1), reply.Data)
+	reply = db.IncrBySingle(schema, "1", keys, &IncrByData{Column: "gold", Delta: 5, Where: "gold>=100"})
+	require.Equal(t, int64(0), reply.Data)
+
+	//guards check the value after increment
+	guard := []IncrByGuard{{Column: "gold", Op: ">=", Value: 0}}
+	reply = db.IncrBySingle(schema, "1", keys, &IncrByData{Deltas: []ColumnDelta{{"gold", -20}}, Guards: guard})
+	require.Equal(t, int64(0), reply.Data)
+	reply = db.IncrBySingle(schema, "1", keys, &IncrByData{Deltas: []ColumnDelta{{"gold", -15}}, Guards: guard})
+	require.Equal(t, int64(1), reply.Data)
+	reply = db.IncrBySingle(schema, "1", keys, &IncrByData{Column: "gold", Delta: 10,
+		Deltas: []ColumnDelta{{"gold", 5}}, Guards: []IncrByGuard{{Column: "gold", Op: "<=", Value: 15}}})
+	require.Equal(t, int64(1), reply.Data)
+	reply = db.IncrBySingle(schema, "1", keys, &IncrByData{Column: "gold", Delta: 1,
+		Guards: []IncrByGuard{{Column: "gold", Op: "=", Value: 0}}})
+	require.Equal(t, "invalid guard", reply.Msg)
+
+	reply = db.SelectSingle(schema, "1", keys)
+	require.NoError(t, reply.Err)
+	fields := RowData2Map(schema, reply.Data.([]byte))
+	require.Equal(t, "b", fields["name"])
+	require.Equal(t, "15", fields["gold"])
+
+	replies := db.Batch(schema, CmdInsert, []BatchItem{
+		{Shard: "1", Keys: []string{"1", "2"}, Fields: []string{"uid", "1", "id", "2", "gold", "20"}},
+		{Shard: "1", Keys: []string{"1", "3"}, Fields: []string{"uid", "1", "id", "3", "name", "c"}},
+		{Shard: "1", Keys: []string{"1", "1"}, Fields: []string{"uid", "1", "id", "1"}},
+	})
+	require.Len(t, replies, 3)
+	require.Equal(t, int64(1), replies[0].Data)
+	require.Equal(t, int64(1), replies[1].Data)
+	require.Equal(t, int64(0), replies[2].Data)
+
+	replies = db.Batch(schema, CmdUpdateSingle, []BatchItem{
+		{Shard: "1", Keys: []string{"1", "2"}, Fields: []string{"gold", "21"}},
+		{Shard: "1", Keys: []string{"1", "3"}, Fields: []string{"gold", "31"}},
+	})
+	require.Len(t, replies, 2)
+	require.NoError(t, replies[0].Err)
+	require.NoError(t, replies[1].Err)
+	require.Equal(t, int64(1), replies[0].Data)
+	require.Equal(t, int64(1), replies[1].Data)
+
+	//missing rows are not inserted by a batched update
+	replies = db.Batch(schema, CmdUpdateSingle, []BatchItem{
+		{Shard: "1", Keys: []string{"1", "9"}, Fields: []string{"gold", "90"}},
+		{Shard: "1", Keys: []string{"1", "2"}, Fields: []string{"name", "b", "gold", "21"}},
+		{Shard: "1", Keys: []string{"1", "2"}, Fields: []string{"name", "a"}},
+	})
+	require.Len(t, replies, 3)
+	require.NoError(t, replies[0].Err)
+	require.Equal(t, int64(0), replies[0].Data)
+	require.Equal(t, int64(1), replies[1].Data)
+	require.Equal(t, int64(1), replies[2].Data)
+	require.Nil(t, db.SelectSingle(schema, "1", []string{"1", "9"}).Data)
+
+	reply = db.SelectMulti(schema, "1", nil)
+	require.NoError(t, reply.Err)
+	rows := reply.Data.([][]byte)
+	require.Len(t, rows, 3)
+	for _, row := range rows {
+		fields := RowData2Map(schema, row)
+		switch fields["id"] {
+		case "2":
+			require.Equal(t, "21", fields["gold"])
+		case "3":
+			require.Equal(t, "31", fields["gold"])
+			require.Equal(t, "c", fields["name"])
+		}
+	}
+
+	//gold: id1=15, id2=21, id3=31
+	query := &SelectQuery{Columns: []string{"gold"}, OrderBy: []OrderBy{{Column: "gold", Desc: true}}, Limit: 1}
+	reply = db.SelectMulti(schema, "1", query)
+	require.NoError(t, reply.Err)
+	rows = reply.Data.([][]byte)
+	require.Len(t, rows, 1)
+	require.Equal(t, "3", GetValueByIndex(schema, rows[0], 1))
+	require.Equal(t, "31", GetValueByIndex(schema, rows[0], 3))
+	require.Empty(t, GetValueByIndex(schema, rows[0], 2))
+
+	query.After = query.Cursor(schema, rows[0])
+	query.Limit = 5
+	rows = db.SelectMulti(schema, "1", query).Data.([][]byte)
+	require.Len(t, rows, 2)
+	require.Equal(t, "2", GetValueByIndex(schema, rows[0], 1))
+	require.Equal(t, "1", GetValueByIndex(schema, rows[1], 1))
+
+	query = &SelectQuery{Where: "gold>? AND name!='c'", Params: []string{"16"}}
+	rows = db.SelectMulti(schema, "1", query).Data.([][]byte)
+	require.Len(t, rows, 1)
+	require.Equal(t, "21", GetValueByIndex(schema, rows[0], 3))
+
+	query = &SelectQuery{OrderBy: []OrderBy{{Column: "id"}}, Offset: 1}
+	rows = db.SelectMulti(schema, "1", query).Data.([][]byte)
+	require.Len(t, rows, 2)
+	require.Equal(t, "2", GetValueByIndex(schema, rows[0], 1))
+	require.Equal(t, "b", GetValueByIndex(schema, db.SelectMulti(schema, "1",
+		&SelectQuery{OrderBy: []OrderBy{{Column: "id"}}, Limit: 1}).Data.([][]byte)[0], 2))
+
+	reply = db.SelectMulti(schema, "1", &SelectQuery{OrderBy: []OrderBy{{Column: "foo"}}})
+	require.NotEmpty(t, reply.Msg)
+	reply = db.SelectMulti(schema, "1", &SelectQuery{After: []string{"1"}})
+	require.NotEmpty(t, reply.Msg)
+
+	aggregates := []struct {
+		query    *AggregateQuery
+		expected *AggregateResult
+	}{
+		{nil, &AggregateResult{Value: "3"}},
+		{&AggregateQuery{Func: "sum", Column: "gold"}, &AggregateResult{Value: "67"}},
+		{&AggregateQuery{Func: AggregateMin, Column: "gold", Where: "name!=?", Params: []string{"c"}}, &AggregateResult{Value: "15"}},
+		{&AggregateQuery{Func: AggregateMax, Column: "name"}, &AggregateResult{Value: "c"}},
+		{&AggregateQuery{Func: AggregateCount, Where: "gold>20"}, &AggregateResult{Value: "2"}},
+		{&AggregateQuery{Func: AggregateSum, Column: "gold", Where: "gold>100"}, &AggregateResult{Null: true}},
+	}
+	for _, c := range aggregates {
+		reply = db.AggregateMulti(schema, "1", c.query)
+		require.NoError(t, reply.Err)
+		require.Empty(t, reply.Msg)
+		require.Equal(t, c.expected, reply.Data, c.query)
+	}
+
+	reply = db.AggregateMulti(schema, "1", &AggregateQuery{Func: AggregateSum, Column: "name"})
+	require.NotEmpty(t, reply.Msg)
+	reply = db.AggregateMulti(schema, "1", &AggregateQuery{Func: "AVG", Column: "gold"})
+	require.NotEmpty(t, reply.Msg)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	reply = tx.DeleteSingle(schema, "1", []string{"1", "2"})
+	require.Equal(t, int64(1), reply.Data)
+	require.NoError(t, tx.Rollback())
+	require.NotNil(t, db.SelectSingle(schema, "1", []string{"1", "2"}).Data)
+
+	reply = db.DeleteMulti(schema, "1", &MultiRequestData{Where: "`uid`=? AND `id`>=?", Params: []string{"1", "2"}})
+	require.NoError(t, reply.Err)
+	require.Equal(t, int64(2), reply.Data)
+
+	reply = db.DeleteSingle(schema, "1", keys)
+	require.Equal(t, int64(1), reply.Data)
+	require.Empty(t, db.SelectMulti(schema, "1", nil).Data)
+
+	reply = db.Upsert(schema, "1", []string{"uid", "1", "id", "1", "name", "u", "gold", "5"})
+	require.NoError(t, reply.Err)
+	require.Equal(t, int64(1), reply.Data)
+	reply = db.Upsert(schema, "1", []string{"uid", "1", "id", "1", "gold", "6"})
+	require.Equal(t, int64(1), reply.Data)
+	reply = db.Upsert(schema, "1", []string{"uid", "1", "id", "1"})
+	require.Empty(t, reply.Msg)
+	require.Equal(t, int64(1), reply.Data)
+	fields = RowData2Map(schema, db.SelectSingle(schema, "1", keys).Data.([]byte))
+	require.Equal(t, "u", fields["name"])
+	require.Equal(t, "6", fields["gold"])
+
+	require.NoError(t, schema.SetVersionColumn("gold"))
+	defer schema.SetVersionColumn("")
+	reply = db.UpdateSingle(schema, "1", keys, []string{"name", "v"})
+	require.Equal(t, "missing version", reply.Msg)
+	reply = db.UpdateSingle(schema, "1", keys, []string{"name", "v", "gold", "6"})
+	require.NoError(t, reply.Err)
+	require.Equal(t, int64(1), reply.Data)
+	reply = db.UpdateSingle(schema, "1", keys, []string{"name", "w", "gold", "6"})
+	require.ErrorIs(t, reply.Err, ErrVersionConflict)
+	reply = db.IncrBySingle(schema, "1", keys, &IncrByData{Column: "id", Delta: 0, Version: "6"})
+	require.ErrorIs(t, reply.Err, ErrVersionConflict)
+	reply = db.UpdateSingle(schema, "1", []string{"1", "9"}, []string{"name", "w", "gold", "6"})
+	require.NoError(t, reply.Err)
+	require.Equal(t, int64(0), reply.Data)
+	fields = RowData2Map(schema, db.SelectSingle(schema, "1", keys).Data.([]byte))
+	require.Equal(t, "v", fields["name"])
+	require.Equal(t, "7", fields["gold"])
+}
+
+func TestDBStub_Driver(t *testing.T) {
+	testDriver(t, NewDBStub(), newTestSchema())
+}
+
+func TestNewTableSchema(t *testing.T) {
+	schema, err := newTableSchema("fake", []columnDesc{
+		{name: "uid", typeName: "bigint", isPrimaryKey: true},
+		{name: "id", typeName: "int", isPrimaryKey: true},
+		{name: "name", typeName: "varchar", defaultValue: "x"},
+		{name: "mtime", typeName: "timestamp", autoMTime: true},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, schema.NumPrimaryKeys)
+	require.Nil(t, schema.PrimaryKeyIndexes)
+	require.Equal(t, []int{3}, schema.AutoMTimeFields)
+	require.Equal(t, "x", schema.GetColumnSchema("name").DefaultValue)
+	require.Equal(t, ColumnTypeTime, schema.GetColumnSchema("mtime").Type)
+	require.Equal(t, "SELECT `uid`,`id`,`name`,`mtime` FROM fake WHERE `uid`=? AND `id`=?", schema.selectSingle)
+	require.Equal(t, "SELECT `uid`,`id`,`name`,`mtime` FROM fake WHERE `uid`=?", schema.selectMulti)
+	require.Equal(t, "DELETE FROM fake WHERE `uid`=? AND `id`=?", schema.deleteSingle)
+
+	_, err = newTableSchema("fake", []columnDesc{{name: "uid", typeName: "bigint"}})
+	require.Error(t, err)
+}
+
+func TestRowData_Null(t *testing.T) {
+	schema := CreateFakeTableSchema([]FakeColumn{
+		{Name: "uid", Type: ColumnTypeInt},
+		{Name: "name", Type: ColumnTypeString},
+		{Name: "gold", Type: ColumnTypeInt},
+	}, 1)
+	schema.Columns[1].DefaultValue = "x"
+
+	row := NewRowDataFromSlice(schema, []string{"uid", "1", "name", NullValue})
+	require.Equal(t, rowFormatNullable, row[0])
+	require.Equal(t, "x", GetValueByIndex(schema, row, 1))
+	require.True(t, IsNullByIndex(schema, row, 1))
+	require.False(t, IsNullByIndex(schema, row, 2))
+	value, null := GetNullableValueByIndex(schema, row, 0)
+	require.False(t, null)
+	require.Equal(t, "1", value)
+	require.Equal(t, "\t1", GetRowKey(schema, row))
+	//the legacy accessors return the default value for NULL
+	require.Equal(t, "x", RowData2Map(schema, row)["name"])
+	require.Equal(t, "x", RowData2Slice(schema, row)[3])
+	require.Equal(t, NullValue, rowData2Map(schema, row, true)["name"])
+
+	//a round trip through the slice keeps the NULL
+	row = NewRowDataFromSlice(schema, rowData2Slice(schema, row, true))
+	require.True(t, IsNullByIndex(schema, row, 1))
+
+	parser, err := CreateParser(schema, "1", "name IS NULL AND gold IS NOT NULL", nil)
+	require.NoError(t, err)
+	require.True(t, parser.Check(row))
+
+	//rows without NULL keep the plain format
+	row = NewRowDataFromSlice(schema, []string{"uid", "1", "name", ""})
+	require.Equal(t, rowFormatPlain, row[0])
+	require.False(t, IsNullByIndex(schema, row, 1))
+	require.Equal(t, "x", GetValueByIndex(schema, row, 1))
+}
@@ -0,0 +1,432 @@
+package sql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// exprNode 条件中的表达式：列、常量、参数，或者两个表达式的四则运算
+type exprNode struct {
+	op         byte
+	columnIdx  int
+	columnType ColumnType
+	collation  Collation
+	value      exprValue
+	left       *exprNode
+	right      *exprNode
+	//大于0时是参数，值为Parser.args[slot-1]
+	slot int
+}
+
+// exprValue 表达式的值。列的值按ColumnType转换，时间为unix时间；
+// 字符串常量和参数在运算和比较时按另一边的类型转换，与MySQL的隐式转换一致
+type exprValue struct {
+	typ  ColumnType
+	i    int64
+	f    float64
+	s    string
+	null bool
+	//字符串列的排序规则，常量和参数为CollationBinary
+	collation Collation
+}
+
+func (e *exprNode) isColumn() bool {
+	return e.op == 0 && e.columnIdx >= 0
+}
+
+// hasColumn 表达式中是否引用了列idx
+func (e *exprNode) hasColumn(idx int) bool {
+	if e == nil {
+		return false
+	}
+
+	if e.op == 0 {
+		return e.columnIdx == idx
+	}
+
+	return e.left.hasColumn(idx) || e.right.hasColumn(idx)
+}
+
+func (e *exprNode) eval(schema *TableSchema, rowData []byte, args []interface{}) exprValue {
+	if e.op == 0 {
+		if e.slot > 0 {
+			return args[e.slot-1].(exprValue)
+		}
+
+		if e.columnIdx < 0 {
+			return e.value
+		}
+
+		value, null := rowValue(schema, rowData, e.columnIdx)
+		if null {
+			return exprValue{null: true}
+		}
+
+		return columnValue(value, e.columnType, e.collation)
+	}
+
+	left := e.left.eval(schema, rowData, args)
+	right := e.right.eval(schema, rowData, args)
+	if left.null || right.null {
+		return exprValue{null: true}
+	}
+
+	return arithmetic(e.op, left, right)
+}
+
+func columnValue(value string, ct ColumnType, collation Collation) exprValue {
+	switch ct {
+	case ColumnTypeInt:
+		i, _ := strconv.ParseInt(value, 10, 64)
+		return exprValue{typ: ColumnTypeInt, i: i}
+
+	case ColumnTypeFloat:
+		f, _ := strconv.ParseFloat(value, 64)
+		return exprValue{typ: ColumnTypeFloat, f: f}
+
+	case ColumnTypeTime:
+		if t, ok := castValue(value, ColumnTypeTime).(int64); ok {
+			return exprValue{typ: ColumnTypeTime, i: t}
+		}
+		return exprValue{null: true}
+
+	default:
+		return exprValue{typ: ColumnTypeString, s: value, collation: collation}
+	}
+}
+
+// literalValue 数字常量为整数或浮点数，其他为字符串
+func literalValue(text string, isNumber bool) exprValue {
+	if isNumber {
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return exprValue{typ: ColumnTypeInt, i: i}
+		}
+
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return exprValue{typ: ColumnTypeFloat, f: f}
+		}
+	}
+
+	return exprValue{typ: ColumnTypeString, s: text}
+}
+
+// number 转换为数字，返回整数或浮点数(isFloat为true)；不是数字的字符串为0
+func (v exprValue) number() (int64, float64, bool) {
+	switch v.typ {
+	case ColumnTypeInt, ColumnTypeTime:
+		return v.i, float64(v.i), false
+
+	case ColumnTypeFloat:
+		return int64(v.f), v.f, true
+
+	default:
+		s := strings.TrimSpace(v.s)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, float64(i), false
+		}
+
+		f, _ := strconv.ParseFloat(s, 64)
+		return int64(f), f, true
+	}
+}
+
+// arithmetic 整数的加减乘结果为整数，除法和有浮点数参与时为浮点数，除以0为NULL
+func arithmetic(op byte, left exprValue, right exprValue) exprValue {
+	li, lf, lFloat := left.number()
+	ri, rf, rFloat := right.number()
+	if op == '/' {
+		if rf == 0 {
+			return exprValue{null: true}
+		}
+
+		return exprValue{typ: ColumnTypeFloat, f: lf / rf}
+	}
+
+	if lFloat || rFloat {
+		switch op {
+		case '+':
+			lf += rf
+		case '-':
+			lf -= rf
+		default:
+			lf *= rf
+		}
+
+		return exprValue{typ: ColumnTypeFloat, f: lf}
+	}
+
+	switch op {
+	case '+':
+		li += ri
+	case '-':
+		li -= ri
+	default:
+		li *= ri
+	}
+
+	return exprValue{typ: ColumnTypeInt, i: li}
+}
+
+// compare 按排序规则比较字符串，返回-1、0、1。CollationNoCase按字符转为小写后比较；
+// 条件中的=、<>、<、>、IN、BETWEEN，表达式比较，MIN/MAX以及SelectMulti的排序都使用列的排序规则
+func (c Collation) compare(a string, b string) int {
+	if c != CollationNoCase {
+		return strings.Compare(a, b)
+	}
+
+	for a != "" && b != "" {
+		ra, na := utf8.DecodeRuneInString(a)
+		rb, nb := utf8.DecodeRuneInString(b)
+		if ra != rb {
+			ra, rb = unicode.ToLower(ra), unicode.ToLower(rb)
+			if ra < rb {
+				return -1
+			}
+			if ra > rb {
+				return 1
+			}
+		}
+
+		a, b = a[na:], b[nb:]
+	}
+
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
+
+// likeFold LIKE比较之前的转换：CollationNoCase转为小写，CollationBinaryLikeNoCase只转换ASCII字母
+func (c Collation) likeFold(s string) string {
+	switch c {
+	case CollationNoCase:
+		return strings.ToLower(s)
+
+	case CollationBinaryLikeNoCase:
+		return strings.Map(func(r rune) rune {
+			if r >= 'A' && r <= 'Z' {
+				return r + 'a' - 'A'
+			}
+			return r
+		}, s)
+
+	default:
+		return s
+	}
+}
+
+// compareValue 比较两个值，返回-1、0、1；无法比较时(如不是时间格式的字符串与时间比较)ok为false
+func compareValue(left exprValue, right exprValue) (int, bool) {
+	if left.typ == ColumnTypeString && right.typ == ColumnTypeString {
+		//与MySQL一样列的排序规则优先于常量和参数
+		collation := left.collation
+		if collation == CollationBinary {
+			collation = right.collation
+		}
+		return collation.compare(left.s, right.s), true
+	}
+
+	if left.typ == ColumnTypeTime || right.typ == ColumnTypeTime {
+		var ok bool
+		if left, ok = toTimeValue(left); !ok {
+			return 0, false
+		}
+		if right, ok = toTimeValue(right); !ok {
+			return 0, false
+		}
+	}
+
+	li, lf, lFloat := left.number()
+	ri, rf, rFloat := right.number()
+	if lFloat || rFloat {
+		switch {
+		case lf < rf:
+			return -1, true
+		case lf > rf:
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+
+	switch {
+	case li < ri:
+		return -1, true
+	case li > ri:
+		return 1, true
+	default:
+		return 0, true
+	}
+}
+
+func toTimeValue(v exprValue) (exprValue, bool) {
+	if v.typ != ColumnTypeString {
+		return v, true
+	}
+
+	t, ok := castValue(v.s, ColumnTypeTime).(int64)
+	return exprValue{typ: ColumnTypeTime, i: t}, ok
+}
+
+// checkExpr 比较两个表达式，有NULL时为ConditionUnknown
+func (cn *conditionNode) checkExpr(schema *TableSchema, rowData []byte, args []interface{}) ConditionResult {
+	left := cn.lhs.eval(schema, rowData, args)
+	right := cn.rhs.eval(schema, rowData, args)
+	if left.null || right.null {
+		return ConditionUnknown
+	}
+
+	c, ok := compareValue(left, right)
+	if !ok {
+		return ConditionFalse
+	}
+
+	var ret bool
+	switch cn.operator {
+	case ">":
+		ret = c > 0
+	case ">=":
+		ret = c >= 0
+	case "<":
+		ret = c < 0
+	case "<=":
+		ret = c <= 0
+	case "=":
+		ret = c == 0
+	default:
+		ret = c != 0
+	}
+
+	if ret {
+		return ConditionTrue
+	}
+	return ConditionFalse
+}
+
+// parseExpr 解析 + - 连接的项
+func (p *conditionParser) parseExpr() (*exprNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.typ != tokenArithmetic || (t.text != "+" && t.text != "-") {
+			return left, nil
+		}
+
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &exprNode{op: t.text[0], columnIdx: -1, left: left, right: right}
+	}
+}
+
+// parseTerm 解析 * / 连接的因子
+func (p *conditionParser) parseTerm() (*exprNode, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.typ != tokenArithmetic || (t.text != "*" && t.text != "/") {
+			return left, nil
+		}
+
+		p.next()
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &exprNode{op: t.text[0], columnIdx: -1, left: left, right: right}
+	}
+}
+
+func (p *conditionParser) parseFactor() (*exprNode, error) {
+	t := p.next()
+	switch t.typ {
+	case tokenLeftParen:
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.next().typ != tokenRightParen {
+			return nil, fmt.Errorf("bracket mismatched: %s", p.where)
+		}
+		return e, nil
+
+	case tokenArithmetic:
+		//负号
+		if t.text == "-" {
+			e, err := p.parseFactor()
+			if err != nil {
+				return nil, err
+			}
+
+			zero := &exprNode{columnIdx: -1, value: exprValue{typ: ColumnTypeInt}}
+			return &exprNode{op: '-', columnIdx: -1, left: zero, right: e}, nil
+		}
+
+	case tokenWord, tokenQuotedWord:
+		if t.typ == tokenWord && isKeyword(t.text) {
+			break
+		}
+
+		column := p.schema.GetColumnSchema(t.text)
+		if column == nil {
+			return nil, fmt.Errorf("invalid column: %s", t.text)
+		}
+		return &exprNode{columnIdx: column.Index, columnType: column.Type, collation: column.Collation}, nil
+
+	case tokenNumber, tokenString:
+		return &exprNode{columnIdx: -1, value: literalValue(t.text, t.typ == tokenNumber)}, nil
+
+	case tokenParam:
+		p.paramIdx++
+		param := p.paramIdx
+		slot := p.addSlot(func(params []string) (interface{}, error) {
+			return literalValue(params[param-1], false), nil
+		})
+		return &exprNode{columnIdx: -1, slot: slot}, nil
+
+	case tokenEnd:
+		return nil, fmt.Errorf("empty condition")
+	}
+
+	return nil, fmt.Errorf("invalid condition: %s", p.where)
+}
+
+// simpleValueNext 下一个是单独的常量或参数(不是列，后面没有运算)，按列的类型比较
+func (p *conditionParser) simpleValueNext() bool {
+	t := p.peek()
+	switch t.typ {
+	case tokenNumber, tokenString, tokenParam:
+	case tokenWord:
+		if isKeyword(t.text) || p.schema.GetColumnSchema(t.text) != nil {
+			return false
+		}
+	default:
+		return false
+	}
+
+	if p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].typ == tokenArithmetic {
+		return false
+	}
+
+	return true
+}
@@ -2,33 +2,56 @@ package sql
 
 import (
 	"fmt"
-	"go-learner/slice"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 const (
-	WordIN  = "IN"
-	WordAND = "AND"
-	WordOR  = "OR"
+	WordIN      = "IN"
+	WordAND     = "AND"
+	WordOR      = "OR"
+	WordNOT     = "NOT"
+	WordLIKE    = "LIKE"
+	WordBETWEEN = "BETWEEN"
+	WordIS      = "IS"
+	WordNULL    = "NULL"
+
+	OperatorIsNull    = "IS NULL"
+	OperatorIsNotNull = "IS NOT NULL"
 )
 
-type SelfConditionFunc func(value string, expected interface{}, ct ColumnType) bool
-type RightConditionFunc func(left bool, right bool) bool
+// ConditionResult 条件的结果，与MySQL一致，NULL参与比较的结果为ConditionUnknown，WHERE只保留ConditionTrue的行
+type ConditionResult uint8
+
+const (
+	ConditionFalse ConditionResult = iota
+	ConditionTrue
+	ConditionUnknown
+)
+
+// SelfConditionFunc 列的值与expected比较，collation为字符串列的排序规则
+type SelfConditionFunc func(value string, expected interface{}, ct ColumnType, collation Collation) bool
+type RightConditionFunc func(left ConditionResult, right ConditionResult) ConditionResult
 
 var SelfConditionFuncMap map[string]SelfConditionFunc
 var RightConditionFuncMap map[string]RightConditionFunc
 
 func init() {
 	SelfConditionFuncMap = map[string]SelfConditionFunc{
-		">":    greater,
-		">=":   greaterOrEqual,
-		"<":    less,
-		"<=":   lessOrEqual,
-		"=":    equal,
-		"!=":   notEqual,
-		WordIN: in,
+		">":               greater,
+		">=":              greaterOrEqual,
+		"<":               less,
+		"<=":              lessOrEqual,
+		"=":               equal,
+		"!=":              notEqual,
+		"<>":              notEqual,
+		WordIN:            in,
+		WordLIKE:          like,
+		WordBETWEEN:       between,
+		OperatorIsNull:    isNull,
+		OperatorIsNotNull: isNotNull,
 	}
 
 	RightConditionFuncMap = map[string]RightConditionFunc{
@@ -37,59 +60,115 @@ func init() {
 	}
 }
 
+// Parser 绑定了参数的条件，编译结果conditionTemplate由相同schema和WHERE的请求共用
 type Parser struct {
 	hasShard bool
 	schema   *TableSchema
 	where    string
-	params   []string
+	tmpl     *conditionTemplate
+	//参数槽位绑定后的值
+	args []interface{}
+}
+
+// conditionParser 把WHERE编译为conditionTemplate，参数(?)编译为槽位，绑定时才转换
+type conditionParser struct {
+	schema   *TableSchema
+	where    string
+	tokens   []token
+	pos      int
 	paramIdx int
-	numTypes []bool
-	shardKey string
-	cn       *conditionNode
+	slots    []paramBinder
+	shards   []*conditionNode
 }
 
+// conditionNode 叶子节点是一个列与常量的比较(selfFunc)，或者两个表达式的比较(lhs、rhs)；
+// child与right由rightFunc(AND/OR)连接，没有right时只有child；not对整个节点取反
 type conditionNode struct {
+	operator   string
 	columnType ColumnType
+	collation  Collation
 	columnIdx  int
 	expected   interface{}
-	level      int
 	selfFunc   SelfConditionFunc
 	rightFunc  RightConditionFunc
+	not        bool
+	lhs        *exprNode
+	rhs        *exprNode
+	//大于0时expected由参数决定，为Parser.args[slot-1]
+	slot int
 
 	right *conditionNode
 	child *conditionNode
 }
 
+type tokenType uint8
+
+const (
+	tokenEnd tokenType = iota
+	tokenWord
+	tokenQuotedWord
+	tokenNumber
+	tokenString
+	tokenParam
+	tokenOperator
+	tokenArithmetic
+	tokenLeftParen
+	tokenRightParen
+	tokenComma
+)
+
+type token struct {
+	typ  tokenType
+	text string
+	pos  int
+}
+
+// CreateParser 编译结果按schema缓存，相同的WHERE只编译一次，之后每个请求只需绑定参数
 func CreateParser(schema *TableSchema, shardKey string, where string, params []string) (*Parser, error) {
 	if where == "" {
 		return nil, nil
 	}
 
-	p := &Parser{
-		schema:   schema,
-		where:    where,
-		params:   params,
-		paramIdx: 0,
-		shardKey: shardKey,
-		numTypes: make([]bool, len(params)),
+	tmpl, err := schema.parsers.get(schema, where)
+	if err != nil {
+		return nil, err
+	}
+
+	return tmpl.bind(schema, shardKey, where, params)
+}
+
+// compileCondition 编译WHERE，不使用缓存
+func compileCondition(schema *TableSchema, where string) (*conditionTemplate, error) {
+	tokens, err := tokenize(where)
+	if err != nil {
+		return nil, err
 	}
 
-	i := 0
-	cn, err := p.parseCondition(p.where, &i, 0)
+	p := &conditionParser{
+		schema: schema,
+		where:  where,
+		tokens: tokens,
+	}
+
+	cn, err := p.parseCondition()
 	if err != nil {
 		return nil, err
 	}
 
-	if "" != nextWordBySpace(p.where, &i) {
+	if t := p.peek(); t.typ != tokenEnd {
 		return nil, fmt.Errorf("invalid condition: %s", p.where)
 	}
 
-	if p.paramIdx != len(p.params) {
-		return nil, fmt.Errorf("condition mismatch parameter num")
+	if err = p.checkShard(cn, true); err != nil {
+		return nil, err
 	}
 
-	p.cn = cn
-	return p, nil
+	return &conditionTemplate{
+		cn:     cn,
+		nParam: p.paramIdx,
+		slots:  p.slots,
+		shards: p.shards,
+	}, nil
 }
 
 func (p *Parser) Check(rowData []byte) bool {
@@ -97,7 +176,7 @@ func (p *Parser) Check(rowData []byte) bool {
 		return false
 	}
 
-	return p.cn.check(p.schema, rowData)
+	return p.tmpl.cn.check(p.schema, rowData, p.args) == ConditionTrue
 }
 
 func (p *Parser) ValidShard() bool {
@@ -116,356 +195,654 @@ func (cn *conditionNode) setRight(operator string, right *conditionNode) bool {
 	return true
 }
 
-func (cn *conditionNode) set(operator string, columnIdx int, columnType ColumnType, expected interface{}) bool {
+func (cn *conditionNode) set(operator string, column *ColumnSchema, expected interface{}) bool {
 	selfFunc, ok := SelfConditionFuncMap[operator]
 	if !ok {
 		return false
 	}
 
-	cn.columnIdx = columnIdx
-	cn.columnType = columnType
+	cn.operator = operator
+	cn.columnIdx = column.Index
+	cn.columnType = column.Type
+	cn.collation = column.Collation
 	cn.selfFunc = selfFunc
 	cn.expected = expected
 
 	return true
 }
 
-func (cn *conditionNode) check(schema *TableSchema, rowData []byte) bool {
-	var left bool
+// expectedValue 比较的值，参数在绑定时已经转换
+func (cn *conditionNode) expectedValue(args []interface{}) interface{} {
+	if cn.slot > 0 {
+		return args[cn.slot-1]
+	}
+
+	return cn.expected
+}
+
+func (cn *conditionNode) check(schema *TableSchema, rowData []byte, args []interface{}) ConditionResult {
+	var ret ConditionResult
 	if cn.child != nil {
-		left = cn.child.check(schema, rowData)
+		ret = cn.child.check(schema, rowData, args)
+
+	} else if cn.lhs != nil {
+		ret = cn.checkExpr(schema, rowData, args)
+
+	} else if value, null := rowValue(schema, rowData, cn.columnIdx); null {
+		//NULL只满足IS NULL，其他比较的结果都是UNKNOWN
+		switch cn.operator {
+		case OperatorIsNull:
+			ret = ConditionTrue
+		case OperatorIsNotNull:
+			ret = ConditionFalse
+		default:
+			ret = ConditionUnknown
+		}
 
-	} else {
-		value := GetValueByIndex(schema, rowData, cn.columnIdx)
-		left = cn.selfFunc(value, cn.expected, cn.columnType)
+	} else if cn.selfFunc(value, cn.expectedValue(args), cn.columnType, cn.collation) {
+		ret = ConditionTrue
 	}
 
-	if cn.right == nil {
-		return left
+	if cn.right != nil {
+		ret = cn.rightFunc(ret, cn.right.check(schema, rowData, args))
 	}
 
-	right := cn.right.check(schema, rowData)
-	return cn.rightFunc(left, right)
+	if cn.not {
+		ret = not(ret)
+	}
+
+	return ret
+}
+
+// rowValue 返回列的值，以及是否为NULL
+func rowValue(schema *TableSchema, rowData []byte, idx int) (string, bool) {
+	return GetNullableValueByIndex(schema, rowData, idx)
 }
 
-func (p *Parser) replaceParam(word string, isNum bool) string {
-	if word != "?" {
-		return word
+// checkShard shard列只能以 shard列=值 的形式出现在最外层AND连接的条件中，值在绑定时与shardKey比较
+func (p *conditionParser) checkShard(cn *conditionNode, top bool) error {
+	if cn == nil {
+		return nil
 	}
 
-	if p.paramIdx >= len(p.params) {
-		return ""
+	if cn.not || (cn.right != nil && cn.operator != WordAND) {
+		top = false
 	}
 
-	ret := p.params[p.paramIdx]
-	p.numTypes[p.paramIdx] = isNum
-	p.paramIdx++
+	if cn.lhs.hasColumn(p.schema.ShardIndex) || cn.rhs.hasColumn(p.schema.ShardIndex) {
+		return fmt.Errorf("invalid shard condition: %s", p.where)
+	}
 
-	return ret
-}
+	if cn.child == nil && cn.columnIdx >= 0 && cn.columnIdx == p.schema.ShardIndex {
+		if !top {
+			return fmt.Errorf("shard key MUST be level 0: %s", p.where)
+		}
 
-func (p *Parser) parseCondition(sql string, start *int, level int) (*conditionNode, error) {
-	word, sep := nextWord(sql, start, "`=!>< ")
-	// check `name`=? like
-	if sep == "`" {
-		if word != "" {
-			return nil, fmt.Errorf("sign '`' mismatched")
+		if cn.operator != "=" {
+			return fmt.Errorf("invalid shard condition: %s", p.where)
 		}
 
-		word, sep = nextWord(sql, start, "`=!>< ")
-		if word == "" || sep == "" {
-			return nil, fmt.Errorf("sign '`' mismatched")
+		p.shards = append(p.shards, cn)
+	}
+
+	if err := p.checkShard(cn.child, top); err != nil {
+		return err
+	}
+
+	return p.checkShard(cn.right, top)
+}
+
+// parseCondition 按优先级 OR < AND < NOT < 比较 解析
+func (p *conditionParser) parseCondition() (*conditionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.acceptWord(WordOR) {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
 		}
 
-		if sep[0] != '`' {
-			return nil, fmt.Errorf("sign '`' mismatched")
+		left = joinCondition(WordOR, left, right)
+	}
+
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (*conditionNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.acceptWord(WordAND) {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
 		}
 
-		sep = sep[1:]
+		left = joinCondition(WordAND, left, right)
+	}
+
+	return left, nil
+}
+
+func (p *conditionParser) parseNot() (*conditionNode, error) {
+	if p.acceptWord(WordNOT) {
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
 
-	} else if word == "" {
-		return nil, fmt.Errorf("empty condition")
+		return &conditionNode{columnIdx: -1, child: child, not: true}, nil
 	}
 
-	node := &conditionNode{columnIdx: -1, level: level}
-	schema := p.schema
-	if sep == "" {
-		if word[0] == '(' {
-			i := 1
-			child, err := p.parseCondition(word, &i, level+1)
-			if err != nil {
-				return nil, err
+	if p.peek().typ == tokenLeftParen {
+		//括号中可能是条件，也可能是表达式，如(level+1)*2>?
+		pos, paramIdx, nSlot := p.pos, p.paramIdx, len(p.slots)
+		child, err := p.parseGroup()
+		if err == nil {
+			if t := p.peek(); t.typ != tokenOperator && t.typ != tokenArithmetic {
+				return child, nil
 			}
+		}
 
-			node.child = child
+		p.pos, p.paramIdx, p.slots = pos, paramIdx, p.slots[:nSlot]
+		node, exprErr := p.parseCompare()
+		if exprErr != nil && err != nil {
+			return nil, err
+		}
 
-		} else {
-			//特殊条件，仅支持：x IN (a, b)
-			column := schema.GetColumnSchema(word)
-			if column == nil {
-				return nil, fmt.Errorf("invalid column: %s", word)
-			}
+		return node, exprErr
+	}
 
-			word = nextWordBySpace(sql, start)
-			word = strings.ToUpper(word)
-			if word != WordIN {
-				return nil, fmt.Errorf("invalid IN condition: %s", sql)
-			}
+	return p.parseCompare()
+}
 
-			i := nextNonEmptyIndex(sql, *start)
-			if i < 0 || sql[i] != '(' {
-				return nil, fmt.Errorf("invalid IN condition: %s", sql)
-			}
+func (p *conditionParser) parseGroup() (*conditionNode, error) {
+	p.next()
+	child, err := p.parseCondition()
+	if err != nil {
+		return nil, err
+	}
 
-			i++
-			v := make([]string, 0, 4)
-			for {
-				word, sep = nextWord(sql, &i, ", ")
-				if word == "" {
-					return nil, fmt.Errorf("invalid IN condition: %s", sql)
-				}
-
-				word = p.replaceParam(word, column.IsNumber)
-				if word == "" {
-					return nil, fmt.Errorf("condition mismatch parameter num")
-				}
-
-				v = append(v, word)
-				if sep != "," {
-					break
-				}
-			}
+	if p.next().typ != tokenRightParen {
+		return nil, fmt.Errorf("bracket mismatched: %s", p.where)
+	}
 
-			cv := castValueSlice(v, column.Type)
-			if cv == nil {
-				return nil, fmt.Errorf("invalid column type: %s", sql)
-			}
+	return child, nil
+}
 
-			i++
-			*start = i
+// parseCompare 解析一个比较：expr op expr；列的 op value, [NOT] IN (...), [NOT] LIKE value, [NOT] BETWEEN a AND b, IS [NOT] NULL
+func (p *conditionParser) parseCompare() (*conditionNode, error) {
+	lhs, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
 
-			if !node.set(WordIN, column.Index, column.Type, cv) {
-				return nil, fmt.Errorf("nonsupport operator: %s", WordIN)
-			}
+	node := &conditionNode{columnIdx: -1}
+	t := p.next()
+	if t.typ == tokenOperator {
+		if _, ok := SelfConditionFuncMap[t.text]; !ok {
+			return nil, fmt.Errorf("nonsupport operator: %s", t.text)
 		}
 
-	} else {
-		column := schema.GetColumnSchema(word)
-		if column == nil {
-			return nil, fmt.Errorf("invalid column: %s", word)
+		if lhs.isColumn() && p.simpleValueNext() {
+			//列与常量比较，常量按列的类型转换
+			column := &p.schema.Columns[lhs.columnIdx]
+			value, param, err := p.parseValue(column)
+			if err != nil {
+				return nil, err
+			}
+
+			node.set(t.text, column, value)
+			if param > 0 {
+				node.slot = p.addSlot(p.bindValue(column, param))
+			}
+			return node, nil
 		}
 
-		word = nextWordBySpace(sql, start)
-		if word == "" {
-			return nil, fmt.Errorf("invalid condition: %s", sql)
+		rhs, err := p.parseExpr()
+		if err != nil {
+			return nil, err
 		}
 
-		word = p.replaceParam(word, column.IsNumber)
-		if word == "" {
-			return nil, fmt.Errorf("condition mismatch parameter num")
+		node.operator = t.text
+		node.lhs = lhs
+		node.rhs = rhs
+		return node, nil
+	}
+
+	if t.typ != tokenWord || !lhs.isColumn() {
+		return nil, fmt.Errorf("invalid condition: %s", p.where)
+	}
+
+	column := &p.schema.Columns[lhs.columnIdx]
+
+	operator := strings.ToUpper(t.text)
+	if operator == WordIS {
+		operator = OperatorIsNull
+		if p.acceptWord(WordNOT) {
+			operator = OperatorIsNotNull
 		}
 
-		cv := castValue(word, column.Type)
-		if cv == nil {
-			return nil, fmt.Errorf("invalid column type: %s", sql)
+		if !p.acceptWord(WordNULL) {
+			return nil, fmt.Errorf("invalid IS condition: %s", p.where)
 		}
 
-		if !node.set(sep, column.Index, column.Type, cv) {
-			return nil, fmt.Errorf("nonsupport operator: %s", sep)
+		node.set(operator, column, nil)
+		return node, nil
+	}
+
+	if operator == WordNOT {
+		node.not = true
+		operator = strings.ToUpper(p.next().text)
+	}
+
+	var expected interface{}
+	switch operator {
+	case WordIN:
+		if p.next().typ != tokenLeftParen {
+			return nil, fmt.Errorf("invalid IN condition: %s", p.where)
 		}
 
-		if column.Index == schema.ShardIndex {
-			if word != p.shardKey || sep != "=" {
-				return nil, fmt.Errorf("invalid shard condition: %s", word)
+		values := make([]interface{}, 0, 4)
+		var params []int
+		for {
+			value, param, err := p.parseValue(column)
+			if err != nil {
+				return nil, err
+			}
+
+			if param > 0 {
+				params = append(params, len(values), param)
 			}
 
-			if level != 0 {
-				return nil, fmt.Errorf("shard key MUST be level 0: %s", word)
+			values = append(values, value)
+			t = p.next()
+			if t.typ == tokenRightParen {
+				break
 			}
 
-			p.hasShard = true
+			if t.typ != tokenComma {
+				return nil, fmt.Errorf("invalid IN condition: %s", p.where)
+			}
+		}
+		expected = values
+		if len(params) > 0 {
+			node.slot = p.addSlot(p.bindValues(column, values, params))
 		}
-	}
 
-	i := *start
-	word = nextWordBySpace(sql, start)
-	word = strings.ToUpper(word)
-	switch word {
-	case WordAND:
-		right, err := p.parseCondition(sql, start, level)
+	case WordLIKE:
+		pattern, param, err := p.parseString()
 		if err != nil {
 			return nil, err
 		}
 
-		if !node.setRight(word, right) {
-			return nil, fmt.Errorf("nonsupport operator: %s", word)
+		collation := column.Collation
+		if param > 0 {
+			node.slot = p.addSlot(func(params []string) (interface{}, error) {
+				return compileLike(params[param-1], collation), nil
+			})
+		} else {
+			expected = compileLike(pattern, collation)
+		}
+
+	case WordBETWEEN:
+		low, lowParam, err := p.parseValue(column)
+		if err != nil {
+			return nil, err
 		}
 
-	case WordOR:
-		if level < 1 {
-			return nil, fmt.Errorf("OR can not be in level 0: %s", sql)
+		if !p.acceptWord(WordAND) {
+			return nil, fmt.Errorf("invalid BETWEEN condition: %s", p.where)
 		}
 
-		//用child来保证运算优先级，OR < AND
-		rightChild, err := p.parseCondition(sql, start, level+1)
+		high, highParam, err := p.parseValue(column)
 		if err != nil {
 			return nil, err
 		}
 
-		if !node.setRight(word, &conditionNode{columnIdx: -1, level: level, child: rightChild}) {
-			return nil, fmt.Errorf("nonsupport operator: %s", word)
+		bounds := []interface{}{low, high}
+		expected = bounds
+		if lowParam > 0 || highParam > 0 {
+			node.slot = p.addSlot(p.bindValues(column, bounds, []int{0, lowParam, 1, highParam}))
 		}
 
 	default:
-		*start = i
+		return nil, fmt.Errorf("nonsupport operator: %s", operator)
 	}
 
+	node.set(operator, column, expected)
 	return node, nil
 }
 
-func nextWord(value string, start *int, separators string) (string, string) {
-	s := nextNonEmptyIndex(value, *start)
-	if s < 0 {
-		return "", ""
+// parseString 读取一个常量的原始字符串；参数返回它的序号(从1开始)，值在绑定时才确定
+func (p *conditionParser) parseString() (string, int, error) {
+	t := p.next()
+	switch t.typ {
+	case tokenParam:
+		p.paramIdx++
+		return "", p.paramIdx, nil
+
+	case tokenNumber, tokenString:
+		return t.text, 0, nil
+
+	case tokenWord:
+		//兼容不加引号的字符串
+		if !isKeyword(t.text) {
+			return t.text, 0, nil
+		}
 	}
 
-	n := len(value)
-	e := n
-
-	var sep []byte
-	nBracket := 0
-	quote := byte(0)
-
-	var i int
-	for i = s; i < n; i++ {
-		c := value[i]
+	return "", 0, fmt.Errorf("invalid condition: %s", p.where)
+}
 
-		if sep != nil {
-			if strings.IndexByte(separators, c) > -1 {
-				if c != ' ' {
-					sep = append(sep, c)
-				}
+// parseValue 常量按列的类型转换；参数返回它的序号，由bindValue转换
+func (p *conditionParser) parseValue(column *ColumnSchema) (interface{}, int, error) {
+	word, param, err := p.parseString()
+	if err != nil || param > 0 {
+		return nil, param, err
+	}
 
-			} else {
-				break
-			}
+	cv := castValue(word, column.Type)
+	if cv == nil {
+		return nil, 0, fmt.Errorf("invalid column type: %s", p.where)
+	}
 
-		} else if quote == 0 {
-			if nBracket == 0 && strings.IndexByte(separators, c) > -1 {
-				e = i
+	return cv, 0, nil
+}
 
-				sep = make([]byte, 0, 2)
-				if c != ' ' {
-					sep = append(sep, c)
-				}
+// addSlot 添加一个参数槽位，返回槽位序号(从1开始)
+func (p *conditionParser) addSlot(binder paramBinder) int {
+	p.slots = append(p.slots, binder)
+	return len(p.slots)
+}
 
-			} else if c == '(' {
-				nBracket++
+// bindValue 把第param个参数按列的类型转换
+func (p *conditionParser) bindValue(column *ColumnSchema, param int) paramBinder {
+	where, ct := p.where, column.Type
+	return func(params []string) (interface{}, error) {
+		cv := castValue(params[param-1], ct)
+		if cv == nil {
+			return nil, fmt.Errorf("invalid column type: %s", where)
+		}
 
-			} else if c == ')' {
-				nBracket--
-				if nBracket < 0 {
-					e = i
-					break
-				}
+		return cv, nil
+	}
+}
 
-			} else if c == '\'' {
-				quote = c
+// bindValues IN和BETWEEN的值列表，positions为成对的 位置,参数序号，参数序号为0的位置是常量
+func (p *conditionParser) bindValues(column *ColumnSchema, values []interface{}, positions []int) paramBinder {
+	where, ct := p.where, column.Type
+	return func(params []string) (interface{}, error) {
+		bound := make([]interface{}, len(values))
+		copy(bound, values)
+		for i := 0; i < len(positions); i += 2 {
+			param := positions[i+1]
+			if param == 0 {
+				continue
 			}
 
-		} else if c == quote {
-			quote = 0
+			cv := castValue(params[param-1], ct)
+			if cv == nil {
+				return nil, fmt.Errorf("invalid column type: %s", where)
+			}
+			bound[positions[i]] = cv
 		}
+
+		return bound, nil
 	}
+}
 
-	if quote != 0 {
-		return "", ""
+func (p *conditionParser) peek() token {
+	if p.pos >= len(p.tokens) {
+		return token{typ: tokenEnd, pos: len(p.where)}
 	}
 
-	*start = i
-	for i = e - 1; i >= s; i-- {
-		if value[i] != ' ' {
-			e = i + 1
-			break
-		}
+	return p.tokens[p.pos]
+}
+
+func (p *conditionParser) next() token {
+	t := p.peek()
+	if t.typ != tokenEnd {
+		p.pos++
 	}
 
-	if value[s] == '\'' && value[e-1] == '\'' {
-		s++
-		e--
+	return t
+}
+
+// acceptWord 下一个是关键字word时读取它
+func (p *conditionParser) acceptWord(word string) bool {
+	t := p.peek()
+	if t.typ == tokenWord && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
 	}
 
-	return value[s:e], slice.ByteSlice2String(sep)
+	return false
+}
+
+func joinCondition(operator string, left *conditionNode, right *conditionNode) *conditionNode {
+	node := &conditionNode{columnIdx: -1, operator: operator, child: left}
+	node.setRight(operator, right)
+	return node
 }
 
-func nextWordBySpace(value string, start *int) string {
-	s := nextNonEmptyIndex(value, *start)
-	if s < 0 {
-		return ""
+func isKeyword(word string) bool {
+	switch strings.ToUpper(word) {
+	case WordIN, WordAND, WordOR, WordNOT, WordLIKE, WordBETWEEN, WordIS, WordNULL:
+		return true
+	default:
+		return false
 	}
+}
 
-	n := len(value)
-	e := n
+// tokenize 把条件拆分为单词、`列名`、数字、'字符串'、?、比较符、括号和逗号
+func tokenize(where string) ([]token, error) {
+	tokens := make([]token, 0, 16)
+	n := len(where)
+	for i := 0; i < n; {
+		c := where[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
 
-	nBracket := 0
-	quote := byte(0)
+		case c == '(':
+			tokens = append(tokens, token{typ: tokenLeftParen, text: "(", pos: i})
+			i++
 
-	var i int
-	for i = s; i < n; i++ {
-		c := value[i]
+		case c == ')':
+			tokens = append(tokens, token{typ: tokenRightParen, text: ")", pos: i})
+			i++
 
-		if quote == 0 {
-			if nBracket == 0 && c == ' ' {
-				e = i
-				break
+		case c == ',':
+			tokens = append(tokens, token{typ: tokenComma, text: ",", pos: i})
+			i++
+
+		case c == '?':
+			tokens = append(tokens, token{typ: tokenParam, text: "?", pos: i})
+			i++
+
+		case c == '`':
+			end := strings.IndexByte(where[i+1:], '`')
+			if end < 0 {
+				return nil, fmt.Errorf("sign '`' mismatched")
+			}
+
+			tokens = append(tokens, token{typ: tokenQuotedWord, text: where[i+1 : i+1+end], pos: i})
+			i += end + 2
 
-			} else if c == '(' {
-				nBracket++
+		case c == '\'' || c == '"':
+			s, end, err := unquoteString(where, i)
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = append(tokens, token{typ: tokenString, text: s, pos: i})
+			i = end
 
-			} else if c == ')' {
-				nBracket--
-				if nBracket < 0 {
-					e = i
-					break
-				}
+		case c == '+' || c == '*' || c == '/' || (c == '-' && !isNumberStart(where, i, tokens)):
+			tokens = append(tokens, token{typ: tokenArithmetic, text: where[i : i+1], pos: i})
+			i++
+
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			i++
+			for i < n && strings.IndexByte("=<>", where[i]) >= 0 {
+				i++
+			}
 
-			} else if c == '\'' {
-				quote = c
+			op := where[start:i]
+			if _, ok := SelfConditionFuncMap[op]; !ok {
+				return nil, fmt.Errorf("nonsupport operator: %s", op)
 			}
+			tokens = append(tokens, token{typ: tokenOperator, text: op, pos: start})
+
+		case isNumberStart(where, i, tokens):
+			i++
+			for i < n && (isDigit(where[i]) || where[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{typ: tokenNumber, text: where[start:i], pos: start})
+
+		case isWordByte(c):
+			for i < n && isWordByte(where[i]) {
+				i++
+			}
+			tokens = append(tokens, token{typ: tokenWord, text: where[start:i], pos: start})
+
+		default:
+			return nil, fmt.Errorf("invalid character '%c' in condition: %s", c, where)
+		}
+	}
+
+	return tokens, nil
+}
+
+// unquoteString 读取从start开始的字符串常量，支持连续两个引号和反斜杠转义，返回内容和结束位置
+func unquoteString(where string, start int) (string, int, error) {
+	quote := where[start]
+	var builder strings.Builder
+	n := len(where)
+	for i := start + 1; i < n; i++ {
+		c := where[i]
+		if c == '\\' && i+1 < n {
+			i++
+			builder.WriteByte(where[i])
 
 		} else if c == quote {
-			quote = 0
+			if i+1 < n && where[i+1] == quote {
+				builder.WriteByte(quote)
+				i++
+				continue
+			}
+
+			return builder.String(), i + 1, nil
+
+		} else {
+			builder.WriteByte(c)
 		}
 	}
 
-	*start = i
-	//for i = e - 1; i > s; i-- {
-	//	if value[i] != ' ' {
-	//		e = i + 1
-	//		break
-	//	}
-	//}
+	return "", 0, fmt.Errorf("quote mismatched: %s", where)
+}
+
+// isNumberStart 负号只在前面不是操作数时属于数字
+func isNumberStart(where string, i int, tokens []token) bool {
+	c := where[i]
+	if isDigit(c) {
+		return true
+	}
+
+	if c != '-' || i+1 >= len(where) || !isDigit(where[i+1]) {
+		return false
+	}
+
+	if len(tokens) == 0 {
+		return true
+	}
 
-	if value[s] == '\'' && value[e-1] == '\'' {
-		s++
-		e--
+	switch tokens[len(tokens)-1].typ {
+	case tokenOperator, tokenArithmetic, tokenLeftParen, tokenComma:
+		return true
+	case tokenWord:
+		return isKeyword(tokens[len(tokens)-1].text)
+	default:
+		return false
 	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
 
-	return value[s:e]
+func isWordByte(c byte) bool {
+	return c == '_' || isDigit(c) ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= utf8.RuneSelf
 }
 
-func nextNonEmptyIndex(value string, start int) int {
-	n := len(value)
-	for i := start; i < n; i++ {
-		if value[i] != ' ' {
-			return i
+// likePattern 编译后的LIKE模式，按列的排序规则转换(likeFold)后逐个字符比较
+type likePattern struct {
+	runes []rune
+	//与runes对应，true表示%或_是通配符
+	wild      []bool
+	collation Collation
+}
+
+func compileLike(pattern string, collation Collation) *likePattern {
+	lp := &likePattern{collation: collation}
+	escaped := false
+	for _, r := range collation.likeFold(pattern) {
+		if !escaped && r == '\\' {
+			escaped = true
+			continue
 		}
+
+		lp.runes = append(lp.runes, r)
+		lp.wild = append(lp.wild, !escaped && (r == '%' || r == '_'))
+		escaped = false
 	}
 
-	return -1
+	return lp
 }
 
-func greater(value string, expected interface{}, ct ColumnType) bool {
+func (lp *likePattern) match(value string) bool {
+	s := []rune(lp.collation.likeFold(value))
+	pi, si := 0, 0
+	//最近一个%的位置，以及它匹配到的s的位置，用于回溯
+	star, mark := -1, 0
+	for si < len(s) {
+		if pi < len(lp.runes) && lp.wild[pi] && lp.runes[pi] == '%' {
+			star = pi
+			mark = si
+			pi++
+
+		} else if pi < len(lp.runes) && ((lp.wild[pi] && lp.runes[pi] == '_') || (!lp.wild[pi] && lp.runes[pi] == s[si])) {
+			pi++
+			si++
+
+		} else if star >= 0 {
+			pi = star + 1
+			mark++
+			si = mark
+
+		} else {
+			return false
+		}
+	}
+
+	for pi < len(lp.runes) && lp.wild[pi] && lp.runes[pi] == '%' {
+		pi++
+	}
+
+	return pi == len(lp.runes)
+}
+
+func greater(value string, expected interface{}, ct ColumnType, collation Collation) bool {
 	actual := castValue(value, ct)
 	if actual == nil {
 		return false
@@ -482,11 +859,11 @@ func greater(value string, expected interface{}, ct ColumnType) bool {
 		return actual.(int64) > expected.(int64)
 
 	default:
-		return actual.(string) > expected.(string)
+		return collation.compare(actual.(string), expected.(string)) > 0
 	}
 }
 
-func greaterOrEqual(value string, expected interface{}, ct ColumnType) bool {
+func greaterOrEqual(value string, expected interface{}, ct ColumnType, collation Collation) bool {
 	actual := castValue(value, ct)
 	if actual == nil {
 		return false
@@ -503,11 +880,11 @@ func greaterOrEqual(value string, expected interface{}, ct ColumnType) bool {
 		return actual.(int64) >= expected.(int64)
 
 	default:
-		return actual.(string) >= expected.(string)
+		return collation.compare(actual.(string), expected.(string)) >= 0
 	}
 }
 
-func less(value string, expected interface{}, ct ColumnType) bool {
+func less(value string, expected interface{}, ct ColumnType, collation Collation) bool {
 	actual := castValue(value, ct)
 	if actual == nil {
 		return false
@@ -524,11 +901,11 @@ func less(value string, expected interface{}, ct ColumnType) bool {
 		return actual.(int64) < expected.(int64)
 
 	default:
-		return actual.(string) < expected.(string)
+		return collation.compare(actual.(string), expected.(string)) < 0
 	}
 }
 
-func lessOrEqual(value string, expected interface{}, ct ColumnType) bool {
+func lessOrEqual(value string, expected interface{}, ct ColumnType, collation Collation) bool {
 	actual := castValue(value, ct)
 	if actual == nil {
 		return false
@@ -545,11 +922,11 @@ func lessOrEqual(value string, expected interface{}, ct ColumnType) bool {
 		return actual.(int64) <= expected.(int64)
 
 	default:
-		return actual.(string) <= expected.(string)
+		return collation.compare(actual.(string), expected.(string)) <= 0
 	}
 }
 
-func equal(value string, expected interface{}, ct ColumnType) bool {
+func equal(value string, expected interface{}, ct ColumnType, collation Collation) bool {
 	actual := castValue(value, ct)
 	if actual == nil {
 		return false
@@ -566,27 +943,35 @@ func equal(value string, expected interface{}, ct ColumnType) bool {
 		return actual.(int64) == expected.(int64)
 
 	default:
-		return actual.(string) == expected.(string)
+		return collation.compare(actual.(string), expected.(string)) == 0
 	}
 }
 
-func notEqual(value string, expected interface{}, ct ColumnType) bool {
+func notEqual(value string, expected interface{}, ct ColumnType, collation Collation) bool {
 	actual := castValue(value, ct)
 	if actual == nil {
 		return false
 	}
 
+	if ct == ColumnTypeString {
+		return collation.compare(actual.(string), expected.(string)) != 0
+	}
+
 	return actual != expected
 }
 
-func in(value string, expected interface{}, ct ColumnType) bool {
+func in(value string, expected interface{}, ct ColumnType, collation Collation) bool {
 	actual := castValue(value, ct)
 	if actual == nil {
 		return false
 	}
 
 	for _, v := range expected.([]interface{}) {
-		if v == actual {
+		if ct == ColumnTypeString {
+			if collation.compare(actual.(string), v.(string)) == 0 {
+				return true
+			}
+		} else if v == actual {
 			return true
 		}
 	}
@@ -594,12 +979,57 @@ func in(value string, expected interface{}, ct ColumnType) bool {
 	return false
 }
 
-func and(left bool, right bool) bool {
-	return left && right
+func like(value string, expected interface{}, _ ColumnType, _ Collation) bool {
+	return expected.(*likePattern).match(value)
+}
+
+func between(value string, expected interface{}, ct ColumnType, collation Collation) bool {
+	bounds := expected.([]interface{})
+	return greaterOrEqual(value, bounds[0], ct, collation) && lessOrEqual(value, bounds[1], ct, collation)
+}
+
+// isNull 非NULL的值
+func isNull(_ string, _ interface{}, _ ColumnType, _ Collation) bool {
+	return false
+}
+
+func isNotNull(_ string, _ interface{}, _ ColumnType, _ Collation) bool {
+	return true
 }
 
-func or(left bool, right bool) bool {
-	return left || right
+func and(left ConditionResult, right ConditionResult) ConditionResult {
+	if left == ConditionFalse || right == ConditionFalse {
+		return ConditionFalse
+	}
+
+	if left == ConditionTrue && right == ConditionTrue {
+		return ConditionTrue
+	}
+
+	return ConditionUnknown
+}
+
+func or(left ConditionResult, right ConditionResult) ConditionResult {
+	if left == ConditionTrue || right == ConditionTrue {
+		return ConditionTrue
+	}
+
+	if left == ConditionFalse && right == ConditionFalse {
+		return ConditionFalse
+	}
+
+	return ConditionUnknown
+}
+
+func not(v ConditionResult) ConditionResult {
+	switch v {
+	case ConditionTrue:
+		return ConditionFalse
+	case ConditionFalse:
+		return ConditionTrue
+	default:
+		return ConditionUnknown
+	}
 }
 
 func castValue(value string, ct ColumnType) interface{} {
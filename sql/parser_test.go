@@ -0,0 +1,246 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParser_Check(t *testing.T) {
+	schema := newTestSchema()
+	//MySQL默认的_ci排序规则
+	schema.Columns[2].Collation = CollationNoCase
+	row := NewRowDataFromMap(schema, map[string]string{"uid": "1", "id": "2", "name": "Alice_1", "gold": "10"})
+
+	cases := []struct {
+		where    string
+		params   []string
+		expected bool
+	}{
+		{"gold>5", nil, true},
+		{"`gold`<>?", []string{"10"}, false},
+		{"gold>=10 AND id IN (1, 2, 3)", nil, true},
+		{"id NOT IN (1, ?)", []string{"2"}, false},
+		{"NOT gold>5", nil, false},
+		{"NOT (gold>5 AND id=3)", nil, true},
+		{"gold>20 OR id=2", nil, true},
+		{"gold>20 OR id=3 AND gold=10", nil, false},
+		{"(gold>20 OR id=2) AND gold=10", nil, true},
+		{"name LIKE 'al%'", nil, true},
+		{"name LIKE ?", []string{"A_ice%"}, true},
+		{"name LIKE 'Alice\\_1'", nil, true},
+		{"name LIKE 'Alice\\_'", nil, false},
+		{"name NOT LIKE '%x%'", nil, true},
+		{"gold BETWEEN 5 AND 10 AND id=2", nil, true},
+		{"gold NOT BETWEEN ? AND ?", []string{"11", "20"}, true},
+		{"gold BETWEEN -5 AND 9", nil, false},
+		{"name IS NULL", nil, false},
+		{"name IS NOT NULL AND name='Alice_1'", nil, true},
+		{"name = \"it's\" OR name='it''s'", nil, false},
+		{"uid=1 AND (gold<0 OR NOT id!=2)", nil, true},
+		//_ci的字符串比较与LIKE一样不区分大小写
+		{"name='alice_1'", nil, true},
+		{"name<>'ALICE_1'", nil, false},
+		{"name IN ('x', ?)", []string{"ALICE_1"}, true},
+		{"name>'alice' AND name<'B'", nil, true},
+		{"name BETWEEN 'ALICE' AND 'alice_2'", nil, true},
+	}
+
+	for _, c := range cases {
+		parser, err := CreateParser(schema, "1", c.where, c.params)
+		require.NoError(t, err, c.where)
+		require.Equal(t, c.expected, parser.Check(row), c.where)
+	}
+}
+
+func TestParser_Expression(t *testing.T) {
+	schema := CreateFakeTableSchema([]FakeColumn{
+		{Name: "uid", Type: ColumnTypeInt},
+		{Name: "hp", Type: ColumnTypeInt},
+		{Name: "max_hp", Type: ColumnTypeInt},
+		{Name: "rate", Type: ColumnTypeFloat},
+		{Name: "name", Type: ColumnTypeString},
+		{Name: "nick", Type: ColumnTypeString},
+		{Name: "ctime", Type: ColumnTypeTime},
+	}, 1)
+	schema.Columns[5].Collation = CollationNoCase
+	row := NewRowDataFromMap(schema, map[string]string{"uid": "1", "hp": "30", "max_hp": "100", "rate": "0.5",
+		"name": "abc", "nick": "abd", "ctime": "2024-01-02 03:04:05"})
+
+	cases := []struct {
+		where    string
+		params   []string
+		expected bool
+	}{
+		{"hp < max_hp", nil, true},
+		{"hp + 1 >= ?", []string{"31"}, true},
+		{"hp+1>?", []string{"31"}, false},
+		{"(hp + 20) * 2 = max_hp", nil, true},
+		{"hp * 2 + 40 = max_hp", nil, true},
+		{"hp - -10 = 40 AND -hp = -30", nil, true},
+		{"max_hp / 3 > 33", nil, true},
+		{"max_hp / 3 = 33", nil, false},
+		{"hp / 0 = 1 OR NOT hp / 0 = 1", nil, false},
+		{"max_hp * rate > hp", nil, true},
+		{"? < hp", []string{"10"}, true},
+		{"name < nick", nil, true},
+		{"name = nick", nil, false},
+		//列的排序规则优先于常量：name区分大小写，nick不区分
+		{"name < 'ABD' AND nick = 'ABD'", nil, false},
+		{"name > 'ABD' AND nick = 'ABD'", nil, true},
+		{"hp > '20'", nil, true},
+		{"ctime > ?", []string{"2024-01-01 00:00:00"}, true},
+		{"ctime + 0 > ctime", nil, false},
+		{"(hp > 10 OR hp < 0) AND (max_hp - hp) > 50", nil, true},
+		{"((hp)) = 30", nil, true},
+	}
+
+	for _, c := range cases {
+		parser, err := CreateParser(schema, "1", c.where, c.params)
+		require.NoError(t, err, c.where)
+		require.Equal(t, c.expected, parser.Check(row), c.where)
+	}
+
+	for _, where := range []string{"hp + = 1", "hp + foo > 1", "(hp + 1 > 1", "uid + 0 = 1", "hp + 1 LIKE 'a'"} {
+		_, err := CreateParser(schema, "1", where, nil)
+		require.Error(t, err, where)
+	}
+}
+
+func TestParser_Error(t *testing.T) {
+	schema := newTestSchema()
+	for _, where := range []string{
+		"gold>",
+		"gold>?",
+		"(gold>1",
+		"gold BETWEEN 1",
+		"gold IS 1",
+		"foo=1",
+		"gold=1 AND",
+		"`gold=1",
+		"name='abc",
+		"gold>1 gold<2",
+		"gold=abc",
+		"gold ~ 1",
+	} {
+		_, err := CreateParser(schema, "1", where, nil)
+		require.Error(t, err, where)
+	}
+}
+
+func TestParser_Shard(t *testing.T) {
+	schema := newTestSchema()
+
+	parser, err := CreateParser(schema, "1", "uid=? AND gold>1 OR uid=1 AND id=2", []string{"1"})
+	require.Error(t, err)
+
+	//OR is allowed at level 0 when the shard condition is still ANDed
+	parser, err = CreateParser(schema, "1", "uid=1 AND (gold>1 OR id=2)", nil)
+	require.NoError(t, err)
+	require.True(t, parser.ValidShard())
+
+	parser, err = CreateParser(schema, "1", "gold>1 OR id=2", nil)
+	require.NoError(t, err)
+	require.False(t, parser.ValidShard())
+
+	for _, where := range []string{"uid=2", "uid>1", "NOT uid=1", "gold>1 OR uid=1"} {
+		_, err = CreateParser(schema, "1", where, nil)
+		require.Error(t, err, where)
+	}
+}
+
+func TestParser_Collation(t *testing.T) {
+	schema := newTestSchema()
+	row := NewRowDataFromMap(schema, map[string]string{"uid": "1", "id": "2", "name": "Alice_1", "gold": "10"})
+
+	cases := []struct {
+		where  string
+		params []string
+		//CollationBinary, CollationNoCase, CollationBinaryLikeNoCase的结果
+		expected [3]bool
+	}{
+		{"name='alice_1'", nil, [3]bool{false, true, false}},
+		{"name<>'ALICE_1'", nil, [3]bool{true, false, true}},
+		{"name IN ('x', ?)", []string{"ALICE_1"}, [3]bool{false, true, false}},
+		{"name>'B'", nil, [3]bool{false, false, false}},
+		{"name<'a'", nil, [3]bool{true, false, true}},
+		{"name BETWEEN 'ALICE' AND 'alice_2'", nil, [3]bool{true, true, true}},
+		{"name BETWEEN 'Alicf' AND 'b'", nil, [3]bool{false, false, false}},
+		{"name LIKE 'al%'", nil, [3]bool{false, true, true}},
+		{"name LIKE ?", []string{"ALICE\\_1"}, [3]bool{false, true, true}},
+		{"name LIKE 'A%'", nil, [3]bool{true, true, true}},
+	}
+
+	for i, collation := range []Collation{CollationBinary, CollationNoCase, CollationBinaryLikeNoCase} {
+		schema.Columns[2].Collation = collation
+		schema.parsers.reset()
+		for _, c := range cases {
+			parser, err := CreateParser(schema, "1", c.where, c.params)
+			require.NoError(t, err, c.where)
+			require.Equal(t, c.expected[i], parser.Check(row), "%d %s", collation, c.where)
+		}
+	}
+}
+
+func TestParser_Cache(t *testing.T) {
+	schema := newTestSchema()
+	row := NewRowDataFromMap(schema, map[string]string{"uid": "1", "id": "2", "name": "Alice_1", "gold": "10"})
+	where := "uid=? AND gold BETWEEN ? AND 20 AND id IN (1, ?) AND name LIKE ? AND gold + ? > 12"
+
+	p1, err := CreateParser(schema, "1", where, []string{"1", "5", "2", "A%", "3"})
+	require.NoError(t, err)
+	p2, err := CreateParser(schema, "1", where, []string{"1", "11", "2", "A%", "3"})
+	require.NoError(t, err)
+	require.Same(t, p1.tmpl, p2.tmpl)
+	require.Equal(t, 1, schema.parsers.len())
+
+	//the same template binds different params
+	require.True(t, p1.Check(row))
+	require.False(t, p2.Check(row))
+
+	//the shard value and param types are checked on every bind
+	_, err = CreateParser(schema, "2", where, []string{"1", "5", "2", "a%", "3"})
+	require.Error(t, err)
+	_, err = CreateParser(schema, "1", where, []string{"2", "5", "2", "a%", "3"})
+	require.Error(t, err)
+	_, err = CreateParser(schema, "1", where, []string{"1", "x", "2", "a%", "3"})
+	require.Error(t, err)
+	_, err = CreateParser(schema, "1", where, []string{"1"})
+	require.Error(t, err)
+
+	//a failed compile is not cached
+	_, err = CreateParser(schema, "1", "gold>", nil)
+	require.Error(t, err)
+	require.Equal(t, 1, schema.parsers.len())
+
+	schema.parsers.reset()
+	require.Zero(t, schema.parsers.len())
+}
+
+func BenchmarkCreateParser(b *testing.B) {
+	schema := newTestSchema()
+	where := "uid=? AND gold>=? AND id IN (?, ?, 3) AND name LIKE ?"
+	params := []string{"1", "10", "1", "2", "Alice%"}
+
+	b.Run("Compile", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tmpl, err := compileCondition(schema, where)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err = tmpl.bind(schema, "1", where, params); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := CreateParser(schema, "1", where, params); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
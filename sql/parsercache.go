@@ -0,0 +1,111 @@
+package sql
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MaxCachedCondition 每个TableSchema最多缓存的WHERE编译结果，超出后清空重新缓存
+const MaxCachedCondition = 1024
+
+// paramBinder 把请求的参数转换为节点比较时使用的值
+type paramBinder func(params []string) (interface{}, error)
+
+// conditionTemplate 编译后的WHERE，不依赖参数和shardKey，可以被多个请求同时使用
+type conditionTemplate struct {
+	cn     *conditionNode
+	nParam int
+	slots  []paramBinder
+	//shard列=值 的条件，值在绑定时与shardKey比较
+	shards []*conditionNode
+}
+
+// bind 转换参数并检查shard条件，只分配参数槽位的值
+func (tmpl *conditionTemplate) bind(schema *TableSchema, shardKey string, where string, params []string) (*Parser, error) {
+	if len(params) != tmpl.nParam {
+		return nil, fmt.Errorf("condition mismatch parameter num")
+	}
+
+	p := &Parser{
+		hasShard: len(tmpl.shards) > 0,
+		schema:   schema,
+		where:    where,
+		tmpl:     tmpl,
+	}
+
+	if len(tmpl.slots) > 0 {
+		p.args = make([]interface{}, len(tmpl.slots))
+		for i, binder := range tmpl.slots {
+			value, err := binder(params)
+			if err != nil {
+				return nil, err
+			}
+			p.args[i] = value
+		}
+	}
+
+	for _, cn := range tmpl.shards {
+		if cn.expectedValue(p.args) != castValue(shardKey, cn.columnType) {
+			return nil, fmt.Errorf("invalid shard condition: %s", where)
+		}
+	}
+
+	return p, nil
+}
+
+// parserCache 一个TableSchema的WHERE编译结果，key为WHERE原文；
+// schema重新加载后旧schema的缓存由TableSchemaManager.ReloadSchema清空
+type parserCache struct {
+	sync.RWMutex
+	templates map[string]*conditionTemplate
+}
+
+func newParserCache() *parserCache {
+	return &parserCache{
+		templates: make(map[string]*conditionTemplate),
+	}
+}
+
+// get 返回编译结果，编译失败的WHERE不缓存；pc为nil时每次都重新编译
+func (pc *parserCache) get(schema *TableSchema, where string) (*conditionTemplate, error) {
+	if pc == nil {
+		return compileCondition(schema, where)
+	}
+
+	pc.RLock()
+	tmpl := pc.templates[where]
+	pc.RUnlock()
+	if tmpl != nil {
+		return tmpl, nil
+	}
+
+	tmpl, err := compileCondition(schema, where)
+	if err != nil {
+		return nil, err
+	}
+
+	pc.Lock()
+	if len(pc.templates) >= MaxCachedCondition {
+		pc.templates = make(map[string]*conditionTemplate)
+	}
+	pc.templates[where] = tmpl
+	pc.Unlock()
+
+	return tmpl, nil
+}
+
+func (pc *parserCache) reset() {
+	if pc == nil {
+		return
+	}
+
+	pc.Lock()
+	pc.templates = make(map[string]*conditionTemplate)
+	pc.Unlock()
+}
+
+func (pc *parserCache) len() int {
+	pc.RLock()
+	defer pc.RUnlock()
+	return len(pc.templates)
+}
@@ -0,0 +1,840 @@
+package sql
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+)
+
+// pgFake 实现Postgres前后端协议中lib/pq使用的部分(文本格式的简单查询和扩展查询、事务状态)，
+// 把语句转换为SQLite的语法后在一个SQLite文件上执行，没有Postgres时用于测试Postgres驱动。
+// 转换只覆盖sqlDriver生成的语句：$n参数、INSERT的VALUES中的DEFAULT，以及pgLoadSchemaSql
+type pgFake struct {
+	ln net.Listener
+	db *sql.DB
+
+	mu    sync.Mutex
+	conns []net.Conn
+	wg    sync.WaitGroup
+}
+
+type pgSession struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	sc   *sql.Conn
+	//ReadyForQuery中的事务状态：I空闲，T事务中，E事务失败
+	status byte
+	stmts  map[string]*pgStmt
+	portal *pgPortal
+	//扩展查询出错后忽略消息直到Sync
+	skip bool
+}
+
+type pgStmt struct {
+	query  string
+	nParam int
+	//查询返回的列，nil表示不返回行
+	columns []string
+	oids    []int32
+	//pgLoadSchemaSql，由PRAGMA table_info回答
+	schema bool
+}
+
+type pgPortal struct {
+	stmt   *pgStmt
+	params []interface{}
+}
+
+// pgError 转换为ErrorResponse的错误
+type pgError struct {
+	code string
+	msg  string
+}
+
+func (e *pgError) Error() string {
+	return e.msg
+}
+
+const (
+	pgOidBool = 16
+	pgOidText = 25
+)
+
+// newPgFake 返回连接fake的url，测试结束时关闭
+func newPgFake(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "pg.db")
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	f := &pgFake{ln: ln, db: db}
+	go f.serve()
+	t.Cleanup(f.close)
+	return "postgres://test@" + ln.Addr().String() + "/test?sslmode=disable"
+}
+
+func (f *pgFake) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.conns = append(f.conns, conn)
+		f.wg.Add(1)
+		f.mu.Unlock()
+
+		go func() {
+			defer f.wg.Done()
+			defer conn.Close()
+			f.session(conn)
+		}()
+	}
+}
+
+func (f *pgFake) close() {
+	_ = f.ln.Close()
+	f.mu.Lock()
+	for _, conn := range f.conns {
+		_ = conn.Close()
+	}
+	f.mu.Unlock()
+
+	f.wg.Wait()
+	_ = f.db.Close()
+}
+
+func (f *pgFake) session(conn net.Conn) {
+	sc, err := f.db.Conn(context.Background())
+	if err != nil {
+		return
+	}
+	defer sc.Close()
+
+	s := &pgSession{
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		w:      bufio.NewWriter(conn),
+		sc:     sc,
+		status: 'I',
+		stmts:  make(map[string]*pgStmt),
+	}
+
+	if err := s.startup(); err != nil {
+		return
+	}
+
+	for {
+		typ, body, err := s.read()
+		if err != nil {
+			return
+		}
+
+		if s.skip && typ != 'S' {
+			continue
+		}
+
+		b := &pgReadBuf{b: body}
+		switch typ {
+		case 'Q':
+			s.simpleQuery(b.string())
+
+		case 'P':
+			name, query := b.string(), b.string()
+			ps, err := s.parse(query)
+			if err != nil {
+				s.extendedFail(err)
+				continue
+			}
+			s.stmts[name] = ps
+			s.send('1', nil)
+
+		case 'D':
+			kind, name := b.byte(), b.string()
+			ps := s.stmts[name]
+			if kind == 'P' && s.portal != nil {
+				ps = s.portal.stmt
+			}
+
+			if ps == nil {
+				s.extendedFail(&pgError{code: "26000", msg: "prepared statement does not exist"})
+				continue
+			}
+
+			if kind == 'S' {
+				var w pgWriteBuf
+				w.int16(ps.nParam)
+				for i := 0; i < ps.nParam; i++ {
+					w.int32(0)
+				}
+				s.send('t', w)
+			}
+			s.describe(ps)
+
+		case 'B':
+			b.string()
+			ps := s.stmts[b.string()]
+			if ps == nil {
+				s.extendedFail(&pgError{code: "26000", msg: "prepared statement does not exist"})
+				continue
+			}
+
+			for n := b.int16(); n > 0; n-- {
+				b.int16()
+			}
+
+			params := make([]interface{}, b.int16())
+			for i := range params {
+				if n := b.int32(); n >= 0 {
+					params[i] = pgParam(string(b.next(int(n))))
+				}
+			}
+			s.portal = &pgPortal{stmt: ps, params: params}
+			s.send('2', nil)
+
+		case 'E':
+			if s.portal == nil {
+				s.extendedFail(&pgError{code: "34000", msg: "portal does not exist"})
+				continue
+			}
+
+			if err := s.execute(s.portal.stmt, s.portal.params, false); err != nil {
+				s.extendedFail(err)
+			}
+
+		case 'C':
+			if b.byte() == 'S' {
+				delete(s.stmts, b.string())
+			}
+			s.send('3', nil)
+
+		case 'S':
+			s.skip = false
+			s.portal = nil
+			s.ready()
+
+		case 'X':
+			return
+
+		default:
+			s.extendedFail(fmt.Errorf("unsupported message %q", typ))
+		}
+	}
+}
+
+// startup 不需要认证，拒绝SSL
+func (s *pgSession) startup() error {
+	for {
+		var n int32
+		if err := binary.Read(s.r, binary.BigEndian, &n); err != nil {
+			return err
+		}
+
+		body := make([]byte, n-4)
+		if _, err := io.ReadFull(s.r, body); err != nil {
+			return err
+		}
+
+		//SSLRequest
+		if binary.BigEndian.Uint32(body) == 80877103 {
+			if _, err := s.conn.Write([]byte{'N'}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var w pgWriteBuf
+		w.int32(0)
+		s.send('R', w)
+		s.parameterStatus("server_version", "14.0")
+		s.parameterStatus("client_encoding", "UTF8")
+		s.ready()
+		return nil
+	}
+}
+
+func (s *pgSession) read() (byte, []byte, error) {
+	typ, err := s.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var n int32
+	if err = binary.Read(s.r, binary.BigEndian, &n); err != nil {
+		return 0, nil, err
+	}
+
+	body := make([]byte, n-4)
+	_, err = io.ReadFull(s.r, body)
+	return typ, body, err
+}
+
+func (s *pgSession) send(typ byte, body pgWriteBuf) {
+	_ = s.w.WriteByte(typ)
+	_ = binary.Write(s.w, binary.BigEndian, int32(len(body)+4))
+	_, _ = s.w.Write(body)
+}
+
+func (s *pgSession) parameterStatus(name string, value string) {
+	var w pgWriteBuf
+	w.string(name)
+	w.string(value)
+	s.send('S', w)
+}
+
+func (s *pgSession) ready() {
+	s.send('Z', pgWriteBuf{s.status})
+	_ = s.w.Flush()
+}
+
+// fail 发送ErrorResponse，事务中出错时事务进入失败状态
+func (s *pgSession) fail(err error) {
+	code := "XX000"
+	var pe *pgError
+	var se sqlite3.Error
+	switch {
+	case errors.As(err, &pe):
+		code = pe.code
+
+	case errors.As(err, &se) && se.Code == sqlite3.ErrConstraint:
+		code = "23000"
+		switch se.ExtendedCode {
+		case sqlite3.ErrConstraintPrimaryKey, sqlite3.ErrConstraintUnique:
+			code = "23505"
+		case sqlite3.ErrConstraintNotNull:
+			code = "23502"
+		}
+
+	case errors.As(err, &se):
+		code = "42000"
+	}
+
+	var w pgWriteBuf
+	for _, field := range [][2]string{{"S", "ERROR"}, {"V", "ERROR"}, {"C", code}, {"M", err.Error()}} {
+		w = append(w, field[0][0])
+		w.string(field[1])
+	}
+	w = append(w, 0)
+	s.send('E', w)
+
+	if s.status == 'T' {
+		s.status = 'E'
+	}
+}
+
+func (s *pgSession) extendedFail(err error) {
+	s.fail(err)
+	s.skip = true
+}
+
+func (s *pgSession) simpleQuery(query string) {
+	defer s.ready()
+
+	query = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	if query == "" {
+		s.send('I', nil)
+		return
+	}
+
+	var err error
+	switch verb := pgVerb(query); verb {
+	case "BEGIN", "START":
+		if _, err = s.sc.ExecContext(context.Background(), "BEGIN"); err == nil {
+			s.status = 'T'
+			s.commandComplete("BEGIN")
+		}
+
+	case "COMMIT", "END", "ROLLBACK", "ABORT":
+		//失败的事务在COMMIT时回滚
+		tag := "COMMIT"
+		if verb == "ROLLBACK" || verb == "ABORT" || s.status == 'E' {
+			tag = "ROLLBACK"
+		}
+
+		if _, err = s.sc.ExecContext(context.Background(), tag); err == nil {
+			s.status = 'I'
+			s.commandComplete(tag)
+		}
+
+	default:
+		var ps *pgStmt
+		if ps, err = s.parse(query); err == nil {
+			err = s.execute(ps, nil, true)
+		}
+	}
+
+	if err != nil {
+		s.fail(err)
+	}
+}
+
+func (s *pgSession) commandComplete(tag string) {
+	var w pgWriteBuf
+	w.string(tag)
+	s.send('C', w)
+}
+
+// parse 转换语句并在SQLite上预编译，查询语句同时得到返回的列
+func (s *pgSession) parse(query string) (*pgStmt, error) {
+	if s.status == 'E' {
+		return nil, errPgAborted
+	}
+
+	if strings.TrimSpace(query) == pgLoadSchemaSql {
+		return &pgStmt{
+			nParam:  1,
+			columns: []string{"column_name", "data_type", "column_default", "?column?", "?column?"},
+			oids:    []int32{pgOidText, pgOidText, pgOidText, pgOidBool, pgOidBool},
+			schema:  true,
+		}, nil
+	}
+
+	ps := &pgStmt{}
+	var err error
+	if ps.query, ps.nParam, err = s.rewrite(query); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	switch pgVerb(ps.query) {
+	case "SELECT", "WITH", "VALUES", "PRAGMA":
+		//只绑定参数，不调用Next时SQLite不会执行语句
+		rows, err := s.sc.QueryContext(ctx, ps.query, make([]interface{}, ps.nParam)...)
+		if err != nil {
+			return nil, err
+		}
+
+		ps.columns, err = rows.Columns()
+		_ = rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		ps.oids = make([]int32, len(ps.columns))
+		for i := range ps.oids {
+			ps.oids[i] = pgOidText
+		}
+
+	default:
+		stmt, err := s.sc.PrepareContext(ctx, ps.query)
+		if err != nil {
+			return nil, err
+		}
+		_ = stmt.Close()
+	}
+
+	return ps, nil
+}
+
+func (s *pgSession) describe(ps *pgStmt) {
+	if ps.columns == nil {
+		s.send('n', nil)
+		return
+	}
+
+	var w pgWriteBuf
+	w.int16(len(ps.columns))
+	for i, name := range ps.columns {
+		w.string(name)
+		w.int32(0)
+		w.int16(0)
+		w.int32(ps.oids[i])
+		w.int16(-1)
+		w.int32(-1)
+		w.int16(0)
+	}
+	s.send('T', w)
+}
+
+// execute 执行语句并发送结果，describe为true时(简单查询)先发送RowDescription
+func (s *pgSession) execute(ps *pgStmt, params []interface{}, describe bool) error {
+	if s.status == 'E' {
+		return errPgAborted
+	}
+
+	ctx := context.Background()
+	if ps.columns == nil {
+		ret, err := s.sc.ExecContext(ctx, ps.query, params...)
+		if err != nil {
+			return err
+		}
+
+		n, _ := ret.RowsAffected()
+		s.commandComplete(pgCommandTag(ps.query, n))
+		return nil
+	}
+
+	var rows *sql.Rows
+	var err error
+	if ps.schema {
+		name, _ := params[0].(string)
+		rows, err = s.sc.QueryContext(ctx, `PRAGMA table_info("`+name+`")`)
+
+	} else {
+		rows, err = s.sc.QueryContext(ctx, ps.query, params...)
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if describe {
+		s.describe(ps)
+	}
+
+	columns, _ := rows.Columns()
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+
+		row := values
+		if ps.schema {
+			row = pgColumnInfo(values)
+		}
+
+		var w pgWriteBuf
+		w.int16(len(row))
+		for _, v := range row {
+			text, ok := pgText(v)
+			if !ok {
+				w.int32(-1)
+				continue
+			}
+			w.int32(int32(len(text)))
+			w = append(w, text...)
+		}
+		s.send('D', w)
+		n++
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.commandComplete("SELECT " + strconv.Itoa(n))
+	return nil
+}
+
+// rewrite 把$n替换为SQLite的?n，INSERT的VALUES中的DEFAULT替换为列的默认值；返回参数个数
+func (s *pgSession) rewrite(query string) (string, int, error) {
+	var defaults []string
+	if pgVerb(query) == "INSERT" && strings.Contains(strings.ToUpper(query), "DEFAULT") {
+		var err error
+		if defaults, err = s.insertDefaults(query); err != nil {
+			return "", 0, err
+		}
+	}
+
+	var builder strings.Builder
+	nParam := 0
+	n := len(query)
+	inValues := false
+	depth, column := 0, 0
+	for i := 0; i < n; i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			e := strings.IndexByte(query[i+1:], c)
+			if e < 0 {
+				e = n - i - 1
+			}
+			builder.WriteString(query[i : i+e+2])
+			i += e + 1
+
+		case c == '$':
+			j := i + 1
+			for j < n && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+
+			if v, err := strconv.Atoi(query[i+1 : j]); err == nil && v > nParam {
+				nParam = v
+			}
+			builder.WriteByte('?')
+			builder.WriteString(query[i+1 : j])
+			i = j - 1
+
+		case defaults != nil && c == '(' && inValues:
+			depth++
+			column = 0
+			builder.WriteByte(c)
+
+		case defaults != nil && c == ')' && inValues:
+			depth--
+			builder.WriteByte(c)
+
+		case defaults != nil && c == ',' && depth > 0:
+			column++
+			builder.WriteByte(c)
+
+		case defaults != nil && pgWordAt(query, i, "VALUES"):
+			inValues = true
+			builder.WriteString(query[i : i+6])
+			i += 5
+
+		case defaults != nil && depth > 0 && pgWordAt(query, i, "DEFAULT"):
+			if column < len(defaults) {
+				builder.WriteString(defaults[column])
+			} else {
+				builder.WriteString("NULL")
+			}
+			i += 6
+
+		case defaults != nil && depth == 0 && inValues && c >= 'A' && c <= 'Z':
+			//VALUES之后的子句(ON CONFLICT ...)
+			inValues = false
+			builder.WriteByte(c)
+
+		default:
+			builder.WriteByte(c)
+		}
+	}
+
+	return builder.String(), nParam, nil
+}
+
+// insertDefaults INSERT INTO t ("a","b") VALUES ... 中各列的默认值表达式
+func (s *pgSession) insertDefaults(query string) ([]string, error) {
+	start := strings.IndexByte(query, '(')
+	end := strings.IndexByte(query, ')')
+	if start < 0 || end < start {
+		return nil, &pgError{code: "42601", msg: "syntax error at or near VALUES"}
+	}
+
+	table := strings.Trim(strings.TrimSpace(query[len("INSERT INTO "):start]), `"`)
+	rows, err := s.sc.QueryContext(context.Background(), `PRAGMA table_info("`+table+`")`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	m := make(map[string]string)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typeDesc, defaultDesc sql.NullString
+		if err := rows.Scan(&cid, &name, &typeDesc, &notNull, &defaultDesc, &pk); err != nil {
+			return nil, err
+		}
+
+		m[name.String] = "NULL"
+		if defaultDesc.Valid {
+			m[name.String] = defaultDesc.String
+		}
+	}
+
+	var defaults []string
+	for _, column := range strings.Split(query[start+1:end], ",") {
+		defaults = append(defaults, m[strings.Trim(strings.TrimSpace(column), `"`)])
+	}
+
+	return defaults, rows.Err()
+}
+
+var errPgAborted = &pgError{code: "25P02", msg: "current transaction is aborted, commands ignored until end of transaction block"}
+
+func pgVerb(query string) string {
+	query = strings.TrimSpace(query)
+	if i := strings.IndexAny(query, " \t\n("); i > 0 {
+		query = query[:i]
+	}
+
+	return strings.ToUpper(query)
+}
+
+func pgWordAt(query string, i int, word string) bool {
+	e := i + len(word)
+	if e > len(query) || !strings.EqualFold(query[i:e], word) {
+		return false
+	}
+
+	isWord := func(c byte) bool {
+		return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+
+	return (i == 0 || !isWord(query[i-1])) && (e == len(query) || !isWord(query[e]))
+}
+
+func pgCommandTag(query string, n int64) string {
+	fields := strings.Fields(strings.ToUpper(query))
+	switch verb := fields[0]; verb {
+	case "INSERT":
+		return "INSERT 0 " + strconv.FormatInt(n, 10)
+
+	case "UPDATE", "DELETE":
+		return verb + " " + strconv.FormatInt(n, 10)
+
+	case "CREATE", "DROP", "ALTER":
+		if len(fields) > 1 {
+			return verb + " " + fields[1]
+		}
+		return verb
+
+	default:
+		return verb
+	}
+}
+
+// pgParam 文本格式的参数，规范形式的数字转换为数字，与Postgres按列的类型推断参数类型一致
+func pgParam(s string) interface{} {
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(v, 10) == s {
+		return v
+	}
+
+	if v, err := strconv.ParseFloat(s, 64); err == nil && strconv.FormatFloat(v, 'f', -1, 64) == s {
+		return v
+	}
+
+	return s
+}
+
+func pgText(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case nil:
+		return nil, false
+	case []byte:
+		return v, true
+	case string:
+		return []byte(v), true
+	case int64:
+		return strconv.AppendInt(nil, v, 10), true
+	case float64:
+		return strconv.AppendFloat(nil, v, 'g', -1, 64), true
+	case bool:
+		if v {
+			return []byte("t"), true
+		}
+		return []byte("f"), true
+	case time.Time:
+		return []byte(v.Format("2006-01-02 15:04:05")), true
+	default:
+		return []byte(fmt.Sprint(v)), true
+	}
+}
+
+// pgColumnInfo 把PRAGMA table_info的一行(cid, name, type, notnull, dflt_value, pk)
+// 转换为pgLoadSchemaSql的一行(column_name, data_type, column_default, 是否主键, 是否可以为NULL)
+func pgColumnInfo(values []interface{}) []interface{} {
+	name, _ := pgText(values[1])
+	decl, _ := pgText(values[2])
+	dataType := pgDataType(string(decl))
+
+	var columnDefault interface{}
+	if text, ok := pgText(values[4]); ok {
+		columnDefault = string(text)
+		if len(text) > 0 && text[0] == '\'' {
+			columnDefault = string(text) + "::" + dataType
+		}
+	}
+
+	pk, _ := values[5].(int64)
+	notNull, _ := values[3].(int64)
+	return []interface{}{name, dataType, columnDefault, pk > 0, notNull == 0}
+}
+
+// pgDataType 建表时的类型转换为information_schema.columns.data_type中的名字
+func pgDataType(decl string) string {
+	decl = strings.ToLower(strings.TrimSpace(decl))
+	if i := strings.IndexByte(decl, '('); i > 0 {
+		decl = strings.TrimSpace(decl[:i])
+	}
+
+	switch decl {
+	case "int", "integer", "int4":
+		return "integer"
+	case "bigint", "int8":
+		return "bigint"
+	case "varchar", "character varying":
+		return "character varying"
+	case "double", "double precision", "float8":
+		return "double precision"
+	case "decimal", "numeric":
+		return "numeric"
+	case "timestamp":
+		return "timestamp without time zone"
+	default:
+		return decl
+	}
+}
+
+type pgReadBuf struct {
+	b []byte
+}
+
+func (b *pgReadBuf) byte() byte {
+	c := b.b[0]
+	b.b = b.b[1:]
+	return c
+}
+
+func (b *pgReadBuf) int16() int {
+	v := int(int16(binary.BigEndian.Uint16(b.b)))
+	b.b = b.b[2:]
+	return v
+}
+
+func (b *pgReadBuf) int32() int32 {
+	v := int32(binary.BigEndian.Uint32(b.b))
+	b.b = b.b[4:]
+	return v
+}
+
+func (b *pgReadBuf) next(n int) []byte {
+	v := b.b[:n]
+	b.b = b.b[n:]
+	return v
+}
+
+func (b *pgReadBuf) string() string {
+	i := 0
+	for i < len(b.b) && b.b[i] != 0 {
+		i++
+	}
+
+	v := string(b.b[:i])
+	if i < len(b.b) {
+		i++
+	}
+	b.b = b.b[i:]
+	return v
+}
+
+type pgWriteBuf []byte
+
+func (w *pgWriteBuf) int16(v int) {
+	*w = binary.BigEndian.AppendUint16(*w, uint16(v))
+}
+
+func (w *pgWriteBuf) int32(v int32) {
+	*w = binary.BigEndian.AppendUint32(*w, uint32(v))
+}
+
+func (w *pgWriteBuf) string(v string) {
+	*w = append(*w, v...)
+	*w = append(*w, 0)
+}
@@ -0,0 +1,166 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	//information_schema.columns.data_type中的类型名
+	for name, ct := range map[string]ColumnType{
+		"integer":          ColumnTypeInt,
+		"real":             ColumnTypeFloat,
+		"double precision": ColumnTypeFloat,
+		"numeric":          ColumnTypeFloat,
+	} {
+		ColumnNumberTypes[name] = ct
+	}
+
+	for name, ct := range map[string]ColumnType{
+		"timestamp without time zone": ColumnTypeTime,
+		"timestamp with time zone":    ColumnTypeString,
+		"time without time zone":      ColumnTypeString,
+		"time with time zone":         ColumnTypeString,
+	} {
+		ColumnTimeTypes[name] = ct
+	}
+}
+
+const pgLoadSchemaSql = `SELECT c.column_name, c.data_type, c.column_default, k.column_name IS NOT NULL, c.is_nullable = 'YES'
+FROM information_schema.columns c
+LEFT JOIN (
+	SELECT kcu.column_name FROM information_schema.table_constraints tc
+	JOIN information_schema.key_column_usage kcu
+	ON tc.constraint_name = kcu.constraint_name AND tc.table_schema = kcu.table_schema AND tc.table_name = kcu.table_name
+	WHERE tc.constraint_type = 'PRIMARY KEY' AND tc.table_schema = current_schema() AND tc.table_name = $1
+) k ON c.column_name = k.column_name
+WHERE c.table_schema = current_schema() AND c.table_name = $1
+ORDER BY c.ordinal_position`
+
+type Postgres struct {
+	sqlDriver
+}
+
+type pgDialect struct{}
+
+func NewPostgres(url string) *Postgres {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil
+	}
+
+	return &Postgres{
+		sqlDriver: newSqlDriver(db, pgDialect{}),
+	}
+}
+
+func (db *Postgres) LoadTableSchema(tableName string) (*TableSchema, error) {
+	return db.LoadTableSchemaContext(context.Background(), tableName)
+}
+
+func (db *Postgres) LoadTableSchemaContext(ctx context.Context, tableName string) (*TableSchema, error) {
+	rows, err := db.db.QueryContext(ctx, pgLoadSchemaSql, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	descs := make([]columnDesc, 0, 32)
+	for rows.Next() {
+		var name, typeName, defaultDesc sql.NullString
+		var isPrimaryKey, nullable bool
+		err := rows.Scan(&name, &typeName, &defaultDesc, &isPrimaryKey, &nullable)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+
+		descs = append(descs, columnDesc{
+			name:         name.String,
+			typeName:     typeName.String,
+			isPrimaryKey: isPrimaryKey,
+			defaultValue: parseDefaultLiteral(defaultDesc.String),
+			defaultNull:  nullable && !defaultDesc.Valid,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "rows")
+	}
+
+	if len(descs) == 0 {
+		return nil, errors.Errorf("table: %s not found", tableName)
+	}
+
+	return newTableSchema(tableName, descs)
+}
+
+// rebind 把`替换为"，把?替换为$n，字符串中的内容保持不变；
+// ??输出一个?，用于jsonb的?、?|、?&运算符(写作??、??|、??&)
+func (pgDialect) rebind(query string) string {
+	n := len(query)
+	var builder strings.Builder
+	builder.Grow(n + 16)
+
+	nParam := 0
+	inQuote := false
+	for i := 0; i < n; i++ {
+		c := query[i]
+		if inQuote {
+			if c == '\'' {
+				inQuote = false
+			}
+			builder.WriteByte(c)
+			continue
+		}
+
+		switch c {
+		case '\'':
+			inQuote = true
+			builder.WriteByte(c)
+
+		case '`':
+			builder.WriteByte('"')
+
+		case '?':
+			if i+1 < n && query[i+1] == '?' {
+				builder.WriteByte('?')
+				i++
+				continue
+			}
+
+			nParam++
+			builder.WriteByte('$')
+			builder.WriteString(strconv.Itoa(nParam))
+
+		default:
+			builder.WriteByte(c)
+		}
+	}
+
+	return builder.String()
+}
+
+func (pgDialect) sqlError(err error) (string, bool) {
+	pgErr, ok := err.(*pq.Error)
+	if !ok {
+		return "", false
+	}
+
+	return pgErr.Message, true
+}
+
+func (pgDialect) writeUpsert(builder *strings.Builder, schema *TableSchema, fields []string) {
+	writeOnConflictUpsert(builder, schema, fields)
+}
+
+func (pgDialect) valuesDefault() bool {
+	return true
+}
+
+func (pgDialect) rawScan() bool {
+	return false
+}
@@ -1,7 +1,11 @@
 package sql
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"time"
 )
 
 type DBCommand uint8
@@ -16,19 +20,44 @@ const (
 	CmdMultiStart
 	CmdSelectMulti
 	CmdDeleteMulti
+	// CmdCountMulti 聚合查询，Data为*AggregateQuery，nil为COUNT(*)
 	CmdCountMulti
+	// CmdUpsert 行不存在时插入，存在时更新Data中的非主键列，Data与Insert相同
+	CmdUpsert
 )
 
 type mergeReqDataFunc func(prev *DBRequest, curr *DBRequest) bool
 
 var mergeRedDataFuncList []mergeReqDataFunc
 
+// mergeCrossFuncMap 不同命令的请求的合并，key为[合并后实际执行的命令, 后加入的请求的命令]
+var mergeCrossFuncMap map[[2]DBCommand]mergeReqDataFunc
+
+// ErrTimeout 请求在Deadline或Processor的超时时间内没有执行完成，DBReply.Err中返回包装了它的错误，不会重试；
+// 写请求超时时无法确定是否已经生效
+var ErrTimeout = errors.New("db request timeout")
+
+// ErrPanic 执行请求时发生panic，DBReply.Err中返回包装了它的错误，不会重试
+var ErrPanic = errors.New("db request panic")
+
+// ErrVersionConflict 有版本列的表中，行存在但版本与请求中的不一致，不会重试；
+// 调用者需要重新读取行之后再修改
+var ErrVersionConflict = errors.New("row version conflict")
+
 type Processor struct {
-	driver       Driver
+	driver    Driver
+	batchSize int
+	timeout   time.Duration
+	retry     RetryPolicy
+	//执行请求的ctx的parent，Stop时用于取消正在执行的请求
+	ctx          context.Context
 	nReq         int32
 	nMerged      int32
 	reqDummyHead *DBRequest
 	reqTail      *DBRequest
+	//等待重试的请求，按park的顺序排列
+	parked  []*parkedRequest
+	blocked map[*RowContext]*parkedRequest
 }
 
 type DBRequest struct {
@@ -42,12 +71,22 @@ type DBRequest struct {
 	Keys       []string
 	Data       interface{}
 	RowContext *RowContext
-	Custom     interface{}
-	Reply      *DBReply
+	TxGroup    *TxGroup
+	// Deadline 请求必须在此之前执行完成，零值表示不限制
+	Deadline time.Time
+	Custom   interface{}
+	Reply    *DBReply
+	// Replayed 由DBAccessor.ReplayWAL从WAL恢复的请求，Custom为nil
+	Replayed bool
 
 	next    *DBRequest
 	merged  *dbMergedRequest
 	brother *DBRequest
+	//失败的次数和下一次重试的时间，只在设置了RetryPolicy时使用
+	attempts int
+	retryAt  time.Time
+	//WAL中的序号，0表示没有记录或者已经完成
+	lsn uint64
 }
 
 func (req *DBRequest) Reset() {
@@ -66,6 +105,47 @@ func (req *DBRequest) Reset() {
 	req.merged = nil
 	req.brother = nil
 	req.RowContext = nil
+	req.TxGroup = nil
+	req.Deadline = time.Time{}
+	req.attempts = 0
+	req.retryAt = time.Time{}
+	req.Replayed = false
+	req.lsn = 0
+}
+
+// TxGroup 在同一个事务中执行的一组请求，可以跨表；
+// 组内请求必须连续地加入Processor，任一请求失败时整个事务回滚，所有成员得到同一个失败结果
+type TxGroup struct {
+	Num int
+	// MustAffect 写请求影响行数为0时也视为失败，如带Where的IncrBy未满足条件
+	MustAffect bool
+
+	nAppended int
+	//成员没有到齐时的失败结果，由DBAccessor设置
+	failed *DBReply
+}
+
+func NewTxGroup(num int, mustAffect bool) *TxGroup {
+	return &TxGroup{Num: num, MustAffect: mustAffect}
+}
+
+// Complete 组内请求是否已全部加入Processor
+func (tg *TxGroup) Complete() bool {
+	return tg.nAppended >= tg.Num
+}
+
+// isFollower 请求已被合并到前面的请求中，结果由leader执行后分发
+func (req *DBRequest) isFollower() bool {
+	return req.merged != nil && req.merged.leader != req
+}
+
+// command 合并后实际执行的命令
+func (req *DBRequest) command() DBCommand {
+	if req.merged != nil {
+		return req.merged.cmd
+	}
+
+	return req.Command
 }
 
 type DBReply struct {
@@ -75,7 +155,11 @@ type DBReply struct {
 }
 
 type dbMergedRequest struct {
-	data interface{}
+	data   interface{}
+	leader *DBRequest
+	//实际执行的命令，不同命令合并后可能与leader的命令不同；Insert和DeleteSingle抵消后为CmdNone，不再合并
+	cmd      DBCommand
+	canceled bool
 	//next *dbMergedRequest
 }
 
@@ -92,9 +176,26 @@ func init() {
 		CmdIncrBySingle: mergeIncrBySingle,
 		CmdSelectSingle: mergeDefault,
 		CmdMultiStart:   mergeDefault,
-		CmdSelectMulti:  mergeDefault,
+		CmdSelectMulti:  mergeSameQuery,
 		CmdDeleteMulti:  mergeDefault,
-		CmdCountMulti:   mergeDefault,
+		CmdCountMulti:   mergeSameQuery,
+		CmdUpsert:       mergeUpdateSingle,
+	}
+
+	mergeCrossFuncMap = map[[2]DBCommand]mergeReqDataFunc{
+		{CmdInsert, CmdUpdateSingle}:       mergeUpdateSingle,
+		{CmdInsert, CmdDeleteSingle}:       mergeCancelInsert,
+		{CmdUpsert, CmdUpdateSingle}:       mergeUpdateSingle,
+		{CmdUpdateSingle, CmdDeleteSingle}: mergeCollapseDelete,
+		{CmdIncrBySingle, CmdDeleteSingle}: mergeCollapseDelete,
+	}
+}
+
+func NewProcessor(driver Driver) *Processor {
+	return &Processor{
+		driver:       driver,
+		reqDummyHead: &DBRequest{},
+		blocked:      make(map[*RowContext]*parkedRequest),
 	}
 }
 
@@ -106,6 +207,16 @@ func (rc *RowContext) Reset() {
 	rc.lastReq = nil
 }
 
+// SetBatchSize 设置Execute一次最多合并执行的请求数，小于2时不做批量执行
+func (p *Processor) SetBatchSize(n int) {
+	p.batchSize = n
+}
+
+// SetTimeout 设置每次调用Driver的超时时间，0表示不限制；与请求的Deadline同时存在时取较早的一个
+func (p *Processor) SetTimeout(d time.Duration) {
+	p.timeout = d
+}
+
 func (p *Processor) PendingReqNum() int32 {
 	return p.nMerged
 }
@@ -114,6 +225,36 @@ func (p *Processor) Empty() bool {
 	return p.nReq == 0
 }
 
+// TakePending 取出所有还没有从Execute返回的请求，Processor恢复为空；等待重试的请求在前，其余按队列顺序。
+// Reply为nil的请求没有执行(或执行失败等待重试)，不为nil的已经执行完成
+func (p *Processor) TakePending() []*DBRequest {
+	ret := make([]*DBRequest, 0, p.nReq)
+	for _, pr := range p.parked {
+		ret = append(ret, pr.reqs...)
+	}
+
+	for req := p.reqDummyHead.next; req != nil; req = req.next {
+		ret = append(ret, req)
+	}
+
+	for _, req := range ret {
+		req.next = nil
+		req.merged = nil
+		req.brother = nil
+		if rc := req.RowContext; rc != nil && rc.lastReq == req {
+			rc.lastReq = nil
+		}
+	}
+
+	p.reqDummyHead.next = nil
+	p.reqTail = nil
+	p.parked = nil
+	p.blocked = make(map[*RowContext]*parkedRequest)
+	p.nReq = 0
+	p.nMerged = 0
+	return ret
+}
+
 func (p *Processor) Driver() Driver {
 	return p.driver
 }
@@ -143,6 +284,10 @@ func (p *Processor) AppendRequest(req *DBRequest) int32 {
 		reqCtx.lastReq = req
 	}
 
+	if req.TxGroup != nil {
+		req.TxGroup.nAppended++
+	}
+
 	p.nReq++
 	p.mergeRequest(prev, req)
 
@@ -153,146 +298,544 @@ func (p *Processor) Execute() *DBRequest {
 	head := p.reqDummyHead
 	driver := p.driver
 
-	curr := head.next
-	if curr == nil {
-		return nil
+	if len(p.parked) > 0 {
+		p.unpark(time.Now())
 	}
 
-	if curr.Reply == nil {
-		data := curr.Data
-		if curr.merged != nil {
-			data = curr.merged.data
+	var curr *DBRequest
+	for {
+		curr = head.next
+		if curr == nil {
+			return nil
 		}
 
-		schema := curr.Schema
-		shard := curr.Keys[curr.ShardId]
-		var reply *DBReply
-		switch curr.Command {
-		case CmdSelectSingle:
-			curr.Reply = driver.SelectSingle(schema, shard, curr.Keys)
-			if curr.Reply.Err == nil {
-				reply = curr.Reply
-			}
+		if curr.Reply != nil {
+			break
+		}
 
-		case CmdSelectMulti, CmdCountMulti:
-			curr.Reply = driver.SelectMulti(schema, shard)
-			if curr.Reply.Err == nil {
-				reply = curr.Reply
-			}
+		//等待重试或者被同一行前面的请求阻塞，移出队列让后面的请求继续执行
+		if p.park(curr) {
+			continue
+		}
 
-		case CmdIncrBySingle:
-			curr.Reply = driver.IncrBySingle(schema, shard, curr.Keys, data.(*IncrByData))
-			if curr.Reply.Err == nil {
-				reply = curr.Reply
-			}
+		var done bool
+		if curr.TxGroup != nil {
+			done = p.executeTx(curr)
 
-		case CmdUpdateSingle:
-			curr.Reply = driver.UpdateSingle(schema, shard, curr.Keys, data.([]string))
-			if curr.Reply.Err == nil {
-				reply = curr.Reply
-			}
+		} else {
+			if batch := p.collectBatch(curr); batch != nil {
+				p.executeBatch(batch)
 
-		case CmdInsert:
-			curr.Reply = driver.Insert(schema, shard, data.([]string))
-			if curr.Reply.Err == nil {
-				reply = &DBReply{Data: int64(0), Msg: "duplicate key"}
+			} else {
+				ctx, cancel := p.requestContext(curr)
+				p.execute(ctx, driver, curr)
+				cancel()
 			}
 
-		case CmdDeleteSingle:
-			curr.Reply = driver.DeleteSingle(schema, shard, curr.Keys)
-			if curr.Reply.Err == nil {
-				reply = &DBReply{Data: int64(0)}
+			done = p.settle(curr)
+		}
+
+		if done {
+			break
+		}
+
+		//没有RetryPolicy时停留在队首，下一次Execute立即重试
+		if curr.retryAt.IsZero() {
+			return nil
+		}
+	}
+
+	head.next = curr.next
+	if head.next == nil {
+		p.reqTail = nil
+	}
+
+	curr.next = nil
+	curr.merged = nil
+	curr.brother = nil
+
+	p.nReq--
+	return curr
+}
+
+// requestContext 返回执行reqs使用的ctx，deadline取reqs及其合并的请求中最早的一个；
+// 只有TxGroup的成员Deadline可能不同，合并和batch的请求Deadline相同
+func (p *Processor) requestContext(reqs ...*DBRequest) (context.Context, context.CancelFunc) {
+	var deadline time.Time
+	if p.timeout > 0 {
+		deadline = time.Now().Add(p.timeout)
+	}
+
+	for _, req := range reqs {
+		for r := req; r != nil; r = r.brother {
+			if !r.Deadline.IsZero() && (deadline.IsZero() || r.Deadline.Before(deadline)) {
+				deadline = r.Deadline
 			}
+		}
+	}
+
+	if deadline.IsZero() {
+		return p.baseContext(), func() {}
+	}
+
+	return context.WithDeadline(p.baseContext(), deadline)
+}
+
+func (p *Processor) baseContext() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+
+	return p.ctx
+}
+
+// panicReply 把recover得到的值转换为失败结果
+func panicReply(r interface{}) *DBReply {
+	return &DBReply{Data: int64(0), Err: fmt.Errorf("%w: %v", ErrPanic, r)}
+}
+
+// isFinalErr 超时和panic不会重试
+func isFinalErr(err error) bool {
+	return errors.Is(err, ErrTimeout) || errors.Is(err, ErrPanic) || errors.Is(err, ErrVersionConflict)
+}
+
+// timeoutReply ctx超时导致的失败替换为ErrTimeout
+func timeoutReply(ctx context.Context, reply *DBReply) *DBReply {
+	if reply == nil || reply.Err == nil || errors.Is(reply.Err, ErrTimeout) {
+		return reply
+	}
+
+	if errors.Is(reply.Err, context.DeadlineExceeded) || errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+		return &DBReply{
+			Data: reply.Data,
+			Err:  fmt.Errorf("%w: %v", ErrTimeout, reply.Err),
+			Msg:  reply.Msg,
+		}
+	}
+
+	return reply
+}
+
+func (p *Processor) execute(ctx context.Context, driver Executor, curr *DBRequest) {
+	defer func() {
+		if r := recover(); r != nil {
+			curr.Reply = panicReply(r)
+		}
+	}()
+
+	data := curr.Data
+	if curr.merged != nil {
+		data = curr.merged.data
+	}
+
+	schema := curr.Schema
+	shard := curr.Keys[curr.ShardId]
+	switch curr.command() {
+	case CmdSelectSingle:
+		curr.Reply = driver.SelectSingleContext(ctx, schema, shard, curr.Keys)
+
+	case CmdSelectMulti:
+		query, _ := data.(*SelectQuery)
+		curr.Reply = driver.SelectMultiContext(ctx, schema, shard, query)
+
+	case CmdCountMulti:
+		query, _ := data.(*AggregateQuery)
+		curr.Reply = driver.AggregateMultiContext(ctx, schema, shard, query)
+
+	case CmdIncrBySingle:
+		curr.Reply = driver.IncrBySingleContext(ctx, schema, shard, curr.Keys, data.(*IncrByData))
+
+	case CmdUpdateSingle:
+		curr.Reply = driver.UpdateSingleContext(ctx, schema, shard, curr.Keys, data.([]string))
+
+	case CmdInsert:
+		curr.Reply = driver.InsertContext(ctx, schema, shard, data.([]string))
 
-		case CmdDeleteMulti:
-			curr.Reply = driver.DeleteMulti(schema, shard, data.(*MultiRequestData))
-			if curr.Reply.Err == nil {
-				reply = curr.Reply
+	case CmdUpsert:
+		curr.Reply = driver.UpsertContext(ctx, schema, shard, data.([]string))
+
+	case CmdDeleteSingle:
+		curr.Reply = driver.DeleteSingleContext(ctx, schema, shard, curr.Keys)
+
+	case CmdDeleteMulti:
+		curr.Reply = driver.DeleteMultiContext(ctx, schema, shard, data.(*MultiRequestData))
+
+	case CmdNone:
+		curr.Reply = &DBReply{}
+
+	default:
+		curr.Reply = &DBReply{Err: fmt.Errorf("nonsupport cmd: %d", curr.command())}
+	}
+
+	curr.Reply = timeoutReply(ctx, curr.Reply)
+}
+
+// settle 根据curr.Reply决定请求是否完成，并把结果分发给合并的请求；返回false表示需要重试
+func (p *Processor) settle(curr *DBRequest) bool {
+	dead := false
+	var reply *DBReply
+	if curr.Reply.Err != nil {
+		//前置请求失败，后续请求同时失败
+		if curr.PreReq && curr.next != nil {
+			reply = curr.Reply
+			curr.next.Reply = reply
+
+			p.nMerged--
+			req := curr.next.brother
+			for req != nil {
+				req.Reply = reply
+				req.merged = nil
+
+				tmp := req.brother
+				req.brother = nil
+				req = tmp
 			}
+		}
 
-		case CmdNone:
-			curr.Reply = &DBReply{}
+		if curr.Sync || curr.PreReq || isFinalErr(curr.Reply.Err) {
 			reply = curr.Reply
 
-		default:
-			curr.Reply = &DBReply{Err: fmt.Errorf("nonsupport cmd: %d", curr.Command)}
+		} else if p.retryLater(curr) {
+			curr.Reply = nil
+			return false
+
+		} else {
+			//超过重试次数，合并的请求一起放弃
+			reply = curr.Reply
+			dead = true
+			p.deadLetter(curr)
 		}
+	}
+
+	p.nMerged--
+	var fanOut *replyFanOut
+	if reply == nil {
+		fanOut = &replyFanOut{cmd: curr.command(), reply: curr.Reply}
+		curr.Reply = fanOut.replyOf(curr)
+	}
+
+	req := curr.brother
+	for req != nil {
+		if fanOut != nil {
+			req.Reply = fanOut.replyOf(req)
 
-		if reply == nil {
-			//前置请求失败，后续请求同时失败
-			if curr.PreReq && curr.next != nil {
-				reply = curr.Reply
-				curr.next.Reply = reply
+		} else {
+			req.Reply = reply
+		}
+		req.merged = nil
+		if dead {
+			p.deadLetter(req)
+		}
 
-				p.nMerged--
-				req := curr.next.brother
-				for req != nil {
-					req.Reply = reply
-					req.merged = nil
+		tmp := req.brother
+		req.brother = nil
+		req = tmp
+	}
 
-					tmp := req.brother
-					req.brother = nil
-					req = tmp
-				}
-			}
+	return true
+}
 
-			if curr.Sync || curr.PreReq {
-				reply = curr.Reply
+// collectBatch 从curr开始收集连续的、同表同命令的请求，已被合并的请求由其leader代表
+func (p *Processor) collectBatch(curr *DBRequest) []*DBRequest {
+	if p.batchSize < 2 || curr.PreReq {
+		return nil
+	}
 
-			} else {
-				//重试
-				curr.Reply = nil
-				return nil
+	cmd := curr.command()
+	switch cmd {
+	case CmdInsert:
+	case CmdUpdateSingle:
+		if versionedWrite(curr) {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	var batch []*DBRequest
+	n := 1
+	for req := curr.next; req != nil && n < p.batchSize; req = req.next {
+		if req.Reply != nil || req.isFollower() {
+			continue
+		}
+
+		//batch在同一个ctx中执行，Deadline不同时不合并，避免其他请求因为较早的Deadline失败
+		if req.command() != cmd || req.Schema != curr.Schema || req.PreReq || req.TxGroup != nil ||
+			!req.Deadline.Equal(curr.Deadline) || !req.retryAt.IsZero() || p.isBlocked(req) {
+			break
+		}
+
+		if batch == nil {
+			batch = make([]*DBRequest, 0, 16)
+			batch = append(batch, curr)
+		}
+
+		batch = append(batch, req)
+		n++
+	}
+
+	return batch
+}
+
+func (p *Processor) executeBatch(batch []*DBRequest) {
+	p.runBatch(batch)
+
+	//batch[0]是队首，由Execute处理
+	for _, req := range batch[1:] {
+		p.settle(req)
+	}
+}
+
+// runBatch panic时batch中的请求都得到同一个失败结果
+func (p *Processor) runBatch(batch []*DBRequest) {
+	defer func() {
+		if r := recover(); r != nil {
+			reply := panicReply(r)
+			for _, req := range batch {
+				req.Reply = reply
 			}
 		}
+	}()
+
+	items := make([]BatchItem, len(batch))
+	for i, req := range batch {
+		data := req.Data
+		if req.merged != nil {
+			data = req.merged.data
+		}
 
+		items[i].Shard = req.Keys[req.ShardId]
+		items[i].Keys = req.Keys
+		items[i].Fields = data.([]string)
+	}
+
+	curr := batch[0]
+	ctx, cancel := p.requestContext(batch...)
+	defer cancel()
+
+	replies := p.driver.BatchContext(ctx, curr.Schema, curr.command(), items)
+	for i, req := range batch {
+		req.Reply = timeoutReply(ctx, replies[i])
+	}
+}
+
+// executeTx 在一个事务中执行curr所在TxGroup的全部请求，返回false表示还不能出队(成员未到齐或需要重试)
+func (p *Processor) executeTx(curr *DBRequest) bool {
+	group := curr.TxGroup
+	if group.failed != nil {
+		//成员没有到齐，已经加入和之后加入的成员到达队首时逐个失败
+		curr.Reply = group.failed
 		p.nMerged--
-		req := curr.brother
-		for req != nil {
-			req.Reply = reply
-			req.merged = nil
+		return true
+	}
 
-			tmp := req.brother
-			req.brother = nil
-			req = tmp
+	members := make([]*DBRequest, 0, group.Num)
+	for req := curr; req != nil && len(members) < group.Num; req = req.next {
+		if req.TxGroup != group {
+			break
 		}
+
+		members = append(members, req)
 	}
 
-	head.next = curr.next
-	if head.next == nil {
-		p.reqTail = nil
+	if len(members) < group.Num {
+		return false
 	}
 
-	curr.next = nil
-	curr.merged = nil
-	curr.brother = nil
+	var failed *DBReply
+	ctx, cancel := p.requestContext(members...)
+	defer cancel()
 
-	p.nReq--
-	return curr
+	tx, err := p.driver.BeginContext(ctx)
+	if err != nil {
+		failed = timeoutReply(ctx, &DBReply{Err: err})
+
+	} else {
+		for i, req := range members {
+			p.execute(ctx, tx, req)
+			if msg := txFailedMsg(group, req); msg != "" {
+				failed = &DBReply{
+					Data: int64(0),
+					Err:  req.Reply.Err,
+					Msg:  fmt.Sprintf("transaction rollback at request %d: %s", i, msg),
+				}
+				break
+			}
+		}
+
+		if failed == nil {
+			if err := tx.Commit(); err != nil {
+				failed = timeoutReply(ctx, &DBReply{Err: err})
+			}
+
+		} else {
+			_ = tx.Rollback()
+		}
+	}
+
+	if failed != nil {
+		dead := false
+		if failed.Err != nil && !curr.Sync && !isFinalErr(failed.Err) {
+			if p.retryLater(curr) {
+				//重试整个事务
+				for _, req := range members {
+					req.Reply = nil
+				}
+				return false
+			}
+
+			dead = true
+		}
+
+		for _, req := range members {
+			req.Reply = failed
+			if dead {
+				p.deadLetter(req)
+			}
+		}
+	}
+
+	//事务中的请求不参与合并，没有brother
+	p.nMerged -= int32(len(members))
+	return true
 }
 
+// versionedWrite 有版本列的表中修改行的请求，每个请求都带有自己读到的版本，不能合并或批量执行
+func versionedWrite(req *DBRequest) bool {
+	if req.Schema == nil || !req.Schema.versioned() {
+		return false
+	}
+
+	switch req.Command {
+	case CmdUpdateSingle, CmdIncrBySingle, CmdDeleteSingle, CmdInsert, CmdUpsert:
+		return true
+	default:
+		return false
+	}
+}
+
+func txFailedMsg(group *TxGroup, req *DBRequest) string {
+	reply := req.Reply
+	if reply.Err != nil {
+		return reply.Err.Error()
+	}
+
+	if reply.Msg != "" {
+		return reply.Msg
+	}
+
+	if group.MustAffect {
+		switch req.Command {
+		case CmdInsert, CmdDeleteSingle, CmdUpdateSingle, CmdIncrBySingle, CmdDeleteMulti, CmdUpsert:
+			if n, ok := reply.Data.(int64); ok && n == 0 {
+				return "no row affected"
+			}
+		}
+	}
+
+	return ""
+}
+
+// mergeRequest 合并的请求在leader的ctx中执行，Deadline不同的请求不合并
 func (p *Processor) mergeRequest(prev *DBRequest, req *DBRequest) {
-	if prev == nil || prev.Reply != nil || !req.CanMerge ||
-		prev.Command != req.Command || prev.Sync != req.Sync {
+	if prev == nil || prev.Reply != nil || !req.CanMerge || prev.TxGroup != nil || req.TxGroup != nil ||
+		prev.Sync != req.Sync || !prev.Deadline.Equal(req.Deadline) || versionedWrite(req) {
 
 		p.nMerged++
 		return
 	}
 
-	if prev.merged == nil {
-		prev.merged = &dbMergedRequest{}
+	//与前面的请求合并后实际执行的命令比较
+	cmd := prev.command()
+	merge := mergeRedDataFuncList[req.Command]
+	if cmd != req.Command {
+		merge = mergeCrossFuncMap[[2]DBCommand{cmd, req.Command}]
 	}
 
-	f := mergeRedDataFuncList[req.Command]
-	if !f(prev, req) {
+	if merge == nil || (prev.merged != nil && prev.merged.canceled) {
 		p.nMerged++
 		return
 	}
 
+	created := prev.merged == nil
+	if created {
+		prev.merged = &dbMergedRequest{leader: prev, cmd: prev.Command}
+	}
+
+	if !p.mergeData(merge, prev, req) {
+		if created {
+			prev.merged = nil
+		}
+
+		//panic的请求已经有结果，不计入待执行的请求
+		if req.Reply == nil {
+			p.nMerged++
+		}
+		return
+	}
+
 	req.merged = prev.merged
 	prev.brother = req
 }
 
+// mergeData 合并函数panic时(如Data的类型不对)不合并，req直接得到失败结果
+func (p *Processor) mergeData(merge mergeReqDataFunc, prev *DBRequest, req *DBRequest) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			req.Reply = panicReply(r)
+			ok = false
+		}
+	}()
+
+	return merge(prev, req)
+}
+
+// replyFanOut 把合并执行成功的结果按每个请求自己的命令分发
+type replyFanOut struct {
+	cmd   DBCommand
+	reply *DBReply
+	//已经得到结果的命令
+	seen uint32
+}
+
+func (fo *replyFanOut) replyOf(req *DBRequest) *DBReply {
+	first := fo.seen&(1<<req.Command) == 0
+	fo.seen |= 1 << req.Command
+
+	reply := fo.reply
+	if fo.cmd == CmdNone && req.Command != CmdNone {
+		//Insert和DeleteSingle抵消，每个请求按单独执行成功返回
+		reply = &DBReply{Data: int64(1)}
+
+	} else if req.Command != fo.cmd {
+		//合并到Insert或Upsert的Update，合并到DeleteSingle的Update/IncrBy：行存在时执行成功
+		if reply.Msg != "" {
+			return &DBReply{Data: int64(0), Msg: reply.Msg}
+		}
+
+		if fo.cmd == CmdInsert || fo.cmd == CmdUpsert {
+			return &DBReply{Data: int64(1)}
+		}
+		return &DBReply{Data: reply.Data}
+	}
+
+	if first {
+		return reply
+	}
+
+	//同一命令后面的请求
+	switch req.Command {
+	case CmdInsert:
+		return &DBReply{Data: int64(0), Msg: "duplicate key"}
+
+	case CmdDeleteSingle:
+		return &DBReply{Data: int64(0)}
+
+	default:
+		return reply
+	}
+}
+
 func mergeDefault(prev *DBRequest, curr *DBRequest) bool {
 	if prev.merged.data == nil {
 		prev.merged.data = prev.Data
@@ -302,6 +845,15 @@ func mergeDefault(prev *DBRequest, curr *DBRequest) bool {
 	return true
 }
 
+// mergeSameQuery 只合并条件相同的SelectMulti和CountMulti
+func mergeSameQuery(prev *DBRequest, curr *DBRequest) bool {
+	if !reflect.DeepEqual(prev.Data, curr.Data) {
+		return false
+	}
+
+	return mergeDefault(prev, curr)
+}
+
 func mergeUpdateSingle(prev *DBRequest, curr *DBRequest) bool {
 	prevMerged := prev.merged
 	if prevMerged.data == nil {
@@ -341,23 +893,56 @@ func mergeUpdateSingle(prev *DBRequest, curr *DBRequest) bool {
 	return true
 }
 
-func mergeIncrBySingle(prev *DBRequest, curr *DBRequest) bool {
+// mergeCollapseDelete Update/IncrBy之后的DeleteSingle，只执行DeleteSingle；带Where或Guards的IncrBy不合并
+func mergeCollapseDelete(prev *DBRequest, curr *DBRequest) bool {
 	prevMerged := prev.merged
-	if prevMerged.data == nil {
-		prevData := prev.Data.(*IncrByData)
-		prevMerged.data = &IncrByData{
-			Column: prevData.Column,
-			Delta:  prevData.Delta,
-			Where:  prevData.Where,
+	if prevMerged.cmd == CmdIncrBySingle {
+		data, _ := prevMerged.data.(*IncrByData)
+		if data == nil {
+			data = prev.Data.(*IncrByData)
+		}
+
+		if data.Where != "" || len(data.Guards) > 0 {
+			return false
 		}
 	}
 
+	prevMerged.cmd = CmdDeleteSingle
+	prevMerged.data = curr.Data
+	curr.Processed = true
+	return true
+}
+
+// mergeCancelInsert Insert之后的DeleteSingle，两者抵消，都不执行；
+// Insert只在缓存确认行不存在时发出，抵消后行仍然不存在
+func mergeCancelInsert(prev *DBRequest, curr *DBRequest) bool {
+	prevMerged := prev.merged
+	prevMerged.cmd = CmdNone
+	prevMerged.canceled = true
+	prevMerged.data = nil
+	curr.Processed = true
+	return true
+}
+
+// mergeIncrBySingle 各列的增量累加。带Where或者Guards的请求不合并：Guards按每个请求自己执行之后的值检查，
+// 合并后只能全部生效或者全部不生效，而每个请求需要各自的结果
+func mergeIncrBySingle(prev *DBRequest, curr *DBRequest) bool {
 	currData := curr.Data.(*IncrByData)
-	prevData := prevMerged.data.(*IncrByData)
-	if prevData.Column != currData.Column || currData.Where != "" || prevData.Where != "" {
+	if currData.Where != "" || len(currData.Guards) > 0 {
 		return false
 	}
 
-	prevData.Delta += currData.Delta
+	prevMerged := prev.merged
+	if prevMerged.data == nil {
+		prevData := prev.Data.(*IncrByData)
+		if prevData.Where != "" || len(prevData.Guards) > 0 {
+			return false
+		}
+
+		prevMerged.data = &IncrByData{Deltas: append([]ColumnDelta(nil), prevData.ColumnDeltas()...)}
+	}
+
+	mergedData := prevMerged.data.(*IncrByData)
+	mergedData.Deltas = addColumnDeltas(mergedData.Deltas, currData.ColumnDeltas())
 	return true
 }
@@ -0,0 +1,590 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type batchCountDriver struct {
+	*DBStub
+	nBatch int
+}
+
+func (db *batchCountDriver) BatchContext(ctx context.Context, schema *TableSchema, cmd DBCommand, items []BatchItem) []*DBReply {
+	db.nBatch++
+	return db.DBStub.BatchContext(ctx, schema, cmd, items)
+}
+
+// stuckDriver 模拟卡住的连接，Insert直到ctx结束才返回
+type stuckDriver struct {
+	*DBStub
+	nInsert int
+}
+
+func (db *stuckDriver) InsertContext(ctx context.Context, _ *TableSchema, _ string, _ []string) *DBReply {
+	db.nInsert++
+	<-ctx.Done()
+	return &DBReply{Data: int64(0), Err: ctx.Err()}
+}
+
+// flakyDriver Insert的id在fails中时返回连接错误，次数用完后恢复正常，-1表示一直失败
+type flakyDriver struct {
+	*DBStub
+	fails map[string]int
+}
+
+func (db *flakyDriver) InsertContext(ctx context.Context, schema *TableSchema, shard string, fields []string) *DBReply {
+	id := fields[3]
+	if n := db.fails[id]; n != 0 {
+		db.fails[id] = n - 1
+		return &DBReply{Data: int64(0), Err: errors.New("connection refused")}
+	}
+
+	return db.DBStub.InsertContext(ctx, schema, shard, fields)
+}
+
+// panicDriver SelectSingle时panic
+type panicDriver struct {
+	*DBStub
+}
+
+func (db *panicDriver) SelectSingleContext(_ context.Context, _ *TableSchema, _ string, _ []string) *DBReply {
+	panic("select single")
+}
+
+func newTestSchema() *TableSchema {
+	return CreateFakeTableSchema([]FakeColumn{
+		{Name: "uid", Type: ColumnTypeInt},
+		{Name: "id", Type: ColumnTypeInt},
+		{Name: "name", Type: ColumnTypeString},
+		{Name: "gold", Type: ColumnTypeInt},
+	}, 2)
+}
+
+func newTestRequest(schema *TableSchema, cmd DBCommand, rc *RowContext, keys []string, data interface{}) *DBRequest {
+	return &DBRequest{
+		Command:    cmd,
+		CanMerge:   true,
+		Schema:     schema,
+		Keys:       keys,
+		Data:       data,
+		RowContext: rc,
+	}
+}
+
+func drainProcessor(p *Processor) []*DBRequest {
+	ret := make([]*DBRequest, 0)
+	for req := p.Execute(); req != nil; req = p.Execute() {
+		ret = append(ret, req)
+	}
+
+	return ret
+}
+
+func TestProcessor_Batch(t *testing.T) {
+	schema := newTestSchema()
+	driver := &batchCountDriver{DBStub: NewDBStub()}
+	p := NewProcessor(driver)
+	p.SetBatchSize(16)
+
+	rc1, rc2 := NewRowContext(), NewRowContext()
+	p.AppendRequest(newTestRequest(schema, CmdInsert, rc1, []string{"1", "1"},
+		[]string{"uid", "1", "id", "1", "gold", "10"}))
+	p.AppendRequest(newTestRequest(schema, CmdInsert, rc2, []string{"1", "2"},
+		[]string{"uid", "1", "id", "2", "gold", "20"}))
+	//merged into the first insert
+	p.AppendRequest(newTestRequest(schema, CmdInsert, rc1, []string{"1", "1"},
+		[]string{"uid", "1", "id", "1", "gold", "10"}))
+	p.AppendRequest(newTestRequest(schema, CmdInsert, NewRowContext(), []string{"1", "2"},
+		[]string{"uid", "1", "id", "2", "gold", "30"}))
+	require.Equal(t, int32(3), p.PendingReqNum())
+
+	reqs := drainProcessor(p)
+	require.Equal(t, 1, driver.nBatch)
+	require.Len(t, reqs, 4)
+	require.Equal(t, int64(1), reqs[0].Reply.Data)
+	require.Equal(t, int64(1), reqs[1].Reply.Data)
+	require.Equal(t, "duplicate key", reqs[2].Reply.Msg)
+	require.Equal(t, "duplicate key", reqs[3].Reply.Msg)
+	require.True(t, p.Empty())
+	require.Equal(t, int32(0), p.PendingReqNum())
+
+	//a different command stops the batch
+	p.AppendRequest(newTestRequest(schema, CmdUpdateSingle, rc1, []string{"1", "1"}, []string{"gold", "11"}))
+	p.AppendRequest(newTestRequest(schema, CmdDeleteSingle, rc2, []string{"1", "2"}, nil))
+	p.AppendRequest(newTestRequest(schema, CmdUpdateSingle, NewRowContext(), []string{"1", "2"}, []string{"gold", "21"}))
+	reqs = drainProcessor(p)
+	require.Equal(t, 1, driver.nBatch)
+	require.Len(t, reqs, 3)
+	require.Equal(t, int64(1), reqs[0].Reply.Data)
+	require.Equal(t, int64(0), reqs[2].Reply.Data)
+}
+
+func TestProcessor_MergeCross(t *testing.T) {
+	schema := newTestSchema()
+	driver := NewDBStub()
+	p := NewProcessor(driver)
+	keys := []string{"1", "1"}
+
+	//insert + updates are executed as one insert
+	rc := NewRowContext()
+	p.AppendRequest(newTestRequest(schema, CmdInsert, rc, keys, []string{"uid", "1", "id", "1", "gold", "10"}))
+	p.AppendRequest(newTestRequest(schema, CmdUpdateSingle, rc, keys, []string{"gold", "11"}))
+	p.AppendRequest(newTestRequest(schema, CmdUpdateSingle, rc, keys, []string{"name", "a", "gold", "12"}))
+	require.Equal(t, int32(1), p.PendingReqNum())
+
+	reqs := drainProcessor(p)
+	require.Len(t, reqs, 3)
+	for _, req := range reqs {
+		require.Equal(t, int64(1), req.Reply.Data)
+		require.Empty(t, req.Reply.Msg)
+	}
+	data := driver.SelectSingle(schema, "1", keys).Data.([]byte)
+	require.Equal(t, "a", GetValueByIndex(schema, data, 2))
+	require.Equal(t, "12", GetValueByIndex(schema, data, 3))
+
+	//updates and incrBy followed by a delete collapse to the delete
+	rc = NewRowContext()
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, keys, &IncrByData{Column: "gold", Delta: 1}))
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, keys, &IncrByData{Column: "gold", Delta: 2}))
+	p.AppendRequest(newTestRequest(schema, CmdDeleteSingle, rc, keys, nil))
+	p.AppendRequest(newTestRequest(schema, CmdDeleteSingle, rc, keys, nil))
+	//not merged after the delete
+	p.AppendRequest(newTestRequest(schema, CmdUpdateSingle, rc, keys, []string{"gold", "1"}))
+	require.Equal(t, int32(2), p.PendingReqNum())
+
+	reqs = drainProcessor(p)
+	require.Len(t, reqs, 5)
+	for i, expected := range []int64{1, 1, 1, 0, 0} {
+		require.Equal(t, expected, reqs[i].Reply.Data, i)
+	}
+	require.Nil(t, driver.SelectSingle(schema, "1", keys).Data)
+
+	//incrBy with where is not collapsed
+	rc = NewRowContext()
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, keys, &IncrByData{Column: "gold", Delta: 1, Where: "gold>0"}))
+	p.AppendRequest(newTestRequest(schema, CmdDeleteSingle, rc, keys, nil))
+	require.Equal(t, int32(2), p.PendingReqNum())
+	drainProcessor(p)
+
+	//insert + delete cancel out, no more merging after that
+	rc = NewRowContext()
+	p.AppendRequest(newTestRequest(schema, CmdInsert, rc, keys, []string{"uid", "1", "id", "1"}))
+	p.AppendRequest(newTestRequest(schema, CmdInsert, rc, keys, []string{"uid", "1", "id", "1"}))
+	p.AppendRequest(newTestRequest(schema, CmdUpdateSingle, rc, keys, []string{"gold", "5"}))
+	p.AppendRequest(newTestRequest(schema, CmdDeleteSingle, rc, keys, nil))
+	p.AppendRequest(newTestRequest(schema, CmdDeleteSingle, rc, keys, nil))
+	require.Equal(t, int32(2), p.PendingReqNum())
+
+	reqs = drainProcessor(p)
+	require.Len(t, reqs, 5)
+	require.Equal(t, int64(1), reqs[0].Reply.Data)
+	require.Equal(t, "duplicate key", reqs[1].Reply.Msg)
+	require.Equal(t, int64(1), reqs[2].Reply.Data)
+	require.Equal(t, int64(1), reqs[3].Reply.Data)
+	require.Equal(t, int64(0), reqs[4].Reply.Data)
+	require.Nil(t, driver.SelectSingle(schema, "1", keys).Data)
+	require.True(t, p.Empty())
+}
+
+func TestProcessor_IncrByGuard(t *testing.T) {
+	schema := CreateFakeTableSchema([]FakeColumn{
+		{Name: "uid", Type: ColumnTypeInt},
+		{Name: "gold", Type: ColumnTypeInt},
+		{Name: "exp", Type: ColumnTypeInt},
+	}, 1)
+	driver := NewDBStub()
+	p := NewProcessor(driver)
+	keys := []string{"1"}
+	require.Equal(t, int64(1), driver.Insert(schema, "1", []string{"uid", "1", "gold", "10", "exp", "0"}).Data)
+
+	spend := func(gold int64) *IncrByData {
+		return &IncrByData{
+			Deltas: []ColumnDelta{{"gold", -gold}, {"exp", gold}},
+			Guards: []IncrByGuard{{Column: "gold", Op: ">=", Value: 0}},
+		}
+	}
+
+	//deltas on several columns are merged, guarded requests are not
+	rc := NewRowContext()
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, keys, &IncrByData{Column: "exp", Delta: 1}))
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, keys, &IncrByData{Deltas: []ColumnDelta{{"gold", 1}, {"exp", -1}}}))
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, keys, spend(3)))
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, keys, &IncrByData{Column: "gold", Delta: -1}))
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, keys, spend(4)))
+	require.Equal(t, int32(4), p.PendingReqNum())
+
+	reqs := drainProcessor(p)
+	for _, req := range reqs {
+		require.Equal(t, int64(1), req.Reply.Data)
+	}
+	data := driver.SelectSingle(schema, "1", keys).Data.([]byte)
+	require.Equal(t, "3", GetValueByIndex(schema, data, 1))
+	require.Equal(t, "7", GetValueByIndex(schema, data, 2))
+
+	//each guard is checked with the value of its own request and replied separately
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, keys, spend(4)))
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, keys, &IncrByData{Column: "exp", Delta: 5}))
+	require.Equal(t, int32(2), p.PendingReqNum())
+
+	reqs = drainProcessor(p)
+	require.Equal(t, int64(0), reqs[0].Reply.Data)
+	require.Equal(t, int64(1), reqs[1].Reply.Data)
+	data = driver.SelectSingle(schema, "1", keys).Data.([]byte)
+	require.Equal(t, "3", GetValueByIndex(schema, data, 1))
+	require.Equal(t, "12", GetValueByIndex(schema, data, 2))
+
+	//requests with where are not merged
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, keys, &IncrByData{Column: "gold", Delta: 1, Where: "gold>0"}))
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, keys, spend(1)))
+	require.Equal(t, int32(2), p.PendingReqNum())
+	drainProcessor(p)
+
+	tr := &TableRow{Data: driver.SelectSingle(schema, "1", keys).Data.([]byte)}
+	ok, msg := tr.IncrBy2(schema, spend(4))
+	require.False(t, ok, msg)
+	ok, msg = tr.IncrBy2(schema, spend(3))
+	require.True(t, ok, msg)
+	require.Equal(t, "0", GetValueByIndex(schema, tr.Data, 1))
+	require.Equal(t, "16", GetValueByIndex(schema, tr.Data, 2))
+}
+
+func TestProcessor_TxGroup(t *testing.T) {
+	schema1 := newTestSchema()
+	schema2 := CreateFakeTableSchema([]FakeColumn{
+		{Name: "uid", Type: ColumnTypeInt},
+		{Name: "item", Type: ColumnTypeInt},
+		{Name: "num", Type: ColumnTypeInt},
+	}, 2)
+	schema2.Name = "fake_item"
+
+	driver := NewDBStub()
+	p := NewProcessor(driver)
+	require.Equal(t, int64(1), driver.Insert(schema1, "1", []string{"uid", "1", "id", "1", "gold", "10"}).Data)
+
+	//gold is enough
+	group := NewTxGroup(2, true)
+	p.AppendRequest(&DBRequest{Command: CmdIncrBySingle, Schema: schema1, Keys: []string{"1", "1"},
+		Data: &IncrByData{Column: "gold", Delta: -8, Where: "gold>=8"}, RowContext: NewRowContext(), TxGroup: group})
+	p.AppendRequest(&DBRequest{Command: CmdInsert, Schema: schema2, Keys: []string{"1", "100"},
+		Data: []string{"uid", "1", "item", "100", "num", "1"}, RowContext: NewRowContext(), TxGroup: group})
+	require.True(t, group.Complete())
+
+	reqs := drainProcessor(p)
+	require.Len(t, reqs, 2)
+	require.Equal(t, int64(1), reqs[0].Reply.Data)
+	require.Equal(t, int64(1), reqs[1].Reply.Data)
+	require.Equal(t, "2", GetValueByIndex(schema1, driver.SelectSingle(schema1, "1", []string{"1", "1"}).Data.([]byte), 3))
+
+	//gold is not enough, the item must not be granted
+	group = NewTxGroup(2, true)
+	p.AppendRequest(&DBRequest{Command: CmdInsert, Schema: schema2, Keys: []string{"1", "101"},
+		Data: []string{"uid", "1", "item", "101", "num", "1"}, RowContext: NewRowContext(), TxGroup: group})
+	require.Nil(t, p.Execute())
+	p.AppendRequest(&DBRequest{Command: CmdIncrBySingle, Schema: schema1, Keys: []string{"1", "1"},
+		Data: &IncrByData{Column: "gold", Delta: -8, Where: "gold>=8"}, RowContext: NewRowContext(), TxGroup: group})
+
+	reqs = drainProcessor(p)
+	require.Len(t, reqs, 2)
+	require.Same(t, reqs[0].Reply, reqs[1].Reply)
+	require.NotEmpty(t, reqs[0].Reply.Msg)
+	require.Nil(t, driver.SelectSingle(schema2, "1", []string{"1", "101"}).Data)
+	require.Equal(t, int32(0), p.PendingReqNum())
+}
+
+func TestProcessor_Timeout(t *testing.T) {
+	schema := newTestSchema()
+	driver := &stuckDriver{DBStub: NewDBStub()}
+	p := NewProcessor(driver)
+	p.SetTimeout(20 * time.Millisecond)
+
+	rc := NewRowContext()
+	p.AppendRequest(newTestRequest(schema, CmdInsert, rc, []string{"1", "1"},
+		[]string{"uid", "1", "id", "1", "gold", "10"}))
+	p.AppendRequest(newTestRequest(schema, CmdInsert, rc, []string{"1", "1"},
+		[]string{"uid", "1", "id", "1", "gold", "10"}))
+
+	//超时不重试，合并的请求得到同样的结果
+	reqs := drainProcessor(p)
+	require.Len(t, reqs, 2)
+	require.Equal(t, 1, driver.nInsert)
+	require.True(t, errors.Is(reqs[0].Reply.Err, ErrTimeout))
+	require.Same(t, reqs[0].Reply, reqs[1].Reply)
+	require.Equal(t, int32(0), p.PendingReqNum())
+
+	//请求的Deadline早于Processor的超时时间
+	p.SetTimeout(time.Hour)
+	req := newTestRequest(schema, CmdUpdateSingle, NewRowContext(), []string{"1", "1"}, []string{"gold", "11"})
+	req.Deadline = time.Now().Add(-time.Second)
+	p.AppendRequest(req)
+	reqs = drainProcessor(p)
+	require.Len(t, reqs, 1)
+	require.True(t, errors.Is(reqs[0].Reply.Err, ErrTimeout))
+
+	//事务中任一请求超时，整个事务失败，不重试
+	group := NewTxGroup(2, false)
+	p.AppendRequest(&DBRequest{Command: CmdUpdateSingle, Schema: schema, Keys: []string{"1", "2"},
+		Data: []string{"gold", "1"}, RowContext: NewRowContext(), TxGroup: group, Deadline: time.Now().Add(-time.Second)})
+	p.AppendRequest(&DBRequest{Command: CmdInsert, Schema: schema, Keys: []string{"1", "3"},
+		Data: []string{"uid", "1", "id", "3"}, RowContext: NewRowContext(), TxGroup: group})
+	reqs = drainProcessor(p)
+	require.Len(t, reqs, 2)
+	require.True(t, errors.Is(reqs[1].Reply.Err, ErrTimeout))
+	require.Same(t, reqs[0].Reply, reqs[1].Reply)
+
+	//请求的Deadline不同时不合并、不批量执行，没有Deadline的请求不受影响
+	p.SetTimeout(0)
+	p.SetBatchSize(8)
+	require.Equal(t, int64(1), driver.Insert(schema, "1", []string{"uid", "1", "id", "4"}).Data)
+	require.Equal(t, int64(1), driver.Insert(schema, "1", []string{"uid", "1", "id", "5"}).Data)
+	rc = NewRowContext()
+	expired := newTestRequest(schema, CmdUpdateSingle, rc, []string{"1", "4"}, []string{"gold", "1"})
+	expired.Deadline = time.Now().Add(-time.Second)
+	p.AppendRequest(expired)
+	p.AppendRequest(newTestRequest(schema, CmdUpdateSingle, rc, []string{"1", "4"}, []string{"gold", "2"}))
+	p.AppendRequest(newTestRequest(schema, CmdUpdateSingle, NewRowContext(), []string{"1", "5"}, []string{"gold", "3"}))
+	reqs = drainProcessor(p)
+	require.Len(t, reqs, 3)
+	require.True(t, errors.Is(reqs[0].Reply.Err, ErrTimeout))
+	require.NoError(t, reqs[1].Reply.Err)
+	require.Equal(t, int64(1), reqs[1].Reply.Data)
+	require.NoError(t, reqs[2].Reply.Err)
+	require.Equal(t, int64(1), reqs[2].Reply.Data)
+}
+
+func TestProcessor_RetryPolicy(t *testing.T) {
+	schema := newTestSchema()
+	driver := &flakyDriver{DBStub: NewDBStub(), fails: map[string]int{"1": 2, "3": -1}}
+	p := NewProcessor(driver)
+
+	var dead []*DBRequest
+	p.SetRetryPolicy(&BackoffRetryPolicy{
+		MaxAttempts:  3,
+		Backoff:      5 * time.Millisecond,
+		MaxBackoff:   10 * time.Millisecond,
+		OnDeadLetter: func(req *DBRequest) { dead = append(dead, req) },
+	})
+
+	rc1 := NewRowContext()
+	p.AppendRequest(newTestRequest(schema, CmdInsert, rc1, []string{"1", "1"},
+		[]string{"uid", "1", "id", "1", "gold", "10"}))
+	p.AppendRequest(newTestRequest(schema, CmdUpdateSingle, rc1, []string{"1", "1"}, []string{"gold", "11"}))
+	p.AppendRequest(newTestRequest(schema, CmdInsert, NewRowContext(), []string{"1", "2"},
+		[]string{"uid", "1", "id", "2", "gold", "20"}))
+	p.AppendRequest(newTestRequest(schema, CmdInsert, NewRowContext(), []string{"1", "3"},
+		[]string{"uid", "1", "id", "3", "gold", "30"}))
+
+	//失败的请求和同一行后续的请求等待重试，其他行不受影响
+	reqs := drainProcessor(p)
+	require.Len(t, reqs, 1)
+	require.Equal(t, "2", reqs[0].Keys[1])
+	require.False(t, p.Empty())
+	require.True(t, p.Idle())
+	require.False(t, p.NextRetryTime().IsZero())
+
+	for !p.Empty() {
+		time.Sleep(time.Until(p.NextRetryTime()))
+		reqs = append(reqs, drainProcessor(p)...)
+	}
+
+	require.Len(t, reqs, 4)
+	require.Equal(t, CmdInsert, reqs[1].Command)
+	require.Equal(t, "1", reqs[1].Keys[1])
+	require.Equal(t, int64(1), reqs[1].Reply.Data)
+	require.Equal(t, CmdUpdateSingle, reqs[2].Command)
+	require.Equal(t, int64(1), reqs[2].Reply.Data)
+	require.Equal(t, "3", reqs[3].Keys[1])
+	require.Error(t, reqs[3].Reply.Err)
+
+	require.Len(t, dead, 1)
+	require.Same(t, reqs[3], dead[0])
+	require.Equal(t, int32(0), p.PendingReqNum())
+	require.True(t, p.NextRetryTime().IsZero())
+}
+
+func TestBackoffRetryPolicy(t *testing.T) {
+	policy := &BackoffRetryPolicy{MaxAttempts: 5, Backoff: time.Second, MaxBackoff: 3 * time.Second}
+	for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		d, ok := policy.NextRetry(nil, attempt+1)
+		require.True(t, ok)
+		require.Equal(t, expected, d)
+	}
+
+	_, ok := policy.NextRetry(nil, 5)
+	require.False(t, ok)
+}
+
+func TestProcessor_Panic(t *testing.T) {
+	schema := newTestSchema()
+	p := NewProcessor(&panicDriver{DBStub: NewDBStub()})
+
+	rc := NewRowContext()
+	p.AppendRequest(newTestRequest(schema, CmdSelectSingle, rc, []string{"1", "1"}, nil))
+	p.AppendRequest(newTestRequest(schema, CmdSelectSingle, rc, []string{"1", "1"}, nil))
+	//Data类型不对，合并时panic
+	p.AppendRequest(newTestRequest(schema, CmdUpdateSingle, NewRowContext(), []string{"1", "2"}, []string{"gold", "1"}))
+	p.AppendRequest(newTestRequest(schema, CmdUpdateSingle, NewRowContext(), []string{"1", "2"}, "gold"))
+
+	reqs := drainProcessor(p)
+	require.Len(t, reqs, 4)
+	require.ErrorIs(t, reqs[0].Reply.Err, ErrPanic)
+	require.Same(t, reqs[0].Reply, reqs[1].Reply)
+	require.ErrorIs(t, reqs[3].Reply.Err, ErrPanic)
+	require.Equal(t, int32(0), p.PendingReqNum())
+	require.True(t, p.Empty())
+}
+
+func TestProcessor_SelectQuery(t *testing.T) {
+	schema := newTestSchema()
+	driver := NewDBStub()
+	for i := 1; i <= 3; i++ {
+		id := strconv.Itoa(i)
+		driver.Insert(schema, "1", []string{"uid", "1", "id", id, "gold", id})
+	}
+
+	p := NewProcessor(driver)
+	rc := NewRowContext()
+	top := &SelectQuery{OrderBy: []OrderBy{{Column: "gold", Desc: true}}, Limit: 1}
+	reqs := []*DBRequest{
+		newTestRequest(schema, CmdSelectMulti, rc, []string{"1"}, nil),
+		newTestRequest(schema, CmdSelectMulti, rc, []string{"1"}, top),
+		newTestRequest(schema, CmdSelectMulti, rc, []string{"1"}, &SelectQuery{OrderBy: []OrderBy{{Column: "gold", Desc: true}}, Limit: 1}),
+		newTestRequest(schema, CmdCountMulti, rc, []string{"1"}, nil),
+		newTestRequest(schema, CmdCountMulti, rc, []string{"1"}, &AggregateQuery{Func: AggregateSum, Column: "gold"}),
+	}
+	for _, req := range reqs {
+		p.AppendRequest(req)
+	}
+
+	//only the requests with the same query are merged
+	require.Equal(t, int32(4), p.PendingReqNum())
+	drainProcessor(p)
+	require.Len(t, reqs[0].Reply.Data, 3)
+	require.Equal(t, &AggregateResult{Value: "3"}, reqs[3].Reply.Data)
+	require.Equal(t, &AggregateResult{Value: "6"}, reqs[4].Reply.Data)
+	for _, req := range reqs[1:3] {
+		rows := req.Reply.Data.([][]byte)
+		require.Len(t, rows, 1)
+		require.Equal(t, "3", GetValueByIndex(schema, rows[0], 1))
+	}
+}
+
+func TestProcessor_Upsert(t *testing.T) {
+	schema := newTestSchema()
+	driver := NewDBStub()
+	driver.Insert(schema, "1", []string{"uid", "1", "id", "1", "name", "a", "gold", "1"})
+
+	p := NewProcessor(driver)
+	rc := NewRowContext()
+	keys := []string{"1", "1"}
+	reqs := []*DBRequest{
+		newTestRequest(schema, CmdUpsert, rc, keys, []string{"uid", "1", "id", "1", "gold", "2"}),
+		newTestRequest(schema, CmdUpsert, rc, keys, []string{"uid", "1", "id", "1", "gold", "3"}),
+		newTestRequest(schema, CmdUpdateSingle, rc, keys, []string{"name", "b"}),
+		newTestRequest(schema, CmdUpsert, NewRowContext(), []string{"1", "2"}, []string{"uid", "1", "id", "2", "gold", "4"}),
+	}
+	for _, req := range reqs {
+		p.AppendRequest(req)
+	}
+
+	require.Equal(t, int32(2), p.PendingReqNum())
+	drainProcessor(p)
+	for _, req := range reqs {
+		require.Equal(t, int64(1), req.Reply.Data)
+	}
+
+	fields := RowData2Map(schema, driver.SelectSingle(schema, "1", keys).Data.([]byte))
+	require.Equal(t, "b", fields["name"])
+	require.Equal(t, "3", fields["gold"])
+	require.NotNil(t, driver.SelectSingle(schema, "1", []string{"1", "2"}).Data)
+}
+
+func TestProcessor_Version(t *testing.T) {
+	schema := newTestSchema()
+	require.NoError(t, schema.SetVersionColumn("gold"))
+	driver := NewDBStub()
+	driver.Insert(schema, "1", []string{"uid", "1", "id", "1", "name", "a", "gold", "1"})
+
+	p := NewProcessor(driver)
+	rc := NewRowContext()
+	keys := []string{"1", "1"}
+	reqs := []*DBRequest{
+		newTestRequest(schema, CmdUpdateSingle, rc, keys, []string{"name", "b", "gold", "1"}),
+		newTestRequest(schema, CmdUpdateSingle, rc, keys, []string{"name", "c", "gold", "2"}),
+		//stale version
+		newTestRequest(schema, CmdUpdateSingle, rc, keys, []string{"name", "d", "gold", "2"}),
+	}
+	for _, req := range reqs {
+		p.AppendRequest(req)
+	}
+
+	//requests carrying versions are never merged
+	require.Equal(t, int32(3), p.PendingReqNum())
+	drainProcessor(p)
+	require.Equal(t, int64(1), reqs[0].Reply.Data)
+	require.Equal(t, int64(1), reqs[1].Reply.Data)
+	require.ErrorIs(t, reqs[2].Reply.Err, ErrVersionConflict)
+
+	fields := RowData2Map(schema, driver.SelectSingle(schema, "1", keys).Data.([]byte))
+	require.Equal(t, "c", fields["name"])
+	require.Equal(t, "3", fields["gold"])
+}
+
+func TestTableRow_Version(t *testing.T) {
+	schema := newTestSchema()
+	require.Error(t, schema.SetVersionColumn("id"))
+	require.Error(t, schema.SetVersionColumn("name"))
+	require.NoError(t, schema.SetVersionColumn("gold"))
+
+	row := &TableRow{State: TableRowStateValid,
+		Data: NewRowDataFromMap(schema, map[string]string{"uid": "1", "id": "1", "name": "a", "gold": "5"})}
+	require.Equal(t, "5", row.Version(schema))
+
+	ok, msg := row.Update2(schema, []string{"name", "b"})
+	require.False(t, ok)
+	require.Equal(t, "missing version", msg)
+	ok, msg = row.Update2(schema, []string{"name", "b", "gold", "4"})
+	require.False(t, ok)
+	require.Equal(t, "version conflict", msg)
+	ok, msg = row.Update2(schema, []string{"name", "b", "gold", "5"})
+	require.True(t, ok, msg)
+	require.Equal(t, "6", row.Version(schema))
+
+	ok, msg = row.IncrBy2(schema, &IncrByData{Column: "id", Delta: 1, Version: "5"})
+	require.False(t, ok)
+	require.Equal(t, "version conflict", msg)
+
+	//a refresh with the same version keeps the cached row
+	stale := NewRowDataFromMap(schema, map[string]string{"uid": "1", "id": "1", "name": "x", "gold": "6"})
+	require.False(t, row.Refresh(schema, stale))
+	fresh := NewRowDataFromMap(schema, map[string]string{"uid": "1", "id": "1", "name": "c", "gold": "8"})
+	require.True(t, row.Refresh(schema, fresh))
+	require.Equal(t, "8", row.Version(schema))
+	require.True(t, row.Refresh(schema, nil))
+	require.Equal(t, TableRowStateNotExist, row.State)
+}
+
+func TestTableRow_Upsert(t *testing.T) {
+	schema := newTestSchema()
+	row := &TableRow{State: TableRowStateNotExist, Data: []byte(AssembleRowKey2(schema, []string{"1", "1"}))}
+
+	ok, msg := row.Upsert(schema, []string{"uid", "1", "id", "2", "gold", "1"})
+	require.False(t, ok, msg)
+
+	ok, msg = row.Upsert(schema, []string{"uid", "1", "id", "1", "gold", "1"})
+	require.True(t, ok, msg)
+	require.Equal(t, TableRowStateValid, row.State)
+
+	ok, msg = row.Upsert(schema, []string{"uid", "1", "id", "1", "name", "a"})
+	require.True(t, ok, msg)
+	require.Equal(t, "1", GetValueByIndex(schema, row.Data, 3))
+	require.Equal(t, "a", GetValueByIndex(schema, row.Data, 2))
+
+	ok, _ = (&TableRow{State: TableRowStateInit}).Upsert(schema, []string{"uid", "1", "id", "1"})
+	require.False(t, ok)
+}
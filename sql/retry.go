@@ -0,0 +1,222 @@
+package sql
+
+import (
+	"time"
+)
+
+// RetryPolicy 非Sync请求因连接等错误(DBReply.Err)失败后的重试策略
+type RetryPolicy interface {
+	// NextRetry 请求第attempt次执行失败后调用，返回距下一次重试的等待时间，false表示放弃
+	NextRetry(req *DBRequest, attempt int) (time.Duration, bool)
+	// DeadLetter 放弃重试的请求(包括与它合并的请求)，请求仍以最后一次的失败结果从Execute返回
+	DeadLetter(req *DBRequest)
+}
+
+// BackoffRetryPolicy 指数退避的重试策略
+type BackoffRetryPolicy struct {
+	// MaxAttempts 最多执行的次数(包括第一次)，小于等于0表示不限制
+	MaxAttempts int
+	// Backoff 第一次重试前的等待时间，之后每次翻倍，不超过MaxBackoff(大于0时)
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// OnDeadLetter 可以为nil
+	OnDeadLetter func(req *DBRequest)
+}
+
+// parkedRequest 等待重试的请求(事务为整个TxGroup)，以及在它之后加入、被它阻塞的同一行的请求
+type parkedRequest struct {
+	retryAt time.Time
+	reqs    []*DBRequest
+}
+
+func (bp *BackoffRetryPolicy) NextRetry(_ *DBRequest, attempt int) (time.Duration, bool) {
+	if bp.MaxAttempts > 0 && attempt >= bp.MaxAttempts {
+		return 0, false
+	}
+
+	d := bp.Backoff
+	for i := 1; i < attempt; i++ {
+		if bp.MaxBackoff > 0 && d >= bp.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+
+	if bp.MaxBackoff > 0 && d > bp.MaxBackoff {
+		d = bp.MaxBackoff
+	}
+
+	return d, true
+}
+
+func (bp *BackoffRetryPolicy) DeadLetter(req *DBRequest) {
+	if bp.OnDeadLetter != nil {
+		bp.OnDeadLetter(req)
+	}
+}
+
+// SetRetryPolicy 设置后失败的请求移出队首等待重试，同一行后续的请求跟随等待，其他请求继续执行；
+// 为nil时(默认)失败的请求停留在队首，每次Execute立即重试
+func (p *Processor) SetRetryPolicy(policy RetryPolicy) {
+	p.retry = policy
+}
+
+// Idle 除了等待重试的请求之外没有可以执行的请求
+func (p *Processor) Idle() bool {
+	return p.reqDummyHead.next == nil
+}
+
+// NextRetryTime 最早一个等待重试的请求的重试时间，没有时返回零值
+func (p *Processor) NextRetryTime() time.Time {
+	var ret time.Time
+	for _, pr := range p.parked {
+		if ret.IsZero() || pr.retryAt.Before(ret) {
+			ret = pr.retryAt
+		}
+	}
+
+	return ret
+}
+
+// retryLater 失败的请求是否重试，按RetryPolicy设置下一次执行的时间
+func (p *Processor) retryLater(req *DBRequest) bool {
+	if p.retry == nil {
+		return true
+	}
+
+	req.attempts++
+	delay, ok := p.retry.NextRetry(req, req.attempts)
+	if !ok {
+		return false
+	}
+
+	req.retryAt = time.Now().Add(delay)
+	return true
+}
+
+func (p *Processor) deadLetter(req *DBRequest) {
+	if p.retry != nil {
+		p.retry.DeadLetter(req)
+	}
+}
+
+func (p *Processor) isBlocked(req *DBRequest) bool {
+	if req.RowContext == nil {
+		return false
+	}
+
+	_, ok := p.blocked[req.RowContext]
+	return ok
+}
+
+// unit 队首必须一起执行的请求：TxGroup的全部成员，PreReq和它的后续请求
+func (p *Processor) unit(curr *DBRequest) []*DBRequest {
+	if group := curr.TxGroup; group != nil {
+		members := make([]*DBRequest, 0, group.Num)
+		for req := curr; req != nil && req.TxGroup == group && len(members) < group.Num; req = req.next {
+			members = append(members, req)
+		}
+
+		if len(members) < group.Num {
+			return nil
+		}
+		return members
+	}
+
+	if curr.PreReq && curr.next != nil {
+		return []*DBRequest{curr, curr.next}
+	}
+
+	return []*DBRequest{curr}
+}
+
+// park 队首的请求需要等待重试或者被阻塞时，把它移出队列，返回是否移出
+func (p *Processor) park(curr *DBRequest) bool {
+	if curr.retryAt.IsZero() && len(p.blocked) == 0 {
+		return false
+	}
+
+	reqs := p.unit(curr)
+	if reqs == nil {
+		return false
+	}
+
+	var pr *parkedRequest
+	for _, req := range reqs {
+		if req.RowContext != nil {
+			if pr = p.blocked[req.RowContext]; pr != nil {
+				break
+			}
+		}
+	}
+
+	if pr == nil {
+		if curr.retryAt.IsZero() {
+			return false
+		}
+
+		pr = &parkedRequest{retryAt: curr.retryAt}
+		p.parked = append(p.parked, pr)
+	}
+
+	last := reqs[len(reqs)-1]
+	p.reqDummyHead.next = last.next
+	if p.reqDummyHead.next == nil {
+		p.reqTail = nil
+	}
+	last.next = nil
+
+	for _, req := range reqs {
+		pr.reqs = append(pr.reqs, req)
+		if req.RowContext != nil {
+			if _, ok := p.blocked[req.RowContext]; !ok {
+				p.blocked[req.RowContext] = pr
+			}
+		}
+	}
+
+	return true
+}
+
+// unpark 到达重试时间的请求按park的顺序放回队首
+func (p *Processor) unpark(now time.Time) {
+	var ready []*parkedRequest
+	n := 0
+	for _, pr := range p.parked {
+		if pr.retryAt.After(now) {
+			p.parked[n] = pr
+			n++
+
+		} else {
+			ready = append(ready, pr)
+		}
+	}
+
+	if ready == nil {
+		return
+	}
+
+	for i := n; i < len(p.parked); i++ {
+		p.parked[i] = nil
+	}
+	p.parked = p.parked[:n]
+
+	head := p.reqDummyHead
+	for i := len(ready) - 1; i >= 0; i-- {
+		pr := ready[i]
+		pr.reqs[0].retryAt = time.Time{}
+
+		for j := len(pr.reqs) - 1; j >= 0; j-- {
+			req := pr.reqs[j]
+			if rc := req.RowContext; rc != nil && p.blocked[rc] == pr {
+				delete(p.blocked, rc)
+			}
+
+			req.next = head.next
+			head.next = req
+			if p.reqTail == nil {
+				p.reqTail = req
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package sql
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// patchValue 按行数据的格式编码后的列值
+type patchValue struct {
+	idx    int
+	text   string
+	bits   uint64
+	binary bool
+	null   bool
+}
+
+func (pv *patchValue) len() int {
+	if pv.null {
+		return 0
+	}
+
+	if pv.binary {
+		return 8
+	}
+
+	return len(pv.text)
+}
+
+// encodePatch 按format(行数据的第一个字节)编码列的新值，value为NullValue时为NULL；
+// 二进制编码的列不是合法的数字时返回false，由调用者重建整行，这一类的列改为文本保存
+func encodePatch(schema *TableSchema, format byte, idx int, value string) (patchValue, bool) {
+	pv := patchValue{idx: idx}
+	if value == NullValue {
+		pv.null = true
+		return pv, true
+	}
+
+	if value == "" {
+		return pv, true
+	}
+
+	switch binaryColumnFormat(&schema.Columns[idx]) & format {
+	case rowFormatBinaryInt:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return pv, false
+		}
+		pv.bits, pv.binary = uint64(v), true
+
+	case rowFormatBinaryFloat:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return pv, false
+		}
+		pv.bits, pv.binary = math.Float64bits(v), true
+
+	default:
+		pv.text = value
+	}
+
+	return pv, true
+}
+
+// patchRow 返回修改了一列之后的新的行数据：复制这一列之前和之后的数据，并调整之后各列的偏移量。
+// rowData不会被修改(copy on write)，GetValueByIndex、RowData2Map等返回的字符串没有复制，仍然引用旧的行数据；
+// rowData必须是完整的行数据，pv不能是主键列，pv为NULL时rowData必须有NULL位图，由patchColumns检查
+func patchRow(schema *TableSchema, rowData []byte, pv *patchValue) []byte {
+	base := rowHeader(schema, rowData)
+	nColumn := len(schema.Columns)
+	headerStart := base + uint32(pv.idx*4)
+	end := binary.LittleEndian.Uint32(rowData[headerStart : headerStart+4])
+	start := base + uint32(nColumn*4)
+	if pv.idx > 0 {
+		start = binary.LittleEndian.Uint32(rowData[headerStart-4 : headerStart])
+	}
+
+	n := pv.len()
+	delta := n - int(end-start)
+	patched := make([]byte, len(rowData)+delta)
+	copy(patched, rowData[:start])
+	copy(patched[int(end)+delta:], rowData[end:])
+	rowData = patched
+
+	if pv.binary {
+		binary.LittleEndian.PutUint64(rowData[start:start+8], pv.bits)
+	} else {
+		copy(rowData[start:int(start)+n], pv.text)
+	}
+
+	if delta != 0 {
+		for i := pv.idx; i < nColumn; i++ {
+			h := base + uint32(i*4)
+			offset := binary.LittleEndian.Uint32(rowData[h : h+4])
+			binary.LittleEndian.PutUint32(rowData[h:h+4], uint32(int(offset)+delta))
+		}
+	}
+
+	if rowData[0]&rowFormatNullable != 0 {
+		if pv.null {
+			rowData[1+pv.idx>>3] |= 1 << (pv.idx & 7)
+		} else {
+			rowData[1+pv.idx>>3] &^= 1 << (pv.idx & 7)
+		}
+	}
+
+	return rowData
+}
+
+// patchColumns 修改多列，values[i]为idxes[i]列的新值，返回新的行数据，不修改rowData。先检查并编码所有的值，
+// 无法只修改这些列时(不是完整的行数据、主键列、值不能按行的格式编码、设置NULL而行没有NULL位图)
+// 返回false，由调用者重建整行
+func patchColumns(schema *TableSchema, rowData []byte, idxes []int, values []string) ([]byte, bool) {
+	if rowHeader(schema, rowData) == 0 {
+		return nil, false
+	}
+
+	var buf [8]patchValue
+	pvs := buf[:0]
+	if len(idxes) > len(buf) {
+		pvs = make([]patchValue, 0, len(idxes))
+	}
+
+	format := rowData[0]
+	for i, idx := range idxes {
+		if schema.Columns[idx].IsPrimaryKey {
+			return nil, false
+		}
+
+		pv, ok := encodePatch(schema, format, idx, values[i])
+		if !ok || (pv.null && format&rowFormatNullable == 0) {
+			return nil, false
+		}
+		pvs = append(pvs, pv)
+	}
+
+	for i := range pvs {
+		rowData = patchRow(schema, rowData, &pvs[i])
+	}
+
+	return rowData, true
+}
@@ -0,0 +1,173 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWideSchema(nColumn int) *TableSchema {
+	columns := make([]FakeColumn, nColumn)
+	columns[0] = FakeColumn{Name: "uid", Type: ColumnTypeInt}
+	for i := 1; i < nColumn; i++ {
+		columns[i] = FakeColumn{Name: "c" + strconv.Itoa(i), Type: ColumnTypeInt}
+		if i&1 == 0 {
+			columns[i].Type = ColumnTypeString
+		}
+	}
+
+	return CreateFakeTableSchema(columns, 1)
+}
+
+func newTestWideRow(schema *TableSchema) []byte {
+	fields := make([]string, 0, len(schema.Columns)*2)
+	for i := range schema.Columns {
+		fields = append(fields, schema.Columns[i].Name, strconv.Itoa(i*100))
+	}
+
+	return NewRowDataFromSlice(schema, fields)
+}
+
+func TestTableRow_Patch(t *testing.T) {
+	updates := [][]string{
+		{"c1", "123456"},
+		{"c2", ""},
+		{"c2", "a longer string value"},
+		{"c1", "7", "c3", "-8"},
+		{"c6", NullValue},
+		{"c6", "x", "c4", NullValue},
+		{"c5", "1"},
+	}
+
+	for _, encoding := range [][]ColumnType{nil, {ColumnTypeInt}} {
+		schema := newTestWideSchema(8)
+		require.NoError(t, schema.SetBinaryEncoding(encoding...))
+
+		tr := &TableRow{State: TableRowStateValid, Data: newTestWideRow(schema)}
+		//rowData2Map does not copy, the strings change with a patched row
+		expected := make(map[string]string)
+		for k, v := range rowData2Map(schema, tr.Data, true) {
+			expected[k] = strings.Clone(v)
+		}
+		for _, fields := range updates {
+			ok, msg := tr.Update2(schema, fields)
+			require.True(t, ok, msg)
+			for i := 0; i < len(fields); i += 2 {
+				expected[fields[i]] = fields[i+1]
+				if fields[i+1] == "" {
+					expected[fields[i]] = schema.GetColumnSchema(fields[i]).DefaultValue
+				}
+			}
+
+			require.Equal(t, expected, rowData2Map(schema, tr.Data, true), fields)
+			require.Equal(t, "\t0", GetRowKey(schema, tr.Data))
+		}
+
+		ok, msg := tr.IncrBy(schema, 3, 10)
+		require.True(t, ok, msg)
+		require.Equal(t, "2", GetValueByIndex(schema, tr.Data, 3))
+		ok, _ = tr.IncrBy(schema, 4, 1)
+		require.False(t, ok)
+
+		//invalid numbers keep the row in the text format for that type
+		ok, msg = tr.Update2(schema, []string{"c1", "9", "c3", "x"})
+		require.True(t, ok, msg)
+		require.Zero(t, tr.Data[0]&rowFormatBinaryInt)
+		require.Equal(t, "9", GetValueByIndex(schema, tr.Data, 1))
+		require.Equal(t, "x", GetValueByIndex(schema, tr.Data, 3))
+	}
+}
+
+func TestPatchColumns(t *testing.T) {
+	schema := newTestWideSchema(4)
+	row := newTestWideRow(schema)
+
+	//a plain row has no null bitmap and can not be patched to NULL
+	_, ok := patchColumns(schema, row, []int{1}, []string{NullValue})
+	require.False(t, ok)
+	_, ok = patchColumns(schema, row, []int{0}, []string{"1"})
+	require.False(t, ok)
+
+	//copy on write: strings handed out before the patch keep their value
+	held := GetValueByIndex(schema, row, 2)
+	heldMap := RowData2Map(schema, row)
+	orig := append([]byte(nil), row...)
+
+	patched, ok := patchColumns(schema, row, []int{2}, []string{""})
+	require.True(t, ok)
+	patched, ok = patchColumns(schema, patched, []int{2}, []string{"201"})
+	require.True(t, ok)
+	patched, ok = patchColumns(schema, patched, []int{2, 3}, []string{"20000", "3"})
+	require.True(t, ok)
+	require.Equal(t, "20000", GetValueByIndex(schema, patched, 2))
+	require.Equal(t, "3", GetValueByIndex(schema, patched, 3))
+
+	require.Equal(t, orig, row)
+	require.Equal(t, "200", held)
+	require.Equal(t, "200", heldMap["c2"])
+	require.Equal(t, "300", heldMap["c3"])
+
+	tr := &TableRow{State: TableRowStateValid, Data: row}
+	ok, msg := tr.IncrBy(schema, 2, 1)
+	require.True(t, ok, msg)
+	require.Equal(t, "201", GetValueByIndex(schema, tr.Data, 2))
+	require.Equal(t, "200", held)
+	require.Equal(t, orig, row)
+}
+
+func BenchmarkTableRow_Update(b *testing.B) {
+	schema := newTestWideSchema(32)
+	row := newTestWideRow(schema)
+	fields := []string{"c7", "777"}
+	idxes, values := []int{7}, []string{"777"}
+
+	b.Run("Rebuild", func(b *testing.B) {
+		b.ReportAllocs()
+		tr := &TableRow{State: TableRowStateValid, Data: row}
+		for i := 0; i < b.N; i++ {
+			tr.rebuild(schema, idxes, values)
+		}
+	})
+
+	b.Run("Patch", func(b *testing.B) {
+		b.ReportAllocs()
+		tr := &TableRow{State: TableRowStateValid, Data: append([]byte(nil), row...)}
+		for i := 0; i < b.N; i++ {
+			tr.Update2(schema, fields)
+		}
+	})
+}
+
+func BenchmarkTableRow_IncrBy(b *testing.B) {
+	schema := newTestWideSchema(32)
+	row := newTestWideRow(schema)
+
+	b.Run("Rebuild", func(b *testing.B) {
+		b.ReportAllocs()
+		tr := &TableRow{State: TableRowStateValid, Data: row}
+		for i := 0; i < b.N; i++ {
+			v := GetValueByIndex(schema, tr.Data, 7)
+			n, _ := strconv.ParseInt(v, 10, 64)
+			tr.rebuild(schema, []int{7}, []string{strconv.FormatInt(n+1, 10)})
+		}
+	})
+
+	for _, encoding := range [][]ColumnType{nil, {ColumnTypeInt}} {
+		name := "Patch"
+		if encoding != nil {
+			name = "PatchBinary"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			schema := newTestWideSchema(32)
+			_ = schema.SetBinaryEncoding(encoding...)
+			tr := &TableRow{State: TableRowStateValid, Data: newTestWideRow(schema)}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tr.IncrBy(schema, 7, 1)
+			}
+		})
+	}
+}
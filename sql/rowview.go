@@ -0,0 +1,181 @@
+package sql
+
+import (
+	"encoding/binary"
+	"fmt"
+	"go-learner/slice"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RowView 按列的类型读取行数据，二进制编码的数字列直接读取，不需要转换为文本再解析。
+// NULL列返回类型的零值，需要区分时使用IsNull；空值按列的默认值转换
+type RowView struct {
+	schema *TableSchema
+	data   []byte
+	base   uint32
+}
+
+func NewRowView(schema *TableSchema, rowData []byte) RowView {
+	return RowView{schema: schema, data: rowData, base: rowHeader(schema, rowData)}
+}
+
+// Valid rowData是否为完整的行数据，NotExist状态的行只有主键
+func (rv RowView) Valid() bool {
+	return rv.base != 0
+}
+
+func (rv RowView) IsNull(col string) bool {
+	idx, err := rv.index(col)
+	return err == nil && rv.base != 0 && isNullColumn(rv.data, idx)
+}
+
+func (rv RowView) String(col string) (string, error) {
+	idx, err := rv.index(col)
+	if err != nil {
+		return "", err
+	}
+
+	v, _ := GetNullableValueByIndex(rv.schema, rv.data, idx)
+	return v, nil
+}
+
+// Bytes 返回列的文本，不是二进制编码的列不复制，调用者不能修改
+func (rv RowView) Bytes(col string) ([]byte, error) {
+	idx, err := rv.index(col)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, format, null := rv.raw(idx)
+	if null {
+		return nil, nil
+	}
+
+	cs := &rv.schema.Columns[idx]
+	if len(raw) == 0 {
+		return slice.String2ByteSlice(cs.DefaultValue), nil
+	}
+
+	if binaryColumnFormat(cs)&format != 0 {
+		return []byte(columnText(cs, format, raw)), nil
+	}
+
+	return raw, nil
+}
+
+func (rv RowView) Int64(col string) (int64, error) {
+	idx, err := rv.index(col)
+	if err != nil {
+		return 0, err
+	}
+
+	return rv.int64At(idx)
+}
+
+func (rv RowView) Float64(col string) (float64, error) {
+	idx, err := rv.index(col)
+	if err != nil {
+		return 0, err
+	}
+
+	raw, format, null := rv.raw(idx)
+	if null {
+		return 0, nil
+	}
+
+	cs := &rv.schema.Columns[idx]
+	if len(raw) == 8 {
+		switch binaryColumnFormat(cs) & format {
+		case rowFormatBinaryFloat:
+			return math.Float64frombits(binary.LittleEndian.Uint64(raw)), nil
+		case rowFormatBinaryInt:
+			return float64(int64(binary.LittleEndian.Uint64(raw))), nil
+		}
+	}
+
+	text := rv.text(cs, raw)
+	if text == "" {
+		return 0, nil
+	}
+
+	return strconv.ParseFloat(text, 64)
+}
+
+// Time 时间列按UTC解析，0000-00-00这样的值返回time.Time{}
+func (rv RowView) Time(col string) (time.Time, error) {
+	idx, err := rv.index(col)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	raw, _, null := rv.raw(idx)
+	if null {
+		return time.Time{}, nil
+	}
+
+	text := rv.text(&rv.schema.Columns[idx], raw)
+	if text == "" || strings.HasPrefix(text, "0000-00-00") {
+		return time.Time{}, nil
+	}
+
+	if len(text) == len("2006-01-02") {
+		return time.Parse("2006-01-02", text)
+	}
+
+	return time.Parse("2006-01-02 15:04:05", text)
+}
+
+func (rv RowView) index(col string) (int, error) {
+	if idx, ok := rv.schema.m[col]; ok {
+		return idx, nil
+	}
+
+	return 0, fmt.Errorf("invalid column: %s", col)
+}
+
+// raw 返回列保存的数据和行的格式，不是完整的行数据时按空值处理
+func (rv RowView) raw(idx int) ([]byte, byte, bool) {
+	if rv.base == 0 {
+		return nil, 0, false
+	}
+
+	if isNullColumn(rv.data, idx) {
+		return nil, 0, true
+	}
+
+	return columnRaw(rv.schema, rv.data, rv.base, idx), rv.data[0], false
+}
+
+// text 不是二进制编码的列的文本，空值为默认值
+func (rv RowView) text(cs *ColumnSchema, raw []byte) string {
+	if len(raw) == 0 {
+		return cs.DefaultValue
+	}
+
+	return slice.ByteSlice2String(raw)
+}
+
+func (rv RowView) int64At(idx int) (int64, error) {
+	raw, format, null := rv.raw(idx)
+	if null {
+		return 0, nil
+	}
+
+	cs := &rv.schema.Columns[idx]
+	if len(raw) == 8 && binaryColumnFormat(cs)&format == rowFormatBinaryInt {
+		return int64(binary.LittleEndian.Uint64(raw)), nil
+	}
+
+	text := columnText(cs, format, raw)
+	if text == "" {
+		text = cs.DefaultValue
+		if text == "" {
+			return 0, nil
+		}
+	}
+
+	return strconv.ParseInt(text, 10, 64)
+}
@@ -0,0 +1,100 @@
+package sql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTypedSchema() *TableSchema {
+	return CreateFakeTableSchema([]FakeColumn{
+		{Name: "uid", Type: ColumnTypeInt},
+		{Name: "gold", Type: ColumnTypeInt},
+		{Name: "rate", Type: ColumnTypeFloat},
+		{Name: "name", Type: ColumnTypeString},
+		{Name: "ctime", Type: ColumnTypeTime},
+	}, 1)
+}
+
+func TestRowView(t *testing.T) {
+	for _, binaryEncoding := range []bool{false, true} {
+		schema := newTestTypedSchema()
+		if binaryEncoding {
+			require.NoError(t, schema.SetBinaryEncoding(ColumnTypeInt, ColumnTypeFloat))
+		}
+
+		row := NewRowDataFromMap(schema, map[string]string{"uid": "7", "gold": "-12", "rate": "0.25",
+			"name": "abc", "ctime": "2024-01-02 03:04:05"})
+		require.NotNil(t, row)
+		rv := NewRowView(schema, row)
+		require.True(t, rv.Valid())
+
+		gold, err := rv.Int64("gold")
+		require.NoError(t, err)
+		require.Equal(t, int64(-12), gold)
+		uid, err := rv.Int64("uid")
+		require.NoError(t, err)
+		require.Equal(t, int64(7), uid)
+		rate, err := rv.Float64("rate")
+		require.NoError(t, err)
+		require.Equal(t, 0.25, rate)
+		name, err := rv.Bytes("name")
+		require.NoError(t, err)
+		require.Equal(t, []byte("abc"), name)
+		ctime, err := rv.Time("ctime")
+		require.NoError(t, err)
+		require.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), ctime)
+		_, err = rv.Int64("foo")
+		require.Error(t, err)
+		_, err = rv.Int64("name")
+		require.Error(t, err)
+
+		//the text api sees the same values whatever the encoding
+		require.Equal(t, "-12", GetValueByIndex(schema, row, 1))
+		require.Equal(t, "0.25", RowData2Map(schema, row)["rate"])
+		parser, err := CreateParser(schema, "7", "gold < 0 AND rate * 4 = 1", nil)
+		require.NoError(t, err)
+		require.True(t, parser.Check(row))
+
+		tr := &TableRow{State: TableRowStateValid, Data: row}
+		ok, msg := tr.IncrBy(schema, 1, 2)
+		require.True(t, ok, msg)
+		gold, _ = NewRowView(schema, tr.Data).Int64("gold")
+		require.Equal(t, int64(-10), gold)
+	}
+}
+
+func TestRowView_Binary(t *testing.T) {
+	schema := newTestTypedSchema()
+	require.Error(t, schema.SetBinaryEncoding(ColumnTypeTime))
+	require.NoError(t, schema.SetBinaryEncoding(ColumnTypeInt))
+
+	row := NewRowDataFromSlice(schema, []string{"uid", "1", "gold", "123456789", "rate", NullValue})
+	require.Equal(t, rowFormatBinaryInt|rowFormatNullable, row[0])
+	rv := NewRowView(schema, row)
+	require.True(t, rv.IsNull("rate"))
+	rate, err := rv.Float64("rate")
+	require.NoError(t, err)
+	require.Zero(t, rate)
+	gold, err := rv.Bytes("gold")
+	require.NoError(t, err)
+	require.Equal(t, "123456789", string(gold))
+
+	//values that are not int64 fall back to text, the row format drops the binary bit
+	for _, value := range []string{"1.5", "18446744073709551615", "true"} {
+		mixed := NewRowDataFromSlice(schema, []string{"uid", "1", "gold", value})
+		require.NotNil(t, mixed, value)
+		require.Equal(t, rowFormatPlain, mixed[0], value)
+		require.Equal(t, value, GetValueByIndex(schema, mixed, 1))
+	}
+
+	//rows in the text format are still readable after the encoding changes
+	require.NoError(t, schema.SetBinaryEncoding())
+	text := NewRowDataFromSlice(schema, []string{"uid", "1", "gold", "5"})
+	require.NoError(t, schema.SetBinaryEncoding(ColumnTypeInt))
+	v, err := NewRowView(schema, text).Int64("gold")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), v)
+	require.Equal(t, "123456789", GetValueByIndex(schema, row, 1))
+}
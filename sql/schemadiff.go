@@ -0,0 +1,157 @@
+package sql
+
+import (
+	"fmt"
+	"go-learner/slice"
+)
+
+// SchemaDiff 同一个表两个版本的TableSchema之间的差异，列按名字对应。
+// 主键(包括顺序)和shard列不能改变；只有增加、删除列，或者列的顺序、默认值改变时可以迁移缓存的行数据
+type SchemaDiff struct {
+	Old *TableSchema
+	New *TableSchema
+	// Added 新增的列
+	Added []string
+	// Removed 删除的列
+	Removed []string
+	// Retyped ColumnType改变的列，缓存中的值可能与数据库转换后的不同，不能迁移
+	Retyped []string
+
+	changed bool
+	//columnMap[i] 新schema的第i列在旧schema中的位置，新增的列为-1
+	columnMap []int
+}
+
+// DiffSchema 比较old和new，主键或shard列改变时返回错误
+func DiffSchema(old *TableSchema, new *TableSchema) (*SchemaDiff, error) {
+	if old.NumPrimaryKeys != new.NumPrimaryKeys || old.ShardKey != new.ShardKey {
+		return nil, fmt.Errorf("can not alter key")
+	}
+
+	for i := 0; i < old.NumPrimaryKeys; i++ {
+		if old.Columns[old.primaryKeyIndex(i)].Name != new.Columns[new.primaryKeyIndex(i)].Name {
+			return nil, fmt.Errorf("can not alter key")
+		}
+	}
+
+	diff := &SchemaDiff{
+		Old:       old,
+		New:       new,
+		changed:   len(old.Columns) != len(new.Columns),
+		columnMap: make([]int, len(new.Columns)),
+	}
+
+	for i := range new.Columns {
+		cs := &new.Columns[i]
+		prev := old.GetColumnSchema(cs.Name)
+		if prev == nil {
+			diff.Added = append(diff.Added, cs.Name)
+			diff.columnMap[i] = -1
+			diff.changed = true
+			continue
+		}
+
+		if prev.IsPrimaryKey != cs.IsPrimaryKey {
+			return nil, fmt.Errorf("can not alter key")
+		}
+
+		if prev.Type != cs.Type {
+			diff.Retyped = append(diff.Retyped, cs.Name)
+		}
+
+		if !prev.Equal(cs) || prev.Index != i {
+			diff.changed = true
+		}
+		diff.columnMap[i] = prev.Index
+	}
+
+	for i := range old.Columns {
+		if new.GetColumnSchema(old.Columns[i].Name) == nil {
+			diff.Removed = append(diff.Removed, old.Columns[i].Name)
+		}
+	}
+
+	return diff, nil
+}
+
+// Empty 两个版本的列完全相同
+func (d *SchemaDiff) Empty() bool {
+	return !d.changed
+}
+
+// Migratable 缓存的行数据是否可以通过MigrateRow转换为新的格式
+func (d *SchemaDiff) Migratable() bool {
+	return len(d.Retyped) == 0
+}
+
+// MigrateRow 把旧格式的行数据转换为新schema的格式，新增的列填充默认值(DefaultNull的列为NULL)，NULL保持为NULL；
+// 其余列复制保存的数据，空值不替换为旧的默认值，读取时使用新的默认值。
+// 只有主键的数据(行的状态为None或NotExist)不需要转换，原样返回
+func (d *SchemaDiff) MigrateRow(rowData []byte) []byte {
+	base := rowHeader(d.Old, rowData)
+	if base == 0 {
+		return rowData
+	}
+
+	fieldData := make([][]byte, len(d.New.Columns))
+	nulls := make([]bool, len(d.New.Columns))
+	for i, j := range d.columnMap {
+		if j < 0 {
+			cs := &d.New.Columns[i]
+			nulls[i] = cs.DefaultNull
+			if !cs.DefaultNull {
+				fieldData[i] = slice.String2ByteSlice(cs.DefaultValue)
+			}
+			continue
+		}
+
+		if isNullColumn(rowData, j) {
+			nulls[i] = true
+			continue
+		}
+
+		//二进制编码的列转换为文本，由NewNullableRowData按新schema的格式编码
+		raw := columnRaw(d.Old, rowData, base, j)
+		fieldData[i] = slice.String2ByteSlice(columnText(&d.Old.Columns[j], rowData[0], raw))
+	}
+
+	return NewNullableRowData(d.New, fieldData, nulls)
+}
+
+// MigrateSchema 把缓存中的行转换为diff.New的格式，之后使用新的schema，返回转换的行数。
+// 有请求还没有返回时(结果可能是旧的格式)，或者diff不能迁移时返回错误，不修改缓存
+func (tb *Table) MigrateSchema(diff *SchemaDiff) (int32, error) {
+	if tb.Schema != diff.Old {
+		return 0, fmt.Errorf("%s schema mismatch", tb.Schema.Name)
+	}
+
+	if !diff.Migratable() {
+		return 0, fmt.Errorf("%s retyped columns %v", tb.Schema.Name, diff.Retyped)
+	}
+
+	if tb.NumDBMultiReq > 0 || tb.NumDBReq > 0 {
+		return 0, fmt.Errorf("%s has DB request pending", tb.Schema.Name)
+	}
+
+	//先全部转换，有一行失败时不修改缓存
+	migrated := make(map[int32][]byte, len(tb.m))
+	for _, idx := range tb.m {
+		row := &tb.rows[idx]
+		if rowHeader(diff.Old, row.Data) == 0 {
+			continue
+		}
+
+		rowData := diff.MigrateRow(row.Data)
+		if rowData == nil {
+			return 0, fmt.Errorf("%s invalid row data: %s", tb.Schema.Name, GetRowKey(diff.Old, row.Data))
+		}
+		migrated[idx] = rowData
+	}
+
+	for idx, rowData := range migrated {
+		tb.rows[idx].Data = rowData
+	}
+	tb.Schema = diff.New
+
+	return int32(len(migrated)), nil
+}
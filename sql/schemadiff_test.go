@@ -0,0 +1,125 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffSchema(t *testing.T) {
+	old := newTestSchema()
+	diff, err := DiffSchema(old, newTestSchema())
+	require.NoError(t, err)
+	require.True(t, diff.Empty())
+
+	schema := CreateFakeTableSchema([]FakeColumn{
+		{Name: "uid", Type: ColumnTypeInt},
+		{Name: "id", Type: ColumnTypeInt},
+		{Name: "gold", Type: ColumnTypeInt},
+		{Name: "exp", Type: ColumnTypeInt},
+	}, 2)
+	schema.Columns[3].DefaultValue = "1"
+	diff, err = DiffSchema(old, schema)
+	require.NoError(t, err)
+	require.False(t, diff.Empty())
+	require.True(t, diff.Migratable())
+	require.Equal(t, []string{"exp"}, diff.Added)
+	require.Equal(t, []string{"name"}, diff.Removed)
+
+	row := NewRowDataFromSlice(old, []string{"uid", "1", "id", "2", "name", "a", "gold", NullValue})
+	migrated := diff.MigrateRow(row)
+	require.Equal(t, GetRowKey(old, row), GetRowKey(schema, migrated))
+	require.True(t, IsNullByIndex(schema, migrated, 2))
+	require.Equal(t, "1", GetValueByIndex(schema, migrated, 3))
+	key := []byte(AssembleRowKey2(old, []string{"1", "2"}))
+	require.Equal(t, key, diff.MigrateRow(key))
+
+	//empty values keep following the column default, a new column without default is NULL
+	old.Columns[3].DefaultValue = "5"
+	schema.Columns[2].DefaultValue = "9"
+	schema.Columns[3].DefaultNull = true
+	row = NewRowDataFromSlice(old, []string{"uid", "1", "id", "2", "name", "a", "gold", ""})
+	require.Equal(t, "5", GetValueByIndex(old, row, 3))
+	migrated = diff.MigrateRow(row)
+	require.Equal(t, "9", GetValueByIndex(schema, migrated, 2))
+	require.True(t, IsNullByIndex(schema, migrated, 3))
+
+	schema = CreateFakeTableSchema([]FakeColumn{
+		{Name: "uid", Type: ColumnTypeInt},
+		{Name: "id", Type: ColumnTypeInt},
+		{Name: "name", Type: ColumnTypeInt},
+		{Name: "gold", Type: ColumnTypeInt},
+	}, 2)
+	diff, err = DiffSchema(old, schema)
+	require.NoError(t, err)
+	require.Equal(t, []string{"name"}, diff.Retyped)
+	require.False(t, diff.Migratable())
+
+	//primary keys can not change
+	for _, columns := range [][]FakeColumn{
+		{{Name: "uid", Type: ColumnTypeInt}, {Name: "gold", Type: ColumnTypeInt}, {Name: "id", Type: ColumnTypeInt}},
+		{{Name: "id", Type: ColumnTypeInt}, {Name: "uid", Type: ColumnTypeInt}, {Name: "gold", Type: ColumnTypeInt}},
+	} {
+		_, err = DiffSchema(old, CreateFakeTableSchema(columns, 2))
+		require.Error(t, err)
+	}
+}
+
+func TestTable_ReloadSchema(t *testing.T) {
+	db, _ := newTestSQLite(t)
+	tsm := NewTableSchemaManager(db)
+	schema, err := tsm.LoadSchema("fake")
+	require.NoError(t, err)
+
+	tb := &Table{Schema: schema, rows: make([]TableRow, 16), m: make(map[string]int32, 16), initRowNum: 16}
+	for i, id := range []string{"1", "2"} {
+		fields := []string{"uid", "1", "id", id, "name", "n" + id, "gold", id}
+		require.Equal(t, int64(1), db.Insert(schema, "1", fields).Data)
+
+		row, _ := tb.HitRow(AssembleRowKey2(schema, []string{"1", id}))
+		row.Data = db.SelectSingle(schema, "1", []string{"1", id}).Data.([]byte)
+		row.State = TableRowStateValid
+		if i == 1 {
+			ok, msg := row.Update2(schema, []string{"name", "x"})
+			require.True(t, ok, msg)
+		}
+	}
+	missing, _ := tb.HitRow(AssembleRowKey2(schema, []string{"1", "3"}))
+	missing.State = TableRowStateNotExist
+
+	_, err = db.Exec("ALTER TABLE fake ADD COLUMN exp INT NOT NULL DEFAULT 7")
+	require.NoError(t, err)
+	_, err = db.Exec("ALTER TABLE fake ADD COLUMN note TEXT")
+	require.NoError(t, err)
+	schema2, err := tsm.ReloadSchema("fake", false)
+	require.NoError(t, err)
+
+	tb2, n := tb.ReloadSchema(schema2)
+	require.Same(t, tb, tb2)
+	require.Zero(t, n)
+	require.Same(t, schema2, tb.Schema)
+
+	row, _ := tb.HitRow(AssembleRowKey2(schema2, []string{"1", "2"}))
+	fields := RowData2Map(schema2, row.Data)
+	require.Equal(t, "x", fields["name"])
+	require.Equal(t, "7", fields["exp"])
+	note := schema2.GetColumnSchema("note")
+	require.True(t, note.DefaultNull)
+	require.True(t, IsNullByIndex(schema2, row.Data, note.Index))
+	row, _ = tb.HitRow(AssembleRowKey2(schema2, []string{"1", "1"}))
+	require.Equal(t, RowData2Map(schema2, db.SelectSingle(schema2, "1", []string{"1", "1"}).Data.([]byte)),
+		RowData2Map(schema2, row.Data))
+	row, _ = tb.HitRow(AssembleRowKey2(schema2, []string{"1", "3"}))
+	require.Equal(t, TableRowStateNotExist, row.State)
+
+	//a pending request keeps the old rows, a new table is used
+	tb.NumDBReq = 1
+	_, err = db.Exec("ALTER TABLE fake ADD COLUMN lv INT NOT NULL DEFAULT 1")
+	require.NoError(t, err)
+	schema3, err := tsm.ReloadSchema("fake", false)
+	require.NoError(t, err)
+	tb3, n := tb.ReloadSchema(schema3)
+	require.NotSame(t, tb, tb3)
+	require.Equal(t, int32(3), n)
+	require.True(t, tb.Outdated)
+}
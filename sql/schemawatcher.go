@@ -0,0 +1,205 @@
+package sql
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SchemaChecksummer 可以低成本得到表结构校验和的Driver实现该接口；
+// 没有实现时SchemaWatcher用LoadTableSchemaContext的结果计算
+type SchemaChecksummer interface {
+	SchemaChecksum(ctx context.Context, tableName string) (uint64, error)
+}
+
+// SchemaChange SchemaWatcher发现的表结构变化。ReloadSchema失败时(例如主键改变)Err不为nil，New和Diff为nil，
+// 同一个校验和只通知一次
+type SchemaChange struct {
+	Name string
+	Old  *TableSchema
+	New  *TableSchema
+	Diff *SchemaDiff
+	Err  error
+}
+
+// SchemaWatcher 定期检查TableSchemaManager中已经加载的所有表，表结构改变时调用ReloadSchema并通知订阅者。
+// 回调在watcher的goroutine中执行，Table不是并发安全的，订阅者需要把变化转交给使用Table的goroutine
+// 再调用Table.ReloadSchema
+type SchemaWatcher struct {
+	//mu 保证同时只有一个Check
+	mu          sync.Mutex
+	tsm         *TableSchemaManager
+	interval    time.Duration
+	checksums   map[string]uint64
+	subMu       sync.RWMutex
+	subscribers []func(*SchemaChange)
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func NewSchemaWatcher(tsm *TableSchemaManager, interval time.Duration) *SchemaWatcher {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	return &SchemaWatcher{
+		tsm:       tsm,
+		interval:  interval,
+		checksums: make(map[string]uint64),
+	}
+}
+
+func (sw *SchemaWatcher) Subscribe(fn func(*SchemaChange)) {
+	sw.subMu.Lock()
+	sw.subscribers = append(sw.subscribers, fn)
+	sw.subMu.Unlock()
+}
+
+// Run 启动后台的定期检查，第一次检查只记录校验和
+func (sw *SchemaWatcher) Run() {
+	//goroutine使用局部变量，Stop会清空sw.stop
+	stop, done := make(chan struct{}), make(chan struct{})
+	sw.stop, sw.done = stop, done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(sw.interval)
+		defer ticker.Stop()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		_ = sw.Check(ctx)
+		for {
+			select {
+			case <-ticker.C:
+				_ = sw.Check(ctx)
+
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止检查，等待正在进行的检查结束
+func (sw *SchemaWatcher) Stop() {
+	if sw.stop == nil {
+		return
+	}
+
+	close(sw.stop)
+	<-sw.done
+	sw.stop = nil
+}
+
+// Check 检查一次所有已经加载的表，返回读取校验和或者ReloadSchema的错误；
+// 第一次见到的表只记录校验和
+func (sw *SchemaWatcher) Check(ctx context.Context) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	var errs []error
+	for _, name := range sw.tsm.names() {
+		checksum, err := sw.checksum(ctx, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		prev, ok := sw.checksums[name]
+		sw.checksums[name] = checksum
+		if !ok || prev == checksum {
+			continue
+		}
+
+		change := &SchemaChange{Name: name}
+		change.Old, _ = sw.tsm.LoadSchema(name)
+		change.New, change.Err = sw.tsm.ReloadSchema(name, false)
+		if change.Err != nil {
+			errs = append(errs, change.Err)
+
+		} else if change.New == nil {
+			//校验和包含了TableSchema不关心的变化(例如INT改为BIGINT)
+			continue
+
+		} else {
+			change.Diff, change.Err = DiffSchema(change.Old, change.New)
+		}
+
+		sw.notify(change)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (sw *SchemaWatcher) notify(change *SchemaChange) {
+	sw.subMu.RLock()
+	subscribers := sw.subscribers
+	sw.subMu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(change)
+	}
+}
+
+func (sw *SchemaWatcher) checksum(ctx context.Context, name string) (uint64, error) {
+	if checksummer, ok := sw.tsm.driver.(SchemaChecksummer); ok {
+		return checksummer.SchemaChecksum(ctx, name)
+	}
+
+	schema, err := sw.tsm.driver.LoadTableSchemaContext(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	return schemaChecksum(schema), nil
+}
+
+// schemaChecksum TableSchema中与缓存的行数据有关的部分的校验和
+func schemaChecksum(schema *TableSchema) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for i := range schema.Columns {
+		cs := &schema.Columns[i]
+		h.Write([]byte(cs.Name))
+		h.Write([]byte{0, byte(cs.Type)})
+		if cs.IsPrimaryKey {
+			h.Write([]byte{1})
+		}
+		h.Write([]byte(cs.DefaultValue))
+		h.Write([]byte{0})
+	}
+
+	for _, i := range schema.AutoMTimeFields {
+		binary.LittleEndian.PutUint64(buf[:], uint64(i))
+		h.Write(buf[:])
+	}
+
+	return h.Sum64()
+}
+
+// names 已经加载的表，按名字排序
+func (tsm *TableSchemaManager) names() []string {
+	tsm.RLock()
+	names := make([]string, 0, len(tsm.schemas))
+	for name := range tsm.schemas {
+		names = append(names, name)
+	}
+	tsm.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,71 @@
+package sql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaWatcher(t *testing.T) {
+	db, _ := newTestSQLite(t)
+	tsm := NewTableSchemaManager(db)
+	schema, err := tsm.LoadSchema("fake")
+	require.NoError(t, err)
+
+	var changes []*SchemaChange
+	sw := NewSchemaWatcher(tsm, time.Hour)
+	sw.Subscribe(func(change *SchemaChange) {
+		changes = append(changes, change)
+	})
+
+	//the first check only records the checksums
+	ctx := context.Background()
+	require.NoError(t, sw.Check(ctx))
+	require.NoError(t, sw.Check(ctx))
+	require.Empty(t, changes)
+
+	_, err = db.Exec("ALTER TABLE fake ADD COLUMN exp INT NOT NULL DEFAULT 0")
+	require.NoError(t, err)
+	require.NoError(t, sw.Check(ctx))
+	require.Len(t, changes, 1)
+	require.Equal(t, "fake", changes[0].Name)
+	require.Same(t, schema, changes[0].Old)
+	require.Equal(t, []string{"exp"}, changes[0].Diff.Added)
+	current, _ := tsm.LoadSchema("fake")
+	require.Same(t, current, changes[0].New)
+
+	//unchanged tables are not reloaded again
+	require.NoError(t, sw.Check(ctx))
+	require.Len(t, changes, 1)
+}
+
+func TestSchemaWatcher_Run(t *testing.T) {
+	db, _ := newTestSQLite(t)
+	tsm := NewTableSchemaManager(db)
+	_, err := tsm.LoadSchema("fake")
+	require.NoError(t, err)
+
+	ch := make(chan *SchemaChange, 1)
+	sw := NewSchemaWatcher(tsm, 10*time.Millisecond)
+	sw.Subscribe(func(change *SchemaChange) {
+		ch <- change
+	})
+	sw.Run()
+	defer sw.Stop()
+
+	//wait for the first check
+	time.Sleep(30 * time.Millisecond)
+	_, err = db.Exec("ALTER TABLE fake ADD COLUMN exp INT NOT NULL DEFAULT 0")
+	require.NoError(t, err)
+
+	select {
+	case change := <-ch:
+		require.NoError(t, change.Err)
+		require.Len(t, change.New.Columns, 5)
+
+	case <-time.After(time.Second):
+		require.Fail(t, "schema change not detected")
+	}
+}
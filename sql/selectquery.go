@@ -0,0 +1,429 @@
+package sql
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SelectQuery SelectMulti的查询条件，nil表示返回shard的所有行。
+// 返回的行仍然是完整schema的格式，Columns之外的列为空(读取时为默认值)，主键列总是返回；
+// 排序、After和Limit/Offset按OrderBy的列加上主键排序，保证顺序确定；
+// 与MySQL一样NULL排在最前(Desc时最后)，字符串按列的排序规则(Collation)比较
+type SelectQuery struct {
+	Where  string
+	Params []string
+	//投影的列，空表示所有列
+	Columns []string
+	OrderBy []OrderBy
+	Limit   int
+	Offset  int
+	//游标，上一页最后一行的Cursor，只返回排在它之后的行；NULL的列为NullValue
+	After []string
+}
+
+type OrderBy struct {
+	Column string
+	Desc   bool
+}
+
+// sortKey 排序使用的列：OrderBy的列，之后是没有出现在OrderBy中的主键
+type sortKey struct {
+	idx        int
+	columnType ColumnType
+	collation  Collation
+	desc       bool
+}
+
+// selectPlan 按schema检查并转换后的SelectQuery
+type selectPlan struct {
+	query   *SelectQuery
+	parser  *Parser
+	keys    []sortKey
+	columns []bool
+	after   []exprValue
+}
+
+// ordered 是否需要排序，只有Where和Columns时保持原来的顺序
+func (q *SelectQuery) ordered() bool {
+	return len(q.OrderBy) > 0 || q.Limit > 0 || q.Offset > 0 || len(q.After) > 0
+}
+
+// Cursor 返回rowData在查询顺序中的位置，作为下一页的After
+func (q *SelectQuery) Cursor(schema *TableSchema, rowData []byte) []string {
+	keys, err := q.sortKeys(schema)
+	if err != nil || rowData == nil {
+		return nil
+	}
+
+	cursor := make([]string, len(keys))
+	for i, key := range keys {
+		value, null := GetNullableValueByIndex(schema, rowData, key.idx)
+		if null {
+			cursor[i] = NullValue
+		} else {
+			cursor[i] = value
+		}
+	}
+
+	return cursor
+}
+
+func (q *SelectQuery) sortKeys(schema *TableSchema) ([]sortKey, error) {
+	keys := make([]sortKey, 0, len(q.OrderBy)+schema.NumPrimaryKeys)
+	for _, ob := range q.OrderBy {
+		column := schema.GetColumnSchema(ob.Column)
+		if column == nil {
+			return nil, fmt.Errorf("invalid column: %s", ob.Column)
+		}
+
+		keys = append(keys, sortKey{idx: column.Index, columnType: column.Type, collation: column.Collation, desc: ob.Desc})
+	}
+
+	for i := 0; i < schema.NumPrimaryKeys; i++ {
+		column := &schema.Columns[schema.primaryKeyIndex(i)]
+		found := false
+		for _, key := range keys {
+			if key.idx == column.Index {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			keys = append(keys, sortKey{idx: column.Index, columnType: column.Type, collation: column.Collation})
+		}
+	}
+
+	return keys, nil
+}
+
+func (q *SelectQuery) plan(schema *TableSchema, shard string) (*selectPlan, error) {
+	if q.Limit < 0 || q.Offset < 0 {
+		return nil, fmt.Errorf("invalid limit: %d, %d", q.Limit, q.Offset)
+	}
+
+	sp := &selectPlan{query: q}
+	if len(q.Columns) > 0 {
+		sp.columns = make([]bool, len(schema.Columns))
+		for _, name := range q.Columns {
+			column := schema.GetColumnSchema(name)
+			if column == nil {
+				return nil, fmt.Errorf("invalid column: %s", name)
+			}
+			sp.columns[column.Index] = true
+		}
+
+		for i := range schema.Columns {
+			if schema.Columns[i].IsPrimaryKey {
+				sp.columns[i] = true
+			}
+		}
+	}
+
+	keys, err := q.sortKeys(schema)
+	if err != nil {
+		return nil, err
+	}
+	sp.keys = keys
+
+	if len(q.After) > 0 {
+		if len(q.After) != len(keys) {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+
+		sp.after = make([]exprValue, len(keys))
+		for i, key := range keys {
+			if q.After[i] == NullValue {
+				sp.after[i] = exprValue{null: true}
+			} else {
+				sp.after[i] = columnValue(q.After[i], key.columnType, key.collation)
+			}
+		}
+	}
+
+	if q.Where != "" {
+		if sp.parser, err = CreateParser(schema, shard, q.Where, q.Params); err != nil {
+			return nil, err
+		}
+	}
+
+	return sp, nil
+}
+
+// compare 按排序的列比较两行，desc的列反向
+func (sp *selectPlan) compare(schema *TableSchema, row1 []byte, row2 []byte) int {
+	for _, key := range sp.keys {
+		if c := sp.compareKey(key, sortValue(schema, row1, key), sortValue(schema, row2, key)); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+func sortValue(schema *TableSchema, rowData []byte, key sortKey) exprValue {
+	value, null := rowValue(schema, rowData, key.idx)
+	if null {
+		return exprValue{null: true}
+	}
+
+	return columnValue(value, key.columnType, key.collation)
+}
+
+// compareKey NULL小于其他值
+func (sp *selectPlan) compareKey(key sortKey, v1 exprValue, v2 exprValue) int {
+	var c int
+	switch {
+	case v1.null && v2.null:
+		c = 0
+	case v1.null:
+		c = -1
+	case v2.null:
+		c = 1
+	default:
+		c, _ = compareValue(v1, v2)
+	}
+
+	if key.desc {
+		return -c
+	}
+
+	return c
+}
+
+// afterCursor 行是否排在游标之后
+func (sp *selectPlan) afterCursor(schema *TableSchema, rowData []byte) bool {
+	for i, key := range sp.keys {
+		if c := sp.compareKey(key, sortValue(schema, rowData, key), sp.after[i]); c != 0 {
+			return c > 0
+		}
+	}
+
+	return false
+}
+
+// apply 在内存中执行查询，rows不会被修改
+func (sp *selectPlan) apply(schema *TableSchema, rows [][]byte) [][]byte {
+	q := sp.query
+	ret := make([][]byte, 0, len(rows))
+	for _, rowData := range rows {
+		if sp.parser != nil && !sp.parser.Check(rowData) {
+			continue
+		}
+
+		if sp.after != nil && !sp.afterCursor(schema, rowData) {
+			continue
+		}
+
+		ret = append(ret, rowData)
+	}
+
+	if q.ordered() {
+		sort.SliceStable(ret, func(i, j int) bool {
+			return sp.compare(schema, ret[i], ret[j]) < 0
+		})
+	}
+
+	if q.Offset > 0 {
+		if q.Offset >= len(ret) {
+			ret = ret[:0]
+		} else {
+			ret = ret[q.Offset:]
+		}
+	}
+
+	if q.Limit > 0 && len(ret) > q.Limit {
+		ret = ret[:q.Limit]
+	}
+
+	if sp.columns != nil {
+		for i, rowData := range ret {
+			ret[i] = sp.project(schema, rowData)
+		}
+	}
+
+	return ret
+}
+
+// project 只保留投影的列
+func (sp *selectPlan) project(schema *TableSchema, rowData []byte) []byte {
+	fieldData := make([][]byte, len(schema.Columns))
+	nulls := make([]bool, len(schema.Columns))
+	for i, selected := range sp.columns {
+		if selected {
+			value, null := GetNullableValueByIndex(schema, rowData, i)
+			fieldData[i], nulls[i] = []byte(value), null
+		}
+	}
+
+	return NewNullableRowData(schema, fieldData, nulls)
+}
+
+// writeSql 生成查询语句，按照投影只选择需要的列，返回追加了参数的params
+func (sp *selectPlan) writeSql(builder *strings.Builder, schema *TableSchema, params []interface{}) []interface{} {
+	q := sp.query
+	builder.WriteString("SELECT")
+	sign := " `"
+	for i := range schema.Columns {
+		if sp.columns != nil && !sp.columns[i] {
+			continue
+		}
+
+		builder.WriteString(sign)
+		builder.WriteString(schema.Columns[i].Name)
+		builder.WriteByte('`')
+		sign = ",`"
+	}
+
+	builder.WriteString(" FROM ")
+	builder.WriteString(schema.tableName)
+	builder.WriteString(" WHERE `")
+	builder.WriteString(schema.ShardKey)
+	builder.WriteString("`=?")
+
+	if q.Where != "" {
+		builder.WriteString(" AND (")
+		builder.WriteString(q.Where)
+		builder.WriteByte(')')
+		for _, param := range q.Params {
+			params = append(params, param)
+		}
+	}
+
+	//(k0>?) OR (k0=? AND k1>?) OR ...，desc的列使用<
+	if len(q.After) > 0 {
+		builder.WriteString(" AND (")
+		n := 0
+		for i, key := range sp.keys {
+			//desc时NULL排在最后，游标为NULL的列没有排在它之后的值
+			if key.desc && q.After[i] == NullValue {
+				continue
+			}
+
+			if n > 0 {
+				builder.WriteString(" OR ")
+			}
+			n++
+
+			builder.WriteByte('(')
+			for j := 0; j < i; j++ {
+				params = sp.writeCursorKey(builder, schema, j, "=", params)
+				builder.WriteString(" AND ")
+			}
+
+			if key.desc {
+				params = sp.writeCursorKey(builder, schema, i, "<", params)
+			} else {
+				params = sp.writeCursorKey(builder, schema, i, ">", params)
+			}
+			builder.WriteByte(')')
+		}
+
+		if n == 0 {
+			builder.WriteString("1=0")
+		}
+		builder.WriteByte(')')
+	}
+
+	if q.ordered() {
+		builder.WriteString(" ORDER BY")
+		sign = " `"
+		for _, key := range sp.keys {
+			builder.WriteString(sign)
+			builder.WriteString(schema.Columns[key.idx].Name)
+			builder.WriteByte('`')
+			if key.desc {
+				builder.WriteString(" DESC")
+			}
+			sign = ",`"
+		}
+	}
+
+	if q.Limit > 0 || q.Offset > 0 {
+		//OFFSET必须跟在LIMIT之后
+		limit := q.Limit
+		if limit == 0 {
+			limit = maxSelectLimit
+		}
+
+		builder.WriteString(" LIMIT ")
+		builder.WriteString(strconv.Itoa(limit))
+		if q.Offset > 0 {
+			builder.WriteString(" OFFSET ")
+			builder.WriteString(strconv.Itoa(q.Offset))
+		}
+	}
+
+	return params
+}
+
+// writeCursorKey 写入第i个排序列与游标的比较，NULL排在最前：
+// 游标为NULL时=写为IS NULL，>写为IS NOT NULL；<包含NULL
+func (sp *selectPlan) writeCursorKey(builder *strings.Builder, schema *TableSchema, i int, op string,
+	params []interface{}) []interface{} {
+	name := schema.Columns[sp.keys[i].idx].Name
+	value := sp.query.After[i]
+	if value == NullValue {
+		builder.WriteByte('`')
+		builder.WriteString(name)
+		if op == "=" {
+			builder.WriteString("` IS NULL")
+		} else {
+			builder.WriteString("` IS NOT NULL")
+		}
+		return params
+	}
+
+	if op == "<" {
+		builder.WriteString("(`")
+		builder.WriteString(name)
+		builder.WriteString("`<? OR `")
+		builder.WriteString(name)
+		builder.WriteString("` IS NULL)")
+	} else {
+		builder.WriteByte('`')
+		builder.WriteString(name)
+		builder.WriteString("`")
+		builder.WriteString(op)
+		builder.WriteByte('?')
+	}
+
+	return append(params, value)
+}
+
+// maxSelectLimit 只有Offset时的LIMIT
+const maxSelectLimit = 1<<31 - 1
+
+// Select 从完整加载的shard中查询，ti的状态不是TableRowStateValid时返回false，需要查询数据库
+func (ti *TableRowIndex) Select(table *Table, query *SelectQuery) ([][]byte, bool, error) {
+	if ti.State != TableRowStateValid {
+		return nil, false, nil
+	}
+
+	rows := ti.rows(table)
+	if query == nil {
+		return rows, true, nil
+	}
+
+	sp, err := query.plan(table.Schema, ti.ShardKey)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return sp.apply(table.Schema, rows), true, nil
+}
+
+// rows shard中存在的行
+func (ti *TableRowIndex) rows(table *Table) [][]byte {
+	rows := make([][]byte, 0, len(ti.Idxes))
+	for _, i := range ti.Idxes {
+		row := table.GetRowByIdx(i)
+		if row.State == TableRowStateValid && row.Data != nil {
+			rows = append(rows, row.Data)
+		}
+	}
+
+	return rows
+}
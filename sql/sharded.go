@@ -0,0 +1,736 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+
+	"go-learner/slice"
+)
+
+type ShardType uint8
+
+const (
+	// ShardTypeHash 整数shard值对分表数取模，字符串取crc32后取模
+	ShardTypeHash ShardType = iota
+	// ShardTypeRange 按Bounds划分整数shard值的区间
+	ShardTypeRange
+)
+
+// ShardRule 一个逻辑表的分表规则，第i个分表的实际表名为 Tables[i].Database.<逻辑表名>_i
+type ShardRule struct {
+	Type ShardType
+	// HintField 分表使用的列，为空时使用TableSchema默认的ShardKey
+	HintField string
+	// Bounds ShardTypeRange时第i个分表保存 Bounds[i-1] <= shard < Bounds[i] 的数据，长度与Tables相同
+	Bounds []int64
+	Tables []ShardTable
+}
+
+type ShardTable struct {
+	ServerId int
+	Database string
+}
+
+// ShardedMySql 按TableSchema.ShardKey的值把请求路由到不同MySql连接池的库表上，布局与DBProxy的
+// server_info/table_info/split_table_info一致；LoadTableSchema返回逻辑表的schema，执行时替换为分表的schema
+type ShardedMySql struct {
+	sync.RWMutex
+
+	servers map[int]*MySql
+	rules   map[string]*ShardRule
+	//逻辑表schema对应的各分表schema
+	shards map[*TableSchema][]*TableSchema
+}
+
+// shardedTx 事务在第一个请求所在的server上开启，不支持跨server的事务
+type shardedTx struct {
+	db       *ShardedMySql
+	ctx      context.Context
+	serverId int
+	tx       Tx
+}
+
+func NewShardedMySql() *ShardedMySql {
+	return &ShardedMySql{
+		servers: make(map[int]*MySql),
+		rules:   make(map[string]*ShardRule),
+		shards:  make(map[*TableSchema][]*TableSchema),
+	}
+}
+
+// NewShardedMySqlFromDBProxy 从DBProxy的配置库读取server和分表信息
+func NewShardedMySqlFromDBProxy(proxy *MySql) (*ShardedMySql, error) {
+	db := NewShardedMySql()
+	rows, err := proxy.Query("SELECT server_id, host, port, user, passwd, timeout FROM server_info")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		serverId, err := strconv.Atoi(slice.ByteSlice2String(row[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid server_id: %s", row[0])
+		}
+
+		url := fmt.Sprintf("%s:%s@tcp(%s:%s)/?timeout=%ss", row[3], row[4], row[1], row[2], row[5])
+		server := NewMySql(url)
+		if server == nil {
+			return nil, fmt.Errorf("open server %d failed", serverId)
+		}
+
+		db.AddServer(serverId, server)
+	}
+
+	rows, err = proxy.Query("SELECT table_name, split_type, table_count, hint_field FROM table_info")
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make(map[string]*ShardRule, len(rows))
+	for _, row := range rows {
+		name := string(row[0])
+		splitType, _ := strconv.Atoi(slice.ByteSlice2String(row[1]))
+		if splitType != int(ShardTypeHash) {
+			//table_info中没有区间信息，按区间分表需要通过AddTable设置
+			return nil, fmt.Errorf("table %s: nonsupport split type %d", name, splitType)
+		}
+
+		count, err := strconv.Atoi(slice.ByteSlice2String(row[2]))
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("table %s: invalid table_count %s", name, row[2])
+		}
+
+		rules[name] = &ShardRule{
+			Type:      ShardTypeHash,
+			HintField: string(row[3]),
+			Tables:    make([]ShardTable, count),
+		}
+	}
+
+	rows, err = proxy.Query("SELECT table_name, table_number, server_id, database_name FROM split_table_info")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		name := slice.ByteSlice2String(row[0])
+		rule, ok := rules[name]
+		if !ok {
+			continue
+		}
+
+		i, err := strconv.Atoi(slice.ByteSlice2String(row[1]))
+		if err != nil || i < 0 || i >= len(rule.Tables) {
+			return nil, fmt.Errorf("table %s: invalid table_number %s", name, row[1])
+		}
+
+		serverId, err := strconv.Atoi(slice.ByteSlice2String(row[2]))
+		if err != nil {
+			return nil, fmt.Errorf("table %s: invalid server_id %s", name, row[2])
+		}
+
+		rule.Tables[i] = ShardTable{ServerId: serverId, Database: string(row[3])}
+	}
+
+	for name, rule := range rules {
+		if err := db.AddTable(name, rule); err != nil {
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+func (db *ShardedMySql) AddServer(serverId int, server *MySql) {
+	db.Lock()
+	db.servers[serverId] = server
+	db.Unlock()
+}
+
+// AddTable 设置逻辑表的分表规则，需要在LoadTableSchema之前调用
+func (db *ShardedMySql) AddTable(name string, rule *ShardRule) error {
+	n := len(rule.Tables)
+	if n == 0 {
+		return fmt.Errorf("table %s: no shard table", name)
+	}
+
+	if rule.Type == ShardTypeRange {
+		if len(rule.Bounds) != n {
+			return fmt.Errorf("table %s: bounds not match shard tables", name)
+		}
+
+		if !sort.SliceIsSorted(rule.Bounds, func(i, j int) bool { return rule.Bounds[i] < rule.Bounds[j] }) {
+			return fmt.Errorf("table %s: bounds must be ascending", name)
+		}
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	for i := range rule.Tables {
+		if rule.Tables[i].Database == "" {
+			return fmt.Errorf("table %s: shard %d not configured", name, i)
+		}
+
+		if _, ok := db.servers[rule.Tables[i].ServerId]; !ok {
+			return fmt.Errorf("table %s: not found server %d", name, rule.Tables[i].ServerId)
+		}
+	}
+
+	db.rules[name] = rule
+	return nil
+}
+
+// shardTableName 第i个分表带库名的实际表名
+func shardTableName(rule *ShardRule, name string, i int) string {
+	return fmt.Sprintf("`%s`.`%s_%d`", rule.Tables[i].Database, name, i)
+}
+
+// index 返回shard值所在的分表
+func (rule *ShardRule) index(shard string, isString bool) (int, error) {
+	n := len(rule.Tables)
+	if rule.Type == ShardTypeHash && isString {
+		return int(crc32.ChecksumIEEE(slice.String2ByteSlice(shard)) % uint32(n)), nil
+	}
+
+	v, err := strconv.ParseInt(shard, 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("invalid shard value: %s", shard)
+	}
+
+	if rule.Type == ShardTypeHash {
+		i := v % int64(n)
+		if i < 0 {
+			i += int64(n)
+		}
+		return int(i), nil
+	}
+
+	i := sort.Search(n, func(i int) bool { return v < rule.Bounds[i] })
+	if i == n {
+		return -1, fmt.Errorf("shard value out of range: %s", shard)
+	}
+
+	return i, nil
+}
+
+func (db *ShardedMySql) LoadTableSchema(tableName string) (*TableSchema, error) {
+	return db.LoadTableSchemaContext(context.Background(), tableName)
+}
+
+// LoadTableSchemaContext 以第0个分表的结构为准；返回的schema在InstallSchema之后才能路由，
+// TableSchemaManager安装schema时会调用，ReloadSchema丢弃的schema不会留在shards中
+func (db *ShardedMySql) LoadTableSchemaContext(ctx context.Context, tableName string) (*TableSchema, error) {
+	db.RLock()
+	rule, ok := db.rules[tableName]
+	var server *MySql
+	if ok {
+		server = db.servers[rule.Tables[0].ServerId]
+	}
+	db.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("table %s has no shard rule", tableName)
+	}
+
+	schema, err := server.LoadTableSchemaContext(ctx, shardTableName(rule, tableName, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := logicalSchema(tableName, schema, rule); err != nil {
+		return nil, err
+	}
+
+	return schema, nil
+}
+
+// SchemaChecksum 实现SchemaChecksummer，与LoadTableSchemaContext一样以第0个分表的结构为准
+func (db *ShardedMySql) SchemaChecksum(ctx context.Context, tableName string) (uint64, error) {
+	db.RLock()
+	rule, ok := db.rules[tableName]
+	var server *MySql
+	if ok {
+		server = db.servers[rule.Tables[0].ServerId]
+	}
+	db.RUnlock()
+
+	if !ok {
+		return 0, fmt.Errorf("table %s has no shard rule", tableName)
+	}
+
+	return server.columnsChecksum(ctx, rule.Tables[0].Database, fmt.Sprintf("%s_0", tableName))
+}
+
+// logicalSchema 把加载的分表结构转为逻辑表的schema
+func logicalSchema(tableName string, schema *TableSchema, rule *ShardRule) error {
+	schema.Name = tableName
+	if rule.HintField != "" && rule.HintField != schema.ShardKey {
+		column := schema.GetColumnSchema(rule.HintField)
+		if column == nil || !column.IsPrimaryKey {
+			return fmt.Errorf("table %s: hint field %s is not a primary key", tableName, rule.HintField)
+		}
+
+		schema.ShardKey = column.Name
+		schema.ShardIndex = column.Index
+	}
+	schema.IsStringShardKey = schema.Columns[schema.ShardIndex].Type == ColumnTypeString
+	schema.initClauses(shardTableName(rule, tableName, 0))
+
+	return nil
+}
+
+// InstallSchema 实现SchemaInstaller，注册TableSchemaManager使用的schema
+func (db *ShardedMySql) InstallSchema(schema *TableSchema) {
+	db.RLock()
+	rule := db.rules[schema.Name]
+	db.RUnlock()
+
+	if rule != nil {
+		db.addSchema(schema, rule)
+	}
+}
+
+// addSchema 生成逻辑表schema对应的各分表schema
+func (db *ShardedMySql) addSchema(schema *TableSchema, rule *ShardRule) {
+	n := len(rule.Tables)
+	shards := make([]*TableSchema, n)
+	for i := 0; i < n; i++ {
+		shard := *schema
+		shard.initClauses(shardTableName(rule, schema.Name, i))
+		shards[i] = &shard
+	}
+
+	db.Lock()
+	db.shards[schema] = shards
+	db.Unlock()
+}
+
+// shardSynced 分表schema的版本列和二进制编码与逻辑表相同
+func shardSynced(shard *TableSchema, schema *TableSchema) bool {
+	return shard.VersionColumn == schema.VersionColumn && shard.binaryFormat == schema.binaryFormat
+}
+
+// route 返回shard所在的server和分表的schema
+func (db *ShardedMySql) route(schema *TableSchema, shard string) (int, *MySql, *TableSchema, error) {
+	db.RLock()
+	shards, ok := db.shards[schema]
+	rule := db.rules[schema.Name]
+	if !ok || rule == nil {
+		db.RUnlock()
+		return 0, nil, nil, fmt.Errorf("table %s not loaded by sharded driver", schema.Name)
+	}
+
+	i, err := rule.index(shard, schema.IsStringShardKey)
+	if err != nil {
+		db.RUnlock()
+		return 0, nil, nil, err
+	}
+
+	serverId := rule.Tables[i].ServerId
+	server, schema2 := db.servers[serverId], shards[i]
+	synced := shardSynced(schema2, schema)
+	db.RUnlock()
+
+	if !synced {
+		if shards = db.syncShards(schema, rule); shards == nil {
+			return 0, nil, nil, fmt.Errorf("table %s not loaded by sharded driver", schema.Name)
+		}
+		schema2 = shards[i]
+	}
+
+	return serverId, server, schema2, nil
+}
+
+// syncShards 分表的schema在加载时复制，之后设置的版本列和二进制编码改变时重新复制各分表的schema；
+// 不修改旧的分表schema，其他请求可能正在使用，旧的schema缓存的预编译语句被清理
+func (db *ShardedMySql) syncShards(schema *TableSchema, rule *ShardRule) []*TableSchema {
+	db.Lock()
+	old := db.shards[schema]
+	if len(old) == 0 || shardSynced(old[0], schema) {
+		db.Unlock()
+		return old
+	}
+
+	shards := make([]*TableSchema, len(old))
+	for i, shard := range old {
+		synced := *shard
+		synced.VersionColumn = schema.VersionColumn
+		synced.versionIndex = schema.versionIndex
+		synced.binaryFormat = schema.binaryFormat
+		shards[i] = &synced
+	}
+	db.shards[schema] = shards
+
+	servers := make([]*MySql, len(old))
+	for i := range old {
+		servers[i] = db.servers[rule.Tables[i].ServerId]
+	}
+	db.Unlock()
+
+	for i, shard := range old {
+		if servers[i] != nil {
+			servers[i].InvalidateSchema(shard)
+		}
+	}
+
+	return shards
+}
+
+// InvalidateSchema 清理各分表schema在对应server上缓存的预编译语句
+func (db *ShardedMySql) InvalidateSchema(schema *TableSchema) {
+	db.Lock()
+	shards := db.shards[schema]
+	delete(db.shards, schema)
+	rule := db.rules[schema.Name]
+	db.Unlock()
+
+	if rule == nil {
+		return
+	}
+
+	for i, shard := range shards {
+		db.RLock()
+		server := db.servers[rule.Tables[i].ServerId]
+		db.RUnlock()
+
+		server.InvalidateSchema(shard)
+	}
+}
+
+// routeReply 路由失败是请求本身的问题，按SQL错误返回，不重试
+func routeReply(err error) *DBReply {
+	return &DBReply{Data: int64(0), Msg: err.Error()}
+}
+
+func (db *ShardedMySql) Insert(schema *TableSchema, shard string, fields []string) *DBReply {
+	return db.InsertContext(context.Background(), schema, shard, fields)
+}
+
+func (db *ShardedMySql) InsertContext(ctx context.Context, schema *TableSchema, shard string, fields []string) *DBReply {
+	_, server, schema2, err := db.route(schema, shard)
+	if err != nil {
+		return routeReply(err)
+	}
+
+	return server.InsertContext(ctx, schema2, shard, fields)
+}
+
+func (db *ShardedMySql) Upsert(schema *TableSchema, shard string, fields []string) *DBReply {
+	return db.UpsertContext(context.Background(), schema, shard, fields)
+}
+
+func (db *ShardedMySql) UpsertContext(ctx context.Context, schema *TableSchema, shard string, fields []string) *DBReply {
+	_, server, schema2, err := db.route(schema, shard)
+	if err != nil {
+		return routeReply(err)
+	}
+
+	return server.UpsertContext(ctx, schema2, shard, fields)
+}
+
+func (db *ShardedMySql) DeleteSingle(schema *TableSchema, shard string, keys []string) *DBReply {
+	return db.DeleteSingleContext(context.Background(), schema, shard, keys)
+}
+
+func (db *ShardedMySql) DeleteSingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string) *DBReply {
+	_, server, schema2, err := db.route(schema, shard)
+	if err != nil {
+		return routeReply(err)
+	}
+
+	return server.DeleteSingleContext(ctx, schema2, shard, keys)
+}
+
+func (db *ShardedMySql) UpdateSingle(schema *TableSchema, shard string, keys []string, fields []string) *DBReply {
+	return db.UpdateSingleContext(context.Background(), schema, shard, keys, fields)
+}
+
+func (db *ShardedMySql) UpdateSingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string, fields []string) *DBReply {
+	_, server, schema2, err := db.route(schema, shard)
+	if err != nil {
+		return routeReply(err)
+	}
+
+	return server.UpdateSingleContext(ctx, schema2, shard, keys, fields)
+}
+
+func (db *ShardedMySql) IncrBySingle(schema *TableSchema, shard string, keys []string, data *IncrByData) *DBReply {
+	return db.IncrBySingleContext(context.Background(), schema, shard, keys, data)
+}
+
+func (db *ShardedMySql) IncrBySingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string, data *IncrByData) *DBReply {
+	_, server, schema2, err := db.route(schema, shard)
+	if err != nil {
+		return routeReply(err)
+	}
+
+	return server.IncrBySingleContext(ctx, schema2, shard, keys, data)
+}
+
+func (db *ShardedMySql) SelectSingle(schema *TableSchema, shard string, keys []string) *DBReply {
+	return db.SelectSingleContext(context.Background(), schema, shard, keys)
+}
+
+func (db *ShardedMySql) SelectSingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string) *DBReply {
+	_, server, schema2, err := db.route(schema, shard)
+	if err != nil {
+		return routeReply(err)
+	}
+
+	return server.SelectSingleContext(ctx, schema2, shard, keys)
+}
+
+func (db *ShardedMySql) SelectMulti(schema *TableSchema, shard string, query *SelectQuery) *DBReply {
+	return db.SelectMultiContext(context.Background(), schema, shard, query)
+}
+
+func (db *ShardedMySql) SelectMultiContext(ctx context.Context, schema *TableSchema, shard string, query *SelectQuery) *DBReply {
+	_, server, schema2, err := db.route(schema, shard)
+	if err != nil {
+		return routeReply(err)
+	}
+
+	return server.SelectMultiContext(ctx, schema2, shard, query)
+}
+
+func (db *ShardedMySql) DeleteMulti(schema *TableSchema, shard string, data *MultiRequestData) *DBReply {
+	return db.DeleteMultiContext(context.Background(), schema, shard, data)
+}
+
+func (db *ShardedMySql) DeleteMultiContext(ctx context.Context, schema *TableSchema, shard string, data *MultiRequestData) *DBReply {
+	_, server, schema2, err := db.route(schema, shard)
+	if err != nil {
+		return routeReply(err)
+	}
+
+	return server.DeleteMultiContext(ctx, schema2, shard, data)
+}
+
+func (db *ShardedMySql) AggregateMulti(schema *TableSchema, shard string, query *AggregateQuery) *DBReply {
+	return db.AggregateMultiContext(context.Background(), schema, shard, query)
+}
+
+func (db *ShardedMySql) AggregateMultiContext(ctx context.Context, schema *TableSchema, shard string, query *AggregateQuery) *DBReply {
+	_, server, schema2, err := db.route(schema, shard)
+	if err != nil {
+		return routeReply(err)
+	}
+
+	return server.AggregateMultiContext(ctx, schema2, shard, query)
+}
+
+func (db *ShardedMySql) Batch(schema *TableSchema, cmd DBCommand, items []BatchItem) []*DBReply {
+	return db.BatchContext(context.Background(), schema, cmd, items)
+}
+
+// BatchContext 按分表拆分items，每个分表执行一次Batch
+func (db *ShardedMySql) BatchContext(ctx context.Context, schema *TableSchema, cmd DBCommand, items []BatchItem) []*DBReply {
+	replies := make([]*DBReply, len(items))
+	type shardBatch struct {
+		server  *MySql
+		items   []BatchItem
+		indexes []int
+	}
+
+	batches := make(map[*TableSchema]*shardBatch, 4)
+	order := make([]*TableSchema, 0, 4)
+	for i := range items {
+		_, server, schema2, err := db.route(schema, items[i].Shard)
+		if err != nil {
+			replies[i] = routeReply(err)
+			continue
+		}
+
+		b, ok := batches[schema2]
+		if !ok {
+			b = &shardBatch{server: server}
+			batches[schema2] = b
+			order = append(order, schema2)
+		}
+
+		b.items = append(b.items, items[i])
+		b.indexes = append(b.indexes, i)
+	}
+
+	for _, schema2 := range order {
+		b := batches[schema2]
+		ret := b.server.BatchContext(ctx, schema2, cmd, b.items)
+		for j, idx := range b.indexes {
+			replies[idx] = ret[j]
+		}
+	}
+
+	return replies
+}
+
+func (db *ShardedMySql) Begin() (Tx, error) {
+	return db.BeginContext(context.Background())
+}
+
+// BeginContext 直到第一个请求确定了server才真正开启事务
+func (db *ShardedMySql) BeginContext(ctx context.Context) (Tx, error) {
+	return &shardedTx{db: db, ctx: ctx}, nil
+}
+
+// executor 返回shard所在server上的事务，事务已经在其他server上开启时返回失败结果
+func (tx *shardedTx) executor(schema *TableSchema, shard string) (Executor, *TableSchema, *DBReply) {
+	serverId, server, schema2, err := tx.db.route(schema, shard)
+	if err != nil {
+		return nil, nil, routeReply(err)
+	}
+
+	if tx.tx == nil {
+		tx.tx, err = server.BeginContext(tx.ctx)
+		if err != nil {
+			return nil, nil, &DBReply{Data: int64(0), Err: err}
+		}
+
+		tx.serverId = serverId
+
+	} else if tx.serverId != serverId {
+		return nil, nil, &DBReply{
+			Data: int64(0),
+			Msg:  fmt.Sprintf("transaction across servers %d and %d is not supported", tx.serverId, serverId),
+		}
+	}
+
+	return tx.tx, schema2, nil
+}
+
+func (tx *shardedTx) Commit() error {
+	if tx.tx == nil {
+		return nil
+	}
+
+	return tx.tx.Commit()
+}
+
+func (tx *shardedTx) Rollback() error {
+	if tx.tx == nil {
+		return nil
+	}
+
+	return tx.tx.Rollback()
+}
+
+func (tx *shardedTx) Insert(schema *TableSchema, shard string, fields []string) *DBReply {
+	return tx.InsertContext(context.Background(), schema, shard, fields)
+}
+
+func (tx *shardedTx) InsertContext(ctx context.Context, schema *TableSchema, shard string, fields []string) *DBReply {
+	e, schema2, reply := tx.executor(schema, shard)
+	if reply != nil {
+		return reply
+	}
+
+	return e.InsertContext(ctx, schema2, shard, fields)
+}
+
+func (tx *shardedTx) Upsert(schema *TableSchema, shard string, fields []string) *DBReply {
+	return tx.UpsertContext(context.Background(), schema, shard, fields)
+}
+
+func (tx *shardedTx) UpsertContext(ctx context.Context, schema *TableSchema, shard string, fields []string) *DBReply {
+	e, schema2, reply := tx.executor(schema, shard)
+	if reply != nil {
+		return reply
+	}
+
+	return e.UpsertContext(ctx, schema2, shard, fields)
+}
+
+func (tx *shardedTx) DeleteSingle(schema *TableSchema, shard string, keys []string) *DBReply {
+	return tx.DeleteSingleContext(context.Background(), schema, shard, keys)
+}
+
+func (tx *shardedTx) DeleteSingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string) *DBReply {
+	e, schema2, reply := tx.executor(schema, shard)
+	if reply != nil {
+		return reply
+	}
+
+	return e.DeleteSingleContext(ctx, schema2, shard, keys)
+}
+
+func (tx *shardedTx) UpdateSingle(schema *TableSchema, shard string, keys []string, fields []string) *DBReply {
+	return tx.UpdateSingleContext(context.Background(), schema, shard, keys, fields)
+}
+
+func (tx *shardedTx) UpdateSingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string, fields []string) *DBReply {
+	e, schema2, reply := tx.executor(schema, shard)
+	if reply != nil {
+		return reply
+	}
+
+	return e.UpdateSingleContext(ctx, schema2, shard, keys, fields)
+}
+
+func (tx *shardedTx) IncrBySingle(schema *TableSchema, shard string, keys []string, data *IncrByData) *DBReply {
+	return tx.IncrBySingleContext(context.Background(), schema, shard, keys, data)
+}
+
+func (tx *shardedTx) IncrBySingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string, data *IncrByData) *DBReply {
+	e, schema2, reply := tx.executor(schema, shard)
+	if reply != nil {
+		return reply
+	}
+
+	return e.IncrBySingleContext(ctx, schema2, shard, keys, data)
+}
+
+func (tx *shardedTx) SelectSingle(schema *TableSchema, shard string, keys []string) *DBReply {
+	return tx.SelectSingleContext(context.Background(), schema, shard, keys)
+}
+
+func (tx *shardedTx) SelectSingleContext(ctx context.Context, schema *TableSchema, shard string, keys []string) *DBReply {
+	e, schema2, reply := tx.executor(schema, shard)
+	if reply != nil {
+		return reply
+	}
+
+	return e.SelectSingleContext(ctx, schema2, shard, keys)
+}
+
+func (tx *shardedTx) SelectMulti(schema *TableSchema, shard string, query *SelectQuery) *DBReply {
+	return tx.SelectMultiContext(context.Background(), schema, shard, query)
+}
+
+func (tx *shardedTx) SelectMultiContext(ctx context.Context, schema *TableSchema, shard string, query *SelectQuery) *DBReply {
+	e, schema2, reply := tx.executor(schema, shard)
+	if reply != nil {
+		return reply
+	}
+
+	return e.SelectMultiContext(ctx, schema2, shard, query)
+}
+
+func (tx *shardedTx) DeleteMulti(schema *TableSchema, shard string, data *MultiRequestData) *DBReply {
+	return tx.DeleteMultiContext(context.Background(), schema, shard, data)
+}
+
+func (tx *shardedTx) DeleteMultiContext(ctx context.Context, schema *TableSchema, shard string, data *MultiRequestData) *DBReply {
+	e, schema2, reply := tx.executor(schema, shard)
+	if reply != nil {
+		return reply
+	}
+
+	return e.DeleteMultiContext(ctx, schema2, shard, data)
+}
+
+func (tx *shardedTx) AggregateMulti(schema *TableSchema, shard string, query *AggregateQuery) *DBReply {
+	return tx.AggregateMultiContext(context.Background(), schema, shard, query)
+}
+
+func (tx *shardedTx) AggregateMultiContext(ctx context.Context, schema *TableSchema, shard string, query *AggregateQuery) *DBReply {
+	e, schema2, reply := tx.executor(schema, shard)
+	if reply != nil {
+		return reply
+	}
+
+	return e.AggregateMultiContext(ctx, schema2, shard, query)
+}
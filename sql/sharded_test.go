@@ -0,0 +1,99 @@
+package sql
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardRule_Index(t *testing.T) {
+	hash := &ShardRule{Type: ShardTypeHash, Tables: make([]ShardTable, 4)}
+	i, err := hash.index("10", false)
+	require.NoError(t, err)
+	require.Equal(t, 2, i)
+	i, err = hash.index("-3", false)
+	require.NoError(t, err)
+	require.Equal(t, 1, i)
+	_, err = hash.index("abc", false)
+	require.Error(t, err)
+
+	i, err = hash.index("abc", true)
+	require.NoError(t, err)
+	j, _ := hash.index("abc", true)
+	require.Equal(t, i, j)
+	require.True(t, i >= 0 && i < 4)
+
+	rng := &ShardRule{Type: ShardTypeRange, Bounds: []int64{100, 200, 300}, Tables: make([]ShardTable, 3)}
+	for shard, expected := range map[string]int{"-5": 0, "99": 0, "100": 1, "299": 2} {
+		i, err = rng.index(shard, false)
+		require.NoError(t, err)
+		require.Equal(t, expected, i, shard)
+	}
+	_, err = rng.index("300", false)
+	require.Error(t, err)
+}
+
+func TestShardedMySql_Route(t *testing.T) {
+	db := NewShardedMySql()
+	//只测试路由，不会访问数据库
+	db.AddServer(1, &MySql{sqlDriver: sqlDriver{stmts: newStmtCache()}})
+	db.AddServer(2, &MySql{sqlDriver: sqlDriver{stmts: newStmtCache()}})
+
+	tables := []ShardTable{{1, "db_0"}, {1, "db_1"}, {2, "db_2"}, {2, "db_3"}}
+	require.Error(t, db.AddTable("fake", &ShardRule{Tables: []ShardTable{{3, "db_0"}}}))
+	require.Error(t, db.AddTable("fake", &ShardRule{Type: ShardTypeRange, Bounds: []int64{2, 1}, Tables: tables[:2]}))
+	require.NoError(t, db.AddTable("fake", &ShardRule{Type: ShardTypeHash, HintField: "id", Tables: tables}))
+
+	schema := newTestSchema()
+	require.NoError(t, logicalSchema("fake", schema, db.rules["fake"]))
+	require.Equal(t, "id", schema.ShardKey)
+	require.Equal(t, 1, schema.ShardIndex)
+	//没有InstallSchema的schema不能路由
+	_, _, _, err := db.route(schema, "6")
+	require.Error(t, err)
+	require.Empty(t, db.shards)
+	db.InstallSchema(schema)
+
+	serverId, _, shard, err := db.route(schema, "6")
+	require.NoError(t, err)
+	require.Equal(t, 2, serverId)
+	require.True(t, strings.Contains(shard.selectSingle, "`db_2`.`fake_2`"), shard.selectSingle)
+	require.True(t, strings.Contains(shard.selectMulti, "`id`=?"), shard.selectMulti)
+
+	//版本列和二进制编码在加载之后设置，重新复制分表的schema，正在使用的旧schema不会被修改
+	require.NoError(t, schema.SetVersionColumn("gold"))
+	require.NoError(t, schema.SetBinaryEncoding(ColumnTypeInt))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, shard2, err := db.route(schema, "6")
+			require.NoError(t, err)
+			require.Equal(t, "gold", shard2.VersionColumn)
+			require.Equal(t, schema.versionIndex, shard2.versionIndex)
+			require.Equal(t, rowFormatBinaryInt, shard2.binaryFormat)
+		}()
+	}
+	require.Empty(t, shard.VersionColumn)
+	require.Zero(t, shard.binaryFormat)
+	wg.Wait()
+
+	_, _, _, err = db.route(schema, "x")
+	require.Error(t, err)
+	_, _, _, err = db.route(newTestSchema(), "1")
+	require.Error(t, err)
+
+	db.InvalidateSchema(schema)
+	_, _, _, err = db.route(schema, "6")
+	require.Error(t, err)
+	require.Empty(t, db.shards)
+
+	//SchemaWatcher通过SchemaChecksum检查分表结构，不再每次LoadTableSchema
+	var checksummer SchemaChecksummer = db
+	_, err = checksummer.SchemaChecksum(context.Background(), "unknown")
+	require.Error(t, err)
+}
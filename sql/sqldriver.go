@@ -0,0 +1,1236 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// dialect 不同数据库的语法差异，语句统一使用`引用列名、?作为参数占位符书写
+type dialect interface {
+	// rebind 把语句转换为数据库自身的语法
+	rebind(query string) string
+	// sqlError 是否为数据库返回的错误(而不是连接等错误)，是则返回错误信息
+	sqlError(err error) (string, bool)
+	// writeUpsert 写入主键冲突时更新fields中各列的子句
+	writeUpsert(builder *strings.Builder, schema *TableSchema, fields []string)
+	// rawScan 是否可以直接scan到sql.RawBytes，否则需要先转换为文本
+	rawScan() bool
+	// valuesDefault INSERT的VALUES中是否支持DEFAULT
+	valuesDefault() bool
+}
+
+// sqlDriver 基于database/sql的Driver公共实现，MySql和Postgres只负责加载表结构
+type sqlDriver struct {
+	db *sql.DB
+	//db或者事务中的tx
+	conn    sqlConn
+	tx      *sql.Tx
+	dialect dialect
+	stmts   *stmtCache
+}
+
+type sqlTx struct {
+	sqlDriver
+}
+
+// columnDesc 从数据库读取的列信息，用于生成TableSchema
+type columnDesc struct {
+	name         string
+	typeName     string
+	isPrimaryKey bool
+	defaultValue string
+	//可以为NULL并且没有默认值
+	defaultNull bool
+	autoMTime   bool
+	collation   Collation
+}
+
+// rowScanner 复用scan的缓冲区，返回的数据在下一次scan前有效；nulls为上一次scan中各列是否为NULL
+type rowScanner struct {
+	wrapper  []interface{}
+	rawBytes []sql.RawBytes
+	values   []textValue
+	fields   [][]byte
+	nulls    []bool
+}
+
+// textValue 把driver返回的各种类型统一转换为文本，NULL为nil，空值不为nil
+type textValue []byte
+
+func newSqlDriver(db *sql.DB, d dialect) sqlDriver {
+	return sqlDriver{
+		db:      db,
+		conn:    db,
+		dialect: d,
+		stmts:   newStmtCache(),
+	}
+}
+
+func (db *sqlDriver) Begin() (Tx, error) {
+	return db.BeginContext(context.Background())
+}
+
+// BeginContext ctx结束时database/sql会自动回滚事务
+func (db *sqlDriver) BeginContext(ctx context.Context) (Tx, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlTx{
+		sqlDriver: sqlDriver{
+			db:      db.db,
+			conn:    tx,
+			tx:      tx,
+			dialect: db.dialect,
+			stmts:   db.stmts,
+		},
+	}, nil
+}
+
+func (tx *sqlTx) Commit() error {
+	return tx.tx.Commit()
+}
+
+func (tx *sqlTx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+func newTableSchema(tableName string, descs []columnDesc) (*TableSchema, error) {
+	nFields := len(descs)
+	schema := &TableSchema{
+		Name:            tableName,
+		Columns:         make([]ColumnSchema, nFields),
+		m:               make(map[string]int, nFields),
+		AutoMTimeFields: make([]int, 0, 1),
+		parsers:         newParserCache(),
+	}
+
+	fieldSchemas := schema.Columns
+	nPrimary := 0
+	pkIndexes := make([]int, 0, 2)
+	bNoSortedKey := false
+	for i := 0; i < nFields; i++ {
+		desc := &descs[i]
+		category, isNumberType := ColumnNumberTypes[desc.typeName]
+		if !isNumberType {
+			var isTimeField bool
+			if category, isTimeField = ColumnTimeTypes[desc.typeName]; !isTimeField {
+				category = ColumnTypeString
+			}
+		}
+
+		field := &fieldSchemas[i]
+		field.Index = i
+		field.Name = desc.name
+		field.Type = category
+		field.IsNumber = isNumberType
+		field.Collation = desc.collation
+
+		if desc.autoMTime {
+			schema.AutoMTimeFields = append(schema.AutoMTimeFields, i)
+
+		} else {
+			field.DefaultValue = desc.defaultValue
+			field.DefaultNull = desc.defaultNull && !desc.isPrimaryKey
+		}
+
+		if desc.isPrimaryKey {
+			pkIndexes = append(pkIndexes, i)
+			if nPrimary != i {
+				bNoSortedKey = true
+				//return nil, fmt.Errorf("table: %s primary key MUST preposition", tableName)
+			}
+
+			nPrimary++
+			field.IsPrimaryKey = true
+		}
+
+		schema.m[desc.name] = i
+	}
+
+	if nPrimary == 0 {
+		return nil, fmt.Errorf("table: %s not found primary key", tableName)
+	}
+
+	schema.NumPrimaryKeys = nPrimary
+	//没有分表信息，默认使用第一个主键
+	shardIndex := 0
+	if bNoSortedKey {
+		schema.PrimaryKeyIndexes = pkIndexes
+		shardIndex = pkIndexes[0]
+	}
+
+	schema.ShardKey = schema.Columns[shardIndex].Name
+	schema.ShardIndex = shardIndex
+
+	schema.initClauses(tableName)
+	return schema, nil
+}
+
+// initClauses 生成缓存的语句，tableName为实际访问的表名
+func (ts *TableSchema) initClauses(tableName string) {
+	ts.tableName = tableName
+	var selectBuilder, whereBuilder strings.Builder
+	selectBuilder.WriteString("SELECT")
+	whereBuilder.WriteString(" WHERE")
+
+	selectLastWord := " `"
+	whereLastWord := " `"
+	for i := range ts.Columns {
+		fieldName := ts.Columns[i].Name
+		selectBuilder.WriteString(selectLastWord)
+		selectBuilder.WriteString(fieldName)
+		selectBuilder.WriteByte('`')
+		selectLastWord = ",`"
+	}
+
+	for i := 0; i < ts.NumPrimaryKeys; i++ {
+		whereBuilder.WriteString(whereLastWord)
+		whereBuilder.WriteString(ts.Columns[ts.primaryKeyIndex(i)].Name)
+		//string value need not wrap with ''
+		whereBuilder.WriteString("`=?")
+		whereLastWord = " AND `"
+	}
+
+	var updateBuilder, insertBuilder, deleteBuilder strings.Builder
+	whereClause := whereBuilder.String()
+	ts.whereSingleClause = whereClause
+
+	insertBuilder.WriteString("INSERT INTO ")
+	insertBuilder.WriteString(tableName)
+	ts.insertClause1 = insertBuilder.String()
+	ts.insertClause2 = " VALUES"
+
+	deleteBuilder.WriteString("DELETE FROM ")
+	deleteBuilder.WriteString(tableName)
+	deleteBuilder.WriteString(whereClause)
+	ts.deleteSingle = deleteBuilder.String()
+
+	updateBuilder.WriteString("UPDATE ")
+	updateBuilder.WriteString(tableName)
+	updateBuilder.WriteString(" SET")
+	ts.updatePrefix = updateBuilder.String()
+
+	selectBuilder.WriteString(" FROM ")
+	selectBuilder.WriteString(tableName)
+	if ts.NumPrimaryKeys == 1 {
+		selectBuilder.WriteString(whereClause)
+		ts.selectSingle = selectBuilder.String()
+
+	} else {
+		var selectMultiBuilder strings.Builder
+		selectMultiBuilder.WriteString(selectBuilder.String())
+		selectMultiBuilder.WriteString(" WHERE `")
+		selectMultiBuilder.WriteString(ts.ShardKey)
+		selectMultiBuilder.WriteString("`=?")
+		//selectMultiBuilder.WriteString("=? LIMIT ?")
+		//selectMultiBuilder.WriteString(strconv.Itoa(MaxMultiRowNum + 1))
+		ts.selectMulti = selectMultiBuilder.String()
+
+		selectBuilder.WriteString(whereClause)
+		ts.selectSingle = selectBuilder.String()
+
+		var deleteMultiBuilder strings.Builder
+		deleteMultiBuilder.WriteString("DELETE FROM ")
+		deleteMultiBuilder.WriteString(tableName)
+		deleteMultiBuilder.WriteString(" WHERE ")
+		ts.deleteMultiPrefix = deleteMultiBuilder.String()
+	}
+}
+
+// writeOnConflictUpsert 标准的upsert语法，Postgres和SQLite使用
+func writeOnConflictUpsert(builder *strings.Builder, schema *TableSchema, fields []string) {
+	builder.WriteString(" ON CONFLICT ")
+	var sign byte = '('
+	for i := 0; i < schema.NumPrimaryKeys; i++ {
+		builder.WriteByte(sign)
+		builder.WriteByte('`')
+		builder.WriteString(schema.Columns[schema.primaryKeyIndex(i)].Name)
+		builder.WriteByte('`')
+		sign = ','
+	}
+	builder.WriteString(") DO UPDATE SET")
+
+	sign = ' '
+	for i := 0; i < len(fields); i += 2 {
+		name := fields[i]
+		builder.WriteByte(sign)
+		builder.WriteByte('`')
+		builder.WriteString(name)
+		builder.WriteString("`=EXCLUDED.`")
+		builder.WriteString(name)
+		builder.WriteByte('`')
+		sign = ','
+	}
+}
+
+// parseDefaultLiteral 只保留常量默认值，如 0、'abc'::character varying，nextval()等表达式由数据库计算
+func parseDefaultLiteral(desc string) string {
+	if desc == "" {
+		return ""
+	}
+
+	if desc[0] == '\'' {
+		e := strings.LastIndexByte(desc, '\'')
+		if e < 1 {
+			return ""
+		}
+
+		return strings.ReplaceAll(desc[1:e], "''", "'")
+	}
+
+	if e := strings.Index(desc, "::"); e > 0 {
+		desc = desc[:e]
+	}
+
+	desc = strings.Trim(desc, "()")
+	if _, err := strconv.ParseFloat(desc, 64); err != nil {
+		return ""
+	}
+
+	return desc
+}
+
+func (db *sqlDriver) errReply(err error, data interface{}) *DBReply {
+	if msg, ok := db.dialect.sqlError(err); ok {
+		return &DBReply{Data: data, Msg: msg}
+	}
+
+	return &DBReply{Data: data, Err: err}
+}
+
+func (db *sqlDriver) newRowScanner(nField int) *rowScanner {
+	rs := &rowScanner{
+		wrapper: make([]interface{}, nField),
+		nulls:   make([]bool, nField),
+	}
+
+	if db.dialect.rawScan() {
+		rs.rawBytes = make([]sql.RawBytes, nField)
+		for i := range rs.wrapper {
+			rs.wrapper[i] = &rs.rawBytes[i]
+		}
+
+	} else {
+		rs.values = make([]textValue, nField)
+		rs.fields = make([][]byte, nField)
+		for i := range rs.wrapper {
+			rs.wrapper[i] = &rs.values[i]
+		}
+	}
+
+	return rs
+}
+
+func (rs *rowScanner) scan(rows *sql.Rows) ([][]byte, error) {
+	if err := rows.Scan(rs.wrapper...); err != nil {
+		return nil, err
+	}
+
+	if rs.rawBytes != nil {
+		for i, v := range rs.rawBytes {
+			rs.nulls[i] = v == nil
+		}
+		return rawBytes2Bytes(rs.rawBytes), nil
+	}
+
+	for i, v := range rs.values {
+		rs.fields[i] = v
+		rs.nulls[i] = v == nil
+	}
+
+	return rs.fields, nil
+}
+
+func (tv *textValue) Scan(src interface{}) error {
+	b := (*tv)[:0]
+	switch v := src.(type) {
+	case nil:
+		b = nil
+
+	case []byte:
+		b = append(b, v...)
+
+	case string:
+		b = append(b, v...)
+
+	case int64:
+		b = strconv.AppendInt(b, v, 10)
+
+	case float64:
+		b = strconv.AppendFloat(b, v, 'g', -1, 64)
+
+	case bool:
+		b = strconv.AppendBool(b, v)
+
+	case time.Time:
+		b = v.AppendFormat(b, "2006-01-02 15:04:05")
+
+	default:
+		return fmt.Errorf("unsupported scan type: %T", src)
+	}
+
+	if b == nil && src != nil {
+		b = []byte{}
+	}
+	*tv = b
+	return nil
+}
+
+func (db *sqlDriver) Insert(schema *TableSchema, shard string, fields []string) *DBReply {
+	return db.InsertContext(context.Background(), schema, shard, fields)
+}
+
+func (db *sqlDriver) InsertContext(ctx context.Context, schema *TableSchema, _ string, fields []string) *DBReply {
+	return db.insert(ctx, schema, fields, false)
+}
+
+func (db *sqlDriver) Upsert(schema *TableSchema, shard string, fields []string) *DBReply {
+	return db.UpsertContext(context.Background(), schema, shard, fields)
+}
+
+// UpsertContext 使用INSERT ... ON DUPLICATE KEY UPDATE(或对应的upsert语法)；
+// 插入和更新的影响行数在各数据库中不一致，成功时统一返回1
+func (db *sqlDriver) UpsertContext(ctx context.Context, schema *TableSchema, _ string, fields []string) *DBReply {
+	return db.insert(ctx, schema, fields, true)
+}
+
+func (db *sqlDriver) insert(ctx context.Context, schema *TableSchema, fields []string, upsert bool) *DBReply {
+	var sql1, sql2 strings.Builder
+	sql1.WriteString(schema.insertClause1)
+	sql2.WriteString(schema.insertClause2)
+
+	nField := len(fields)
+	if nField&1 != 0 {
+		return &DBReply{
+			Data: int64(0),
+			Msg:  "invalid fields for INSERT parameters",
+		}
+	}
+
+	var lastSign byte = '('
+	params := make([]interface{}, 0, nField>>1)
+	var updates, keys []string
+	for i := 0; i < nField; i += 2 {
+		name := fields[i]
+		value := fields[i+1]
+
+		cs := schema.GetColumnSchema(name)
+		if cs == nil {
+			return &DBReply{
+				Data: int64(0),
+				Msg:  "invalid field of INSERT parameter",
+			}
+		}
+
+		if cs.IsNumber && value == "" {
+			continue
+		}
+
+		if upsert {
+			if cs.IsPrimaryKey {
+				keys = append(keys, name, value)
+			} else {
+				updates = append(updates, name, value)
+			}
+		}
+
+		sql1.WriteByte(lastSign)
+		sql1.WriteByte('`')
+		sql1.WriteString(name)
+		sql1.WriteByte('`')
+
+		sql2.WriteByte(lastSign)
+		sql2.WriteByte('?')
+
+		params = append(params, fieldParam(value))
+		lastSign = ','
+	}
+	sql1.WriteByte(')')
+	sql2.WriteByte(')')
+	sql1.WriteString(sql2.String())
+
+	if upsert {
+		//只有主键时更新为相同的值，行已存在时不报错
+		if len(updates) == 0 {
+			updates = keys
+		}
+		db.dialect.writeUpsert(&sql1, schema, updates)
+	}
+
+	_, err := db.conn.ExecContext(ctx, db.dialect.rebind(sql1.String()), params...)
+	if err != nil {
+		return db.errReply(err, int64(0))
+	}
+
+	return &DBReply{Data: int64(1)}
+}
+
+func (db *sqlDriver) DeleteSingle(schema *TableSchema, shard string, keys []string) *DBReply {
+	return db.DeleteSingleContext(context.Background(), schema, shard, keys)
+}
+
+func (db *sqlDriver) DeleteSingleContext(ctx context.Context, schema *TableSchema, _ string, keys []string) *DBReply {
+	nKey := len(keys)
+	if nKey != schema.NumPrimaryKeys {
+		return &DBReply{Data: int64(0), Msg: "invalid primary keys"}
+	}
+
+	params := make([]interface{}, nKey)
+	for i := 0; i < nKey; i++ {
+		params[i] = keys[i]
+	}
+
+	ret, err := db.execStmt(ctx, schema, schema.deleteSingle, false, params...)
+	if err != nil {
+		return db.errReply(err, int64(0))
+	}
+
+	num, _ := ret.RowsAffected()
+	return &DBReply{Data: num}
+}
+
+func (db *sqlDriver) UpdateSingle(schema *TableSchema, shard string, keys []string, fields []string) *DBReply {
+	return db.UpdateSingleContext(context.Background(), schema, shard, keys, fields)
+}
+
+func (db *sqlDriver) UpdateSingleContext(ctx context.Context, schema *TableSchema, _ string, keys []string, fields []string) *DBReply {
+	n := len(fields)
+	if n&1 != 0 {
+		return &DBReply{Data: int64(0), Msg: "invalid fields for Update"}
+	}
+	nKey := len(keys)
+	if nKey != schema.NumPrimaryKeys {
+		return &DBReply{Data: int64(0), Msg: "invalid primary keys"}
+	}
+
+	var version string
+	if schema.versioned() {
+		var ok bool
+		if fields, version, ok = schema.splitVersion(fields); !ok {
+			return &DBReply{Data: int64(0), Msg: "missing version"}
+		}
+		n = len(fields)
+	}
+
+	nField := n >> 1
+	params := make([]interface{}, nField+schema.NumPrimaryKeys, nField+schema.NumPrimaryKeys+1)
+	var builder strings.Builder
+	builder.WriteString(schema.updatePrefix)
+	var prevSign byte = ' '
+	idx := 0
+	for i := 0; i < n; i += 2 {
+		name := fields[i]
+		value := fields[i+1]
+
+		builder.WriteByte(prevSign)
+		builder.WriteByte('`')
+		builder.WriteString(name)
+		builder.WriteByte('`')
+		builder.WriteString("=?")
+
+		params[idx] = fieldParam(value)
+		idx++
+
+		prevSign = ','
+	}
+
+	if schema.versioned() {
+		builder.WriteByte(prevSign)
+		writeVersionIncr(&builder, schema)
+	}
+	builder.WriteString(schema.whereSingleClause)
+
+	for i := 0; i < nKey; i++ {
+		params[i+nField] = keys[i]
+	}
+
+	if schema.versioned() {
+		writeVersionCheck(&builder, schema)
+		params = append(params, version)
+	}
+
+	ret, err := db.execStmt(ctx, schema, builder.String(), true, params...)
+	if err != nil {
+		return db.errReply(err, int64(0))
+	}
+
+	num, _ := ret.RowsAffected()
+	if num == 0 && schema.versioned() {
+		return db.versionReply(ctx, schema, keys, version)
+	}
+
+	return &DBReply{Data: num}
+}
+
+// writeVersionIncr 版本列加1
+func writeVersionIncr(builder *strings.Builder, schema *TableSchema) {
+	builder.WriteByte('`')
+	builder.WriteString(schema.VersionColumn)
+	builder.WriteString("`=`")
+	builder.WriteString(schema.VersionColumn)
+	builder.WriteString("`+1")
+}
+
+// writeVersionCheck WHERE中检查版本
+func writeVersionCheck(builder *strings.Builder, schema *TableSchema) {
+	builder.WriteString(" AND `")
+	builder.WriteString(schema.VersionColumn)
+	builder.WriteString("`=?")
+}
+
+// versionReply 有版本列的表中没有修改任何行时，区分版本冲突和其他原因(行不存在、条件不满足)
+func (db *sqlDriver) versionReply(ctx context.Context, schema *TableSchema, keys []string, version string) *DBReply {
+	params := make([]interface{}, len(keys))
+	for i, key := range keys {
+		params[i] = key
+	}
+
+	query := "SELECT `" + schema.VersionColumn + "` FROM " + schema.tableName + schema.whereSingleClause
+	rows, err := db.queryStmt(ctx, schema, query, params...)
+	if err != nil {
+		return db.errReply(err, int64(0))
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		values, err := db.newRowScanner(1).scan(rows)
+		if err != nil {
+			return &DBReply{Data: int64(0), Err: err}
+		}
+
+		if string(values[0]) != version {
+			return &DBReply{Data: int64(0), Err: ErrVersionConflict}
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return db.errReply(err, int64(0))
+	}
+
+	return &DBReply{Data: int64(0)}
+}
+
+func (db *sqlDriver) IncrBySingle(schema *TableSchema, shard string, keys []string, data *IncrByData) *DBReply {
+	return db.IncrBySingleContext(context.Background(), schema, shard, keys, data)
+}
+
+func (db *sqlDriver) IncrBySingleContext(ctx context.Context, schema *TableSchema, _ string, keys []string, data *IncrByData) *DBReply {
+	nKey := len(keys)
+	if nKey != schema.NumPrimaryKeys {
+		return &DBReply{Data: int64(0), Msg: "invalid primary keys"}
+	}
+
+	deltas := data.ColumnDeltas()
+	if len(deltas) == 0 {
+		return &DBReply{Data: int64(0), Msg: "invalid fields"}
+	}
+
+	if schema.versioned() && data.Version == "" {
+		return &DBReply{Data: int64(0), Msg: "missing version"}
+	}
+
+	params := make([]interface{}, nKey, nKey+len(data.Guards)+1)
+	for i := 0; i < nKey; i++ {
+		params[i] = keys[i]
+	}
+
+	var builder strings.Builder
+	builder.WriteString(schema.updatePrefix)
+	for i, cd := range deltas {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		//builder.WriteByte(' ')
+		builder.WriteString(" `")
+		builder.WriteString(cd.Column)
+		//builder.WriteByte('=')
+		builder.WriteString("`=`")
+		builder.WriteString(cd.Column)
+		//builder.WriteByte('+')
+		builder.WriteString("`+")
+		builder.WriteString(strconv.FormatInt(cd.Delta, 10))
+	}
+
+	if schema.versioned() {
+		builder.WriteByte(',')
+		writeVersionIncr(&builder, schema)
+	}
+	builder.WriteString(schema.whereSingleClause)
+
+	if schema.versioned() {
+		writeVersionCheck(&builder, schema)
+		params = append(params, data.Version)
+	}
+
+	//WHERE比较的是增加之前的值，column+delta op value 转换为 column op value-delta
+	for i := range data.Guards {
+		guard := &data.Guards[i]
+		if !guard.valid() {
+			return &DBReply{Data: int64(0), Msg: "invalid guard"}
+		}
+
+		builder.WriteString(" AND `")
+		builder.WriteString(guard.Column)
+		builder.WriteByte('`')
+		builder.WriteString(guard.Op)
+		builder.WriteByte('?')
+		params = append(params, guard.Value-data.DeltaOf(guard.Column))
+	}
+
+	if data.Where != "" {
+		builder.WriteString(" AND ")
+		builder.WriteString(data.Where)
+	}
+
+	ret, err := db.conn.ExecContext(ctx, db.dialect.rebind(builder.String()), params...)
+	if err != nil {
+		return db.errReply(err, int64(0))
+	}
+
+	num, _ := ret.RowsAffected()
+	if num == 0 && schema.versioned() {
+		return db.versionReply(ctx, schema, keys, data.Version)
+	}
+
+	return &DBReply{Data: num}
+}
+
+func (db *sqlDriver) SelectSingle(schema *TableSchema, shard string, keys []string) *DBReply {
+	return db.SelectSingleContext(context.Background(), schema, shard, keys)
+}
+
+func (db *sqlDriver) SelectSingleContext(ctx context.Context, schema *TableSchema, _ string, keys []string) *DBReply {
+	var rowData []byte
+	nKey := len(keys)
+	if nKey != schema.NumPrimaryKeys {
+		return &DBReply{Data: rowData, Msg: "invalid primary keys"}
+	}
+
+	params := make([]interface{}, nKey)
+	for i := 0; i < nKey; i++ {
+		params[i] = keys[i]
+	}
+
+	rows, err := db.queryStmt(ctx, schema, schema.selectSingle, params...)
+	if err != nil {
+		return db.errReply(err, rowData)
+	}
+
+	scanner := db.newRowScanner(len(schema.Columns))
+
+	rowNum := 0
+	for rows.Next() {
+		fieldData, err := scanner.scan(rows)
+		if err != nil {
+			_ = rows.Close()
+			return &DBReply{Data: rowData, Err: err}
+		}
+
+		rowData = NewNullableRowData(schema, fieldData, scanner.nulls)
+		if rowData == nil {
+			_ = rows.Close()
+			return &DBReply{Data: rowData, Msg: "inconsistent columns returned, check table schema"}
+		}
+		rowNum++
+	}
+
+	if err = rows.Err(); err != nil {
+		return db.errReply(err, rowData)
+	}
+
+	if rowNum > 1 {
+		return &DBReply{Data: rowData, Msg: "multiple row returned"}
+	}
+
+	return &DBReply{Data: rowData}
+}
+
+func (db *sqlDriver) SelectMulti(schema *TableSchema, shard string, query *SelectQuery) *DBReply {
+	return db.SelectMultiContext(context.Background(), schema, shard, query)
+}
+
+func (db *sqlDriver) SelectMultiContext(ctx context.Context, schema *TableSchema, shard string, query *SelectQuery) *DBReply {
+	if query != nil {
+		return db.selectQuery(ctx, schema, shard, query)
+	}
+
+	params := []interface{}{shard}
+	var multiRowData [][]byte
+
+	rows, err := db.queryStmt(ctx, schema, schema.selectMulti, params...)
+	if err != nil {
+		return db.errReply(err, multiRowData)
+	}
+
+	scanner := db.newRowScanner(len(schema.Columns))
+
+	multiRowData = make([][]byte, 0, 512)
+	nRow := 0
+	for rows.Next() {
+		fieldData, err := scanner.scan(rows)
+		if err != nil {
+			_ = rows.Close()
+			return &DBReply{Data: multiRowData, Err: err}
+		}
+
+		rowData := NewNullableRowData(schema, fieldData, scanner.nulls)
+		if rowData == nil {
+			_ = rows.Close()
+			return &DBReply{Data: rowData, Msg: "inconsistent columns returned, check table schema"}
+		}
+
+		multiRowData = append(multiRowData, rowData)
+		nRow++
+	}
+
+	if err = rows.Err(); err != nil {
+		return db.errReply(err, multiRowData)
+	}
+
+	return &DBReply{Data: multiRowData}
+}
+
+// selectQuery 条件各不相同，与DeleteMulti一样不使用预编译的语句
+func (db *sqlDriver) selectQuery(ctx context.Context, schema *TableSchema, shard string, query *SelectQuery) *DBReply {
+	var multiRowData [][]byte
+	sp, err := query.plan(schema, shard)
+	if err != nil {
+		return &DBReply{Data: multiRowData, Msg: err.Error()}
+	}
+
+	var builder strings.Builder
+	params := sp.writeSql(&builder, schema, []interface{}{shard})
+	rows, err := db.conn.QueryContext(ctx, db.dialect.rebind(builder.String()), params...)
+	if err != nil {
+		return db.errReply(err, multiRowData)
+	}
+	defer rows.Close()
+
+	nColumn := len(schema.Columns)
+	if sp.columns != nil {
+		nColumn = 0
+		for _, selected := range sp.columns {
+			if selected {
+				nColumn++
+			}
+		}
+	}
+	scanner := db.newRowScanner(nColumn)
+	fieldData := make([][]byte, len(schema.Columns))
+	nulls := make([]bool, len(schema.Columns))
+
+	multiRowData = make([][]byte, 0, 64)
+	for rows.Next() {
+		values, err := scanner.scan(rows)
+		if err != nil {
+			return &DBReply{Data: multiRowData, Err: err}
+		}
+
+		if sp.columns == nil {
+			copy(fieldData, values)
+			copy(nulls, scanner.nulls)
+		} else {
+			j := 0
+			for i, selected := range sp.columns {
+				fieldData[i] = nil
+				nulls[i] = false
+				if selected {
+					fieldData[i] = values[j]
+					nulls[i] = scanner.nulls[j]
+					j++
+				}
+			}
+		}
+
+		rowData := NewNullableRowData(schema, fieldData, nulls)
+		if rowData == nil {
+			return &DBReply{Data: multiRowData, Msg: "inconsistent columns returned, check table schema"}
+		}
+
+		multiRowData = append(multiRowData, rowData)
+	}
+
+	if err = rows.Err(); err != nil {
+		return db.errReply(err, multiRowData)
+	}
+
+	return &DBReply{Data: multiRowData}
+}
+
+func (db *sqlDriver) AggregateMulti(schema *TableSchema, shard string, query *AggregateQuery) *DBReply {
+	return db.AggregateMultiContext(context.Background(), schema, shard, query)
+}
+
+func (db *sqlDriver) AggregateMultiContext(ctx context.Context, schema *TableSchema, shard string, query *AggregateQuery) *DBReply {
+	var result *AggregateResult
+	ap, err := query.plan(schema, shard)
+	if err != nil {
+		return &DBReply{Data: result, Msg: err.Error()}
+	}
+
+	var builder strings.Builder
+	params := ap.writeSql(&builder, schema, []interface{}{shard})
+	rows, err := db.conn.QueryContext(ctx, db.dialect.rebind(builder.String()), params...)
+	if err != nil {
+		return db.errReply(err, result)
+	}
+	defer rows.Close()
+
+	scanner := db.newRowScanner(1)
+	if rows.Next() {
+		values, err := scanner.scan(rows)
+		if err != nil {
+			return &DBReply{Data: result, Err: err}
+		}
+
+		result = &AggregateResult{Value: string(values[0]), Null: scanner.nulls[0]}
+	}
+
+	if err = rows.Err(); err != nil {
+		return db.errReply(err, result)
+	}
+
+	return &DBReply{Data: result}
+}
+
+func (db *sqlDriver) DeleteMulti(schema *TableSchema, shard string, data *MultiRequestData) *DBReply {
+	return db.DeleteMultiContext(context.Background(), schema, shard, data)
+}
+
+func (db *sqlDriver) DeleteMultiContext(ctx context.Context, schema *TableSchema, _ string, data *MultiRequestData) *DBReply {
+	n := len(data.Params)
+	params := make([]interface{}, n)
+	for i := 0; i < n; i++ {
+		params[i] = data.Params[i]
+	}
+
+	var builder strings.Builder
+	builder.WriteString(schema.deleteMultiPrefix)
+	builder.WriteString(data.Where)
+
+	ret, err := db.conn.ExecContext(ctx, db.dialect.rebind(builder.String()), params...)
+	if err != nil {
+		return db.errReply(err, int64(0))
+	}
+
+	num, _ := ret.RowsAffected()
+	return &DBReply{Data: num}
+}
+
+func (db *sqlDriver) Batch(schema *TableSchema, cmd DBCommand, items []BatchItem) []*DBReply {
+	return db.BatchContext(context.Background(), schema, cmd, items)
+}
+
+func (db *sqlDriver) BatchContext(ctx context.Context, schema *TableSchema, cmd DBCommand, items []BatchItem) []*DBReply {
+	replies := make([]*DBReply, len(items))
+	switch cmd {
+	case CmdInsert:
+		if db.dialect.valuesDefault() {
+			db.insertBatch(ctx, schema, items, replies)
+			break
+		}
+
+		//不支持DEFAULT时，只有插入相同列的请求才能合并
+		n := len(items)
+		for s := 0; s < n; {
+			e := s + 1
+			for e < n && sameFieldNames(items[s].Fields, items[e].Fields) {
+				e++
+			}
+
+			db.insertBatch(ctx, schema, items[s:e], replies[s:e])
+			s = e
+		}
+
+	case CmdUpdateSingle:
+		db.updateBatch(ctx, schema, items, replies)
+
+	default:
+		for i := range replies {
+			replies[i] = &DBReply{Err: fmt.Errorf("nonsupport batch cmd: %d", cmd)}
+		}
+	}
+
+	return replies
+}
+
+// insertBatch 合并为一条多VALUES的INSERT，未提供的列使用DEFAULT；
+// 语句失败时(如duplicate key)逐条重新执行，以得到每个请求各自的结果
+func (db *sqlDriver) insertBatch(ctx context.Context, schema *TableSchema, items []BatchItem, replies []*DBReply) {
+	if len(items) == 1 {
+		replies[0] = db.InsertContext(ctx, schema, items[0].Shard, items[0].Fields)
+		return
+	}
+
+	columns := schema.Columns
+	nColumn := len(columns)
+	used := make([]bool, nColumn)
+	//每个item中各列对应的值在Fields中的下标，-1表示DEFAULT
+	valueIdxes := make([][]int, len(items))
+	nValid := 0
+	for i := range items {
+		fields := items[i].Fields
+		nField := len(fields)
+		if nField&1 != 0 {
+			replies[i] = &DBReply{Data: int64(0), Msg: "invalid fields for INSERT parameters"}
+			continue
+		}
+
+		idxes := make([]int, nColumn)
+		for j := range idxes {
+			idxes[j] = -1
+		}
+
+		for j := 0; j < nField; j += 2 {
+			cs := schema.GetColumnSchema(fields[j])
+			if cs == nil {
+				idxes = nil
+				break
+			}
+
+			if cs.IsNumber && fields[j+1] == "" {
+				continue
+			}
+
+			idxes[cs.Index] = j + 1
+			used[cs.Index] = true
+		}
+
+		if idxes == nil {
+			replies[i] = &DBReply{Data: int64(0), Msg: "invalid field of INSERT parameter"}
+			continue
+		}
+
+		valueIdxes[i] = idxes
+		nValid++
+	}
+
+	if nValid == 0 {
+		return
+	}
+
+	needDefault := false
+	for _, idxes := range valueIdxes {
+		for j := 0; idxes != nil && j < nColumn; j++ {
+			if used[j] && idxes[j] < 0 {
+				needDefault = true
+			}
+		}
+	}
+
+	if needDefault && !db.dialect.valuesDefault() {
+		for i, idxes := range valueIdxes {
+			if idxes != nil {
+				replies[i] = db.InsertContext(ctx, schema, items[i].Shard, items[i].Fields)
+			}
+		}
+		return
+	}
+
+	var builder strings.Builder
+	builder.WriteString(schema.insertClause1)
+	var lastSign byte = '('
+	nUsed := 0
+	for i := 0; i < nColumn; i++ {
+		if !used[i] {
+			continue
+		}
+
+		builder.WriteByte(lastSign)
+		builder.WriteByte('`')
+		builder.WriteString(columns[i].Name)
+		builder.WriteByte('`')
+		lastSign = ','
+		nUsed++
+	}
+	builder.WriteByte(')')
+	builder.WriteString(schema.insertClause2)
+
+	params := make([]interface{}, 0, nValid*nUsed)
+	var rowSign byte = ' '
+	for i, idxes := range valueIdxes {
+		if idxes == nil {
+			continue
+		}
+
+		builder.WriteByte(rowSign)
+		lastSign = '('
+		for j := 0; j < nColumn; j++ {
+			if !used[j] {
+				continue
+			}
+
+			builder.WriteByte(lastSign)
+			if idxes[j] < 0 {
+				builder.WriteString("DEFAULT")
+
+			} else {
+				builder.WriteByte('?')
+				params = append(params, fieldParam(items[i].Fields[idxes[j]]))
+			}
+			lastSign = ','
+		}
+		builder.WriteByte(')')
+		rowSign = ','
+	}
+
+	_, err := db.conn.ExecContext(ctx, db.dialect.rebind(builder.String()), params...)
+	if err == nil {
+		for i, idxes := range valueIdxes {
+			if idxes != nil {
+				replies[i] = &DBReply{Data: int64(1)}
+			}
+		}
+		return
+	}
+
+	if _, ok := db.dialect.sqlError(err); !ok {
+		for i, idxes := range valueIdxes {
+			if idxes != nil {
+				replies[i] = &DBReply{Err: err}
+			}
+		}
+		return
+	}
+
+	for i, idxes := range valueIdxes {
+		if idxes != nil {
+			replies[i] = db.InsertContext(ctx, schema, items[i].Shard, items[i].Fields)
+		}
+	}
+}
+
+// updateBatch 在一个事务中逐行UPDATE，不会插入不存在的行，每个请求返回各自影响的行数；
+// 有版本列(冲突需要各自返回)、已经在事务中或者只有一行时逐条直接执行
+func (db *sqlDriver) updateBatch(ctx context.Context, schema *TableSchema, items []BatchItem, replies []*DBReply) {
+	if len(items) > 1 && !schema.versioned() && db.tx == nil && db.updateInTx(ctx, schema, items, replies) {
+		return
+	}
+
+	for i := range items {
+		replies[i] = db.UpdateSingleContext(ctx, schema, items[i].Shard, items[i].Keys, items[i].Fields)
+	}
+}
+
+// updateInTx 有语句返回数据库错误时回滚并返回false，由调用者逐条重新执行以得到每个请求各自的结果；
+// 其他错误(如连接断开、提交失败)所有请求都返回该错误
+func (db *sqlDriver) updateInTx(ctx context.Context, schema *TableSchema, items []BatchItem, replies []*DBReply) bool {
+	tx, err := db.BeginContext(ctx)
+	if err != nil {
+		fillErrReplies(replies, err)
+		return true
+	}
+
+	txDriver := &tx.(*sqlTx).sqlDriver
+	for i := range items {
+		reply := txDriver.UpdateSingleContext(ctx, schema, items[i].Shard, items[i].Keys, items[i].Fields)
+		if reply.Err != nil {
+			_ = tx.Rollback()
+			fillErrReplies(replies, reply.Err)
+			return true
+		}
+
+		if reply.Msg != "" {
+			_ = tx.Rollback()
+			return false
+		}
+		replies[i] = reply
+	}
+
+	if err = tx.Commit(); err != nil {
+		fillErrReplies(replies, err)
+	}
+
+	return true
+}
+
+func fillErrReplies(replies []*DBReply, err error) {
+	for i := range replies {
+		replies[i] = &DBReply{Data: int64(0), Err: err}
+	}
+}
+
+func (db *sqlDriver) Query(query string, params ...interface{}) ([][][]byte, error) {
+	rows, err := db.conn.QueryContext(context.Background(), query, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	nField := len(columns)
+	wrapper := make([]interface{}, nField)
+	multiRowData := make([][][]byte, 0, 512)
+	for rows.Next() {
+		rawBytes := make([][]byte, nField)
+		for i := range wrapper {
+			wrapper[i] = &rawBytes[i]
+		}
+
+		err := rows.Scan(wrapper...)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+
+		multiRowData = append(multiRowData, rawBytes)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return multiRowData, nil
+}
+
+func (db *sqlDriver) Exec(query string, params ...interface{}) (int64, error) {
+	ret, err := db.conn.ExecContext(context.Background(), query, params...)
+	if err != nil {
+		return 0, err
+	}
+
+	return ret.RowsAffected()
+}
+
+func sameFieldNames(fields1 []string, fields2 []string) bool {
+	n := len(fields1)
+	if n != len(fields2) {
+		return false
+	}
+
+	for i := 0; i < n; i += 2 {
+		if fields1[i] != fields2[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fieldParam 列的值作为语句的参数，NullValue转换为NULL
+func fieldParam(value string) interface{} {
+	if value == NullValue {
+		return nil
+	}
+
+	return value
+}
+
+func rawBytes2Bytes(b []sql.RawBytes) [][]byte {
+	return *(*[][]byte)(unsafe.Pointer(&b))
+}
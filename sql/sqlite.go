@@ -0,0 +1,96 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// SQLite 用于本地开发和测试，语法与MySql接近：支持`和?，但VALUES中不支持DEFAULT
+type SQLite struct {
+	sqlDriver
+}
+
+type sqliteDialect struct{}
+
+// NewSQLite path为文件路径或":memory:"，只使用一个连接，保证内存数据库在多次访问之间可见
+func NewSQLite(path string) *SQLite {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil
+	}
+
+	db.SetMaxOpenConns(1)
+	return &SQLite{
+		sqlDriver: newSqlDriver(db, sqliteDialect{}),
+	}
+}
+
+func (db *SQLite) LoadTableSchema(tableName string) (*TableSchema, error) {
+	return db.LoadTableSchemaContext(context.Background(), tableName)
+}
+
+func (db *SQLite) LoadTableSchemaContext(ctx context.Context, tableName string) (*TableSchema, error) {
+	rows, err := db.db.QueryContext(ctx, "PRAGMA table_info(`"+tableName+"`)")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	descs := make([]columnDesc, 0, 32)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typeDesc, defaultDesc sql.NullString
+		err := rows.Scan(&cid, &name, &typeDesc, &notNull, &defaultDesc, &pk)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+
+		descs = append(descs, columnDesc{
+			name:         name.String,
+			typeName:     parseFieldType(strings.ToLower(typeDesc.String)),
+			isPrimaryKey: pk > 0,
+			defaultValue: parseDefaultLiteral(defaultDesc.String),
+			defaultNull:  notNull == 0 && !defaultDesc.Valid,
+			collation:    CollationBinaryLikeNoCase,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "rows")
+	}
+
+	if len(descs) == 0 {
+		return nil, errors.Errorf("table: %s not found", tableName)
+	}
+
+	return newTableSchema(tableName, descs)
+}
+
+func (sqliteDialect) rebind(query string) string {
+	return query
+}
+
+// sqlError SQLITE_BUSY和SQLITE_LOCKED是暂时的，按连接错误处理，由RetryPolicy重试
+func (sqliteDialect) sqlError(err error) (string, bool) {
+	sqlErr, ok := err.(sqlite3.Error)
+	if !ok || sqlErr.Code == sqlite3.ErrBusy || sqlErr.Code == sqlite3.ErrLocked {
+		return "", false
+	}
+
+	return sqlErr.Error(), true
+}
+
+func (sqliteDialect) writeUpsert(builder *strings.Builder, schema *TableSchema, fields []string) {
+	writeOnConflictUpsert(builder, schema, fields)
+}
+
+func (sqliteDialect) valuesDefault() bool {
+	return false
+}
+
+func (sqliteDialect) rawScan() bool {
+	return false
+}
@@ -0,0 +1,286 @@
+package sql
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSQLite(t *testing.T) (*SQLite, *TableSchema) {
+	db := NewSQLite(":memory:")
+	CreateSQLiteTestTable(db, "fake", []string{
+		"uid BIGINT", "id INT", "name VARCHAR(64) NOT NULL DEFAULT ''", "gold BIGINT NOT NULL DEFAULT 0",
+	}, []string{"uid", "id"})
+
+	schema, err := db.LoadTableSchema("fake")
+	require.NoError(t, err)
+	return db, schema
+}
+
+func TestSQLite_LoadTableSchema(t *testing.T) {
+	_, schema := newTestSQLite(t)
+	require.Equal(t, 2, schema.NumPrimaryKeys)
+	require.Equal(t, "uid", schema.ShardKey)
+	require.Equal(t, ColumnTypeInt, schema.GetColumnSchema("id").Type)
+	require.Equal(t, ColumnTypeString, schema.GetColumnSchema("name").Type)
+	require.Equal(t, "0", schema.GetColumnSchema("gold").DefaultValue)
+}
+
+func TestSQLite_Driver(t *testing.T) {
+	db, schema := newTestSQLite(t)
+	testDriver(t, db, schema)
+}
+
+func TestSQLite_Processor(t *testing.T) {
+	db, schema := newTestSQLite(t)
+	p := NewProcessor(db)
+	p.SetBatchSize(16)
+
+	rc := NewRowContext()
+	p.AppendRequest(newTestRequest(schema, CmdInsert, rc, []string{"1", "1"}, []string{"uid", "1", "id", "1"}))
+	p.AppendRequest(newTestRequest(schema, CmdUpdateSingle, rc, []string{"1", "1"}, []string{"gold", "5"}))
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, []string{"1", "1"}, &IncrByData{Column: "gold", Delta: 2}))
+	p.AppendRequest(newTestRequest(schema, CmdIncrBySingle, rc, []string{"1", "1"}, &IncrByData{Column: "gold", Delta: 3}))
+	for i := 2; i < 5; i++ {
+		id := string(rune('0' + i))
+		p.AppendRequest(newTestRequest(schema, CmdInsert, NewRowContext(), []string{"1", id},
+			[]string{"uid", "1", "id", id, "name", "n" + id}))
+	}
+
+	reqs := drainProcessor(p)
+	require.Len(t, reqs, 7)
+	for _, req := range reqs {
+		require.NoError(t, req.Reply.Err)
+	}
+
+	reply := db.SelectSingle(schema, "1", []string{"1", "1"})
+	require.Equal(t, "10", GetValueByIndex(schema, reply.Data.([]byte), 3))
+	require.Len(t, db.SelectMulti(schema, "1", nil).Data, 4)
+}
+
+func TestSQLite_StmtCache(t *testing.T) {
+	db, _ := newTestSQLite(t)
+	tsm := NewTableSchemaManager(db)
+	schema, err := tsm.LoadSchema("fake")
+	require.NoError(t, err)
+
+	keys := []string{"1", "1"}
+	db.Insert(schema, "1", []string{"uid", "1", "id", "1"})
+	for i := 0; i < 3; i++ {
+		require.NotNil(t, db.SelectSingle(schema, "1", keys).Data)
+		require.Equal(t, int64(1), db.UpdateSingle(schema, "1", keys, []string{"gold", "1"}).Data)
+	}
+
+	nHit, nMiss := db.StmtCacheStats()
+	require.Equal(t, int64(4), nHit)
+	require.Equal(t, int64(2), nMiss)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	require.NotNil(t, tx.SelectSingle(schema, "1", keys).Data)
+	require.NoError(t, tx.Commit())
+
+	_, err = CreateParser(schema, "1", "gold>?", []string{"0"})
+	require.NoError(t, err)
+	require.Equal(t, 1, schema.parsers.len())
+
+	_, err = db.Exec("ALTER TABLE fake ADD COLUMN exp INT NOT NULL DEFAULT 0")
+	require.NoError(t, err)
+	schema2, err := tsm.ReloadSchema("fake", false)
+	require.NoError(t, err)
+	require.NotNil(t, schema2)
+	require.Len(t, schema2.Columns, 5)
+	require.Zero(t, schema.parsers.len())
+
+	//the old statements have been dropped, the new schema prepares again
+	require.NotNil(t, db.SelectSingle(schema2, "1", keys).Data)
+	nHit, nMiss = db.StmtCacheStats()
+	require.Equal(t, int64(5), nHit)
+	require.Equal(t, int64(3), nMiss)
+
+	//the old schema is not prepared again
+	require.NotNil(t, db.SelectSingle(schema, "1", keys).Data)
+	require.Empty(t, db.stmts.schemas[schema].stmts)
+
+	//statements in use are closed after the last user releases them
+	ctx := context.Background()
+	stmt, ss := db.stmts.get(ctx, db.db, schema2, schema2.selectSingle, false)
+	require.NotNil(t, stmt)
+	db.InvalidateSchema(schema2)
+	stmt2, _ := db.stmts.get(ctx, db.db, schema2, schema2.selectSingle, false)
+	require.Nil(t, stmt2)
+	rows, err := stmt.QueryContext(ctx, "1", "1")
+	require.NoError(t, err)
+	require.NoError(t, rows.Close())
+	db.stmts.release(ss)
+	_, err = stmt.QueryContext(ctx, "1", "1")
+	require.Error(t, err)
+}
+
+func TestSQLite_Context(t *testing.T) {
+	db, schema := newTestSQLite(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	reply := db.InsertContext(ctx, schema, "1", []string{"uid", "1", "id", "1"})
+	require.ErrorIs(t, reply.Err, context.Canceled)
+	reply = db.SelectSingleContext(ctx, schema, "1", []string{"1", "1"})
+	require.ErrorIs(t, reply.Err, context.Canceled)
+	_, err := db.BeginContext(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+
+	//连接不受已取消的ctx影响
+	require.Equal(t, int64(1), db.Insert(schema, "1", []string{"uid", "1", "id", "1"}).Data)
+	require.NotNil(t, db.SelectSingleContext(context.Background(), schema, "1", []string{"1", "1"}).Data)
+}
+
+func TestSQLite_Null(t *testing.T) {
+	db := NewSQLite(":memory:")
+	CreateSQLiteTestTable(db, "fake_null", []string{"uid BIGINT", "name VARCHAR(64)", "gold BIGINT"}, []string{"uid"})
+	schema, err := db.LoadTableSchema("fake_null")
+	require.NoError(t, err)
+
+	keys := []string{"1"}
+	require.Equal(t, int64(1), db.Insert(schema, "1", []string{"uid", "1", "name", NullValue, "gold", "5"}).Data)
+	row := db.SelectSingle(schema, "1", keys).Data.([]byte)
+	require.True(t, IsNullByIndex(schema, row, 1))
+	require.False(t, IsNullByIndex(schema, row, 2))
+
+	require.Equal(t, int64(1), db.UpdateSingle(schema, "1", keys, []string{"name", "", "gold", NullValue}).Data)
+	row = db.SelectSingle(schema, "1", keys).Data.([]byte)
+	require.False(t, IsNullByIndex(schema, row, 1))
+	require.True(t, IsNullByIndex(schema, row, 2))
+
+	reply := db.SelectMulti(schema, "1", &SelectQuery{Where: "gold IS NULL", Columns: []string{"gold"}})
+	require.Len(t, reply.Data, 1)
+	require.True(t, IsNullByIndex(schema, reply.Data.([][]byte)[0], 2))
+
+	reply = db.AggregateMulti(schema, "1", &AggregateQuery{Func: AggregateMax, Column: "gold"})
+	require.True(t, reply.Data.(*AggregateResult).Null)
+}
+
+func TestSQLite_NullOrder(t *testing.T) {
+	db := NewSQLite(":memory:")
+	CreateSQLiteTestTable(db, "fake_order", []string{"uid BIGINT", "id INT", "gold BIGINT"}, []string{"uid", "id"})
+	schema, err := db.LoadTableSchema("fake_order")
+	require.NoError(t, err)
+
+	for i, gold := range []string{NullValue, "5", NullValue, "3"} {
+		reply := db.Insert(schema, "1", []string{"uid", "1", "id", strconv.Itoa(i + 1), "gold", gold})
+		require.Equal(t, int64(1), reply.Data)
+	}
+	all := db.SelectMulti(schema, "1", nil).Data.([][]byte)
+
+	//与MySQL一样NULL排在最前，desc时排在最后；数据库和内存中的分页结果相同
+	for desc, expected := range map[bool][]string{false: {"1", "3", "4", "2"}, true: {"2", "4", "1", "3"}} {
+		query := &SelectQuery{OrderBy: []OrderBy{{Column: "gold", Desc: desc}}, Limit: 1}
+		var ids, memIds []string
+		for {
+			rows := db.SelectMulti(schema, "1", query).Data.([][]byte)
+			sp, err := query.plan(schema, "1")
+			require.NoError(t, err)
+			memRows := sp.apply(schema, all)
+			require.Equal(t, len(rows), len(memRows))
+			if len(rows) == 0 {
+				break
+			}
+
+			ids = append(ids, GetValueByIndex(schema, rows[0], 1))
+			memIds = append(memIds, GetValueByIndex(schema, memRows[0], 1))
+			query.After = query.Cursor(schema, rows[0])
+		}
+
+		require.Equal(t, expected, ids)
+		require.Equal(t, expected, memIds)
+	}
+}
+
+func TestSQLite_RowsErr(t *testing.T) {
+	db, schema := newTestSQLite(t)
+	for _, id := range []string{"1", "2"} {
+		require.Equal(t, int64(1), db.Insert(schema, "1", []string{"uid", "1", "id", id, "gold", "5"}).Data)
+	}
+
+	//换成第二行才出错的视图，错误只能在rows.Next()之后由rows.Err()得到
+	_, err := db.Exec("ALTER TABLE fake RENAME TO fake_data")
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE VIEW fake AS SELECT uid, id, name, " +
+		"CASE WHEN id = 2 THEN abs(id - 9223372036854775807 - 3) ELSE gold END AS gold FROM fake_data")
+	require.NoError(t, err)
+
+	//SQLite的执行错误由sqlError转换为Msg
+	reply := db.SelectMulti(schema, "1", nil)
+	require.Equal(t, "integer overflow", reply.Msg)
+	reply = db.SelectSingle(schema, "1", []string{"1", "2"})
+	require.Equal(t, "integer overflow", reply.Msg)
+	reply = db.SelectSingle(schema, "1", []string{"1", "1"})
+	require.Empty(t, reply.Msg)
+	require.NotNil(t, reply.Data)
+
+	_, err = db.Query("SELECT gold FROM fake ORDER BY id")
+	require.Error(t, err)
+}
+
+func TestSQLite_Collation(t *testing.T) {
+	db, schema := newTestSQLite(t)
+	require.Equal(t, CollationBinaryLikeNoCase, schema.GetColumnSchema("name").Collation)
+
+	for i, name := range []string{"alice", "Alice", "BOB", "bob", "Bo_b"} {
+		reply := db.Insert(schema, "1", []string{"uid", "1", "id", strconv.Itoa(i + 1), "name", name})
+		require.Equal(t, int64(1), reply.Data)
+	}
+	all := db.SelectMulti(schema, "1", nil).Data.([][]byte)
+
+	//SQLite的比较和排序区分大小写，LIKE不区分ASCII字母的大小写；缓存中的结果与数据库相同
+	queries := []*SelectQuery{
+		{Where: "name=?", Params: []string{"alice"}},
+		{Where: "name IN ('BOB', 'x')"},
+		{Where: "name>'B' AND name<'b'", OrderBy: []OrderBy{{Column: "name"}}},
+		{Where: "name LIKE 'bo%'", OrderBy: []OrderBy{{Column: "name", Desc: true}}},
+		{Where: "name LIKE ?", Params: []string{"BO_B"}},
+		{OrderBy: []OrderBy{{Column: "name"}}},
+	}
+	for _, query := range queries {
+		rows := db.SelectMulti(schema, "1", query).Data.([][]byte)
+		sp, err := query.plan(schema, "1")
+		require.NoError(t, err)
+		memRows := sp.apply(schema, all)
+
+		var names, memNames []string
+		for i := range rows {
+			names = append(names, GetValueByIndex(schema, rows[i], 2))
+		}
+		for i := range memRows {
+			memNames = append(memNames, GetValueByIndex(schema, memRows[i], 2))
+		}
+		require.NotEmpty(t, names, query.Where)
+		require.Equal(t, names, memNames, query.Where)
+	}
+
+	aq := &AggregateQuery{Func: AggregateMax, Column: "name"}
+	reply := db.AggregateMulti(schema, "1", aq)
+	require.Equal(t, "bob", reply.Data.(*AggregateResult).Value)
+	ap, err := aq.plan(schema, "1")
+	require.NoError(t, err)
+	require.Equal(t, "bob", ap.apply(schema, all).Value)
+}
+
+func TestSqliteDialect_sqlError(t *testing.T) {
+	db, schema := newTestSQLite(t)
+	reply := db.Insert(schema, "1", []string{"uid", "1", "id", "1"})
+	require.Equal(t, int64(1), reply.Data)
+	reply = db.Insert(schema, "1", []string{"uid", "1", "id", "1"})
+	require.NoError(t, reply.Err)
+	require.NotEmpty(t, reply.Msg)
+
+	//busy and locked are transient and go through the retry policy
+	d := sqliteDialect{}
+	for _, code := range []sqlite3.ErrNo{sqlite3.ErrBusy, sqlite3.ErrLocked} {
+		_, ok := d.sqlError(sqlite3.Error{Code: code})
+		require.False(t, ok, code)
+		require.Equal(t, sqlite3.Error{Code: code}, db.errReply(sqlite3.Error{Code: code}, int64(0)).Err)
+	}
+}
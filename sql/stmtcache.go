@@ -0,0 +1,178 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+)
+
+// MaxCachedUpdateStmt 每个TableSchema最多缓存的UpdateSingle语句数(按更新的列组合区分)
+const MaxCachedUpdateStmt = 64
+
+// SchemaInvalidator 按TableSchema缓存数据的Driver实现该接口，
+// TableSchemaManager.ReloadSchema替换schema后通知其清理旧schema的缓存
+type SchemaInvalidator interface {
+	InvalidateSchema(schema *TableSchema)
+}
+
+// stmtCache 每个TableSchema预编译的语句，key为rebind之后的语句
+type stmtCache struct {
+	sync.RWMutex
+	schemas map[*TableSchema]*schemaStmts
+	nHit    atomic.Int64
+	nMiss   atomic.Int64
+}
+
+type schemaStmts struct {
+	stmts   map[string]*sql.Stmt
+	nUpdate int
+	//get返回、还没有release的次数
+	nUser atomic.Int32
+	//schema已经被替换，不再预编译；语句在没有使用者时关闭
+	dead      atomic.Bool
+	closeOnce sync.Once
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{
+		schemas: make(map[*TableSchema]*schemaStmts),
+	}
+}
+
+// get 返回预编译的语句，不为nil时使用后需要调用release；isUpdate的语句超出MaxCachedUpdateStmt、
+// schema已经失效或预编译失败时返回nil。db为nil时只查找不预编译，事务中使用，避免等待事务占用的连接
+func (sc *stmtCache) get(ctx context.Context, db *sql.DB, schema *TableSchema, query string, isUpdate bool) (*sql.Stmt, *schemaStmts) {
+	sc.RLock()
+	ss := sc.schemas[schema]
+	var stmt *sql.Stmt
+	if ss != nil && !ss.dead.Load() {
+		if stmt = ss.stmts[query]; stmt != nil {
+			ss.nUser.Add(1)
+		}
+	}
+	sc.RUnlock()
+
+	if stmt != nil {
+		sc.nHit.Add(1)
+		return stmt, ss
+	}
+
+	sc.nMiss.Add(1)
+	if db == nil {
+		return nil, nil
+	}
+
+	sc.Lock()
+	defer sc.Unlock()
+
+	ss = sc.schemas[schema]
+	if ss == nil {
+		ss = &schemaStmts{stmts: make(map[string]*sql.Stmt, 8)}
+		sc.schemas[schema] = ss
+
+	} else if ss.dead.Load() {
+		return nil, nil
+
+	} else if stmt = ss.stmts[query]; stmt != nil {
+		ss.nUser.Add(1)
+		return stmt, ss
+	}
+
+	if isUpdate && ss.nUpdate >= MaxCachedUpdateStmt {
+		return nil, nil
+	}
+
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil
+	}
+
+	ss.stmts[query] = stmt
+	if isUpdate {
+		ss.nUpdate++
+	}
+
+	ss.nUser.Add(1)
+	return stmt, ss
+}
+
+// release 语句使用完成(Exec返回，或者Query返回了Rows，Rows关闭前database/sql不会真正关闭语句)
+func (sc *stmtCache) release(ss *schemaStmts) {
+	if ss.nUser.Add(-1) == 0 && ss.dead.Load() {
+		ss.close()
+	}
+}
+
+// invalidate 标记schema失效，之后的get不再返回或者预编译它的语句；
+// 其他goroutine(pool模式的worker)可能还在使用旧schema的语句，等它们release之后再关闭
+func (sc *stmtCache) invalidate(schema *TableSchema) {
+	sc.Lock()
+	ss := sc.schemas[schema]
+	if ss == nil {
+		ss = &schemaStmts{}
+		sc.schemas[schema] = ss
+	}
+	ss.dead.Store(true)
+	sc.Unlock()
+
+	if ss.nUser.Load() == 0 {
+		ss.close()
+	}
+}
+
+func (ss *schemaStmts) close() {
+	ss.closeOnce.Do(func() {
+		for _, stmt := range ss.stmts {
+			_ = stmt.Close()
+		}
+		ss.stmts = nil
+	})
+}
+
+func (db *sqlDriver) InvalidateSchema(schema *TableSchema) {
+	db.stmts.invalidate(schema)
+}
+
+// StmtCacheStats 预编译语句缓存的命中和未命中次数
+func (db *sqlDriver) StmtCacheStats() (int64, int64) {
+	return db.stmts.nHit.Load(), db.stmts.nMiss.Load()
+}
+
+func (db *sqlDriver) execStmt(ctx context.Context, schema *TableSchema, query string, isUpdate bool, params ...interface{}) (sql.Result, error) {
+	query = db.dialect.rebind(query)
+	if db.tx != nil {
+		if stmt, ss := db.stmts.get(ctx, nil, schema, query, isUpdate); stmt != nil {
+			defer db.stmts.release(ss)
+			return db.tx.StmtContext(ctx, stmt).ExecContext(ctx, params...)
+		}
+
+		return db.tx.ExecContext(ctx, query, params...)
+	}
+
+	if stmt, ss := db.stmts.get(ctx, db.db, schema, query, isUpdate); stmt != nil {
+		defer db.stmts.release(ss)
+		return stmt.ExecContext(ctx, params...)
+	}
+
+	return db.db.ExecContext(ctx, query, params...)
+}
+
+func (db *sqlDriver) queryStmt(ctx context.Context, schema *TableSchema, query string, params ...interface{}) (*sql.Rows, error) {
+	query = db.dialect.rebind(query)
+	if db.tx != nil {
+		if stmt, ss := db.stmts.get(ctx, nil, schema, query, false); stmt != nil {
+			defer db.stmts.release(ss)
+			return db.tx.StmtContext(ctx, stmt).QueryContext(ctx, params...)
+		}
+
+		return db.tx.QueryContext(ctx, query, params...)
+	}
+
+	if stmt, ss := db.stmts.get(ctx, db.db, schema, query, false); stmt != nil {
+		defer db.stmts.release(ss)
+		return stmt.QueryContext(ctx, params...)
+	}
+
+	return db.db.QueryContext(ctx, query, params...)
+}
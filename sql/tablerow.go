@@ -42,10 +42,12 @@ type TableRow struct {
 	NumDBReq        int16
 	NumDBSyncReq    int16
 	LastHitTime     int64
-	Data            []byte
-	DBContext       *RowContext
-	prevIdx         int32
-	nextIdx         int32
+	// Data 修改时总是替换为新的行数据，不会原地修改(copy on write)，
+	// GetValueByIndex、RowData2Map等返回的没有复制的字符串不会随之改变
+	Data      []byte
+	DBContext *RowContext
+	prevIdx   int32
+	nextIdx   int32
 }
 
 type TableRowIndex struct {
@@ -61,7 +63,17 @@ type TableRowIndex struct {
 	nextIdx          int32
 }
 
+// ReloadSchema 只是增加、删除列或者列的顺序、默认值改变时，原地把缓存的行迁移到新的格式(见MigrateSchema)；
+// 否则清空缓存，有请求还没有返回时创建新的Table，tb标记为Outdated。返回使用的Table和丢弃的行数
 func (tb *Table) ReloadSchema(schema *TableSchema) (*Table, int32) {
+	if tb.Schema != nil && tb.Schema != schema {
+		if diff, err := DiffSchema(tb.Schema, schema); err == nil {
+			if _, err = tb.MigrateSchema(diff); err == nil {
+				return tb, 0
+			}
+		}
+	}
+
 	if n, err := tb.Reset(); err == nil {
 		tb.Schema = schema
 		return tb, n
@@ -465,7 +477,7 @@ func (tb *Table) recycleSI(num int32, expireTime int64) int32 {
 }
 
 func (tr *TableRow) Update(schema *TableSchema, fields map[string]string) (bool, error) {
-	mapFields := RowData2Map(schema, tr.Data)
+	mapFields := rowData2Map(schema, tr.Data, true)
 	if mapFields == nil {
 		return false, fmt.Errorf("invalid row data")
 	}
@@ -500,51 +512,283 @@ func (tr *TableRow) Update(schema *TableSchema, fields map[string]string) (bool,
 	return true, nil
 }
 
+// Update2 有版本列时fields必须带上期望的版本，与缓存的版本不一致时不修改，返回false和"version conflict"
 func (tr *TableRow) Update2(schema *TableSchema, fields []string) (bool, string) {
+	if nUpdate := len(fields); nUpdate&1 != 0 {
+		return false, "invalid fields"
+	}
+
+	var version string
+	if schema.versioned() {
+		var ok bool
+		if fields, version, ok = schema.splitVersion(fields); !ok {
+			return false, "missing version"
+		}
+	}
+
+	return tr.update(schema, fields, version)
+}
+
+func (tr *TableRow) update(schema *TableSchema, fields []string, version string) (bool, string) {
 	nUpdate := len(fields)
 	if nUpdate&1 != 0 {
 		return false, "invalid fields"
 	}
 
-	curr := RowData2Slice(schema, tr.Data)
-	if curr == nil {
+	if rowHeader(schema, tr.Data) == 0 {
 		return false, "invalid row data"
 	}
 
+	nPatch := nUpdate>>1 + len(schema.AutoMTimeFields) + 1
+	idxes := make([]int, 0, nPatch)
+	values := make([]string, 0, nPatch)
+	if version != "" {
+		next, msg := schema.nextVersion(tr.Data, version)
+		if msg != "" {
+			return false, msg
+		}
+		idxes = append(idxes, schema.versionIndex)
+		values = append(values, next)
+	}
+
 	for i := 0; i < nUpdate; i += 2 {
 		column := schema.GetColumnSchema(fields[i])
 		if column == nil || column.IsPrimaryKey {
 			return false, "invalid fields"
 		}
 
-		j := (column.Index << 1) + 1
-		curr[j] = fields[i+1]
+		idxes = append(idxes, column.Index)
+		values = append(values, fields[i+1])
 	}
 
+	idxes, values = appendMTime(schema, idxes, values)
+	return tr.patch(schema, idxes, values)
+}
+
+// appendMTime 追加自动更新的时间列
+func appendMTime(schema *TableSchema, idxes []int, values []string) ([]int, []string) {
+	if len(schema.AutoMTimeFields) == 0 {
+		return idxes, values
+	}
+
+	now := time.Now().UTC().Format("2006-01-02 15:04:05")
 	for _, i := range schema.AutoMTimeFields {
-		curr[(i<<1)+1] = time.Now().UTC().Format("2006-01-02 15:04:05")
+		idxes = append(idxes, i)
+		values = append(values, now)
+	}
+
+	return idxes, values
+}
+
+// patch 把values[i]写入idxes[i]列，后面的值覆盖前面的；优先只修改这些列，复制其余列的数据，
+// 无法只修改这些列时重建整行。tr.Data替换为新的行数据，旧的行数据不会被修改
+func (tr *TableRow) patch(schema *TableSchema, idxes []int, values []string) (bool, string) {
+	if rowData, ok := patchColumns(schema, tr.Data, idxes, values); ok {
+		tr.Data = rowData
+		return true, ""
+	}
+
+	return tr.rebuild(schema, idxes, values)
+}
+
+// rebuild 转换为rowData2Slice修改后重新生成整行
+func (tr *TableRow) rebuild(schema *TableSchema, idxes []int, values []string) (bool, string) {
+	curr := rowData2Slice(schema, tr.Data, true)
+	if curr == nil {
+		return false, "invalid row data"
+	}
+
+	for i, idx := range idxes {
+		curr[(idx<<1)+1] = values[i]
+	}
+
+	rowData := NewRowDataFromSlice(schema, curr)
+	if rowData == nil {
+		return false, "invalid fields"
 	}
 
-	tr.Data = NewRowDataFromSlice(schema, curr)
+	tr.Data = rowData
 	return true, ""
 }
 
+// Upsert fields与Insert相同。行存在时更新非主键列，不存在时以fields作为行数据，之后状态都为TableRowStateValid；
+// 状态未知(还没有从数据库加载)时无法得到完整的行数据，返回false，由调用者加载后再执行
+func (tr *TableRow) Upsert(schema *TableSchema, fields []string) (bool, string) {
+	switch tr.State {
+	case TableRowStateValid:
+		if !CheckFields(schema, fields) {
+			return false, "invalid fields"
+		}
+
+		updates := make([]string, 0, len(fields))
+		for i := 0; i < len(fields); i += 2 {
+			if !schema.GetColumnSchema(fields[i]).IsPrimaryKey {
+				updates = append(updates, fields[i], fields[i+1])
+			}
+		}
+
+		//与数据库相同，upsert不检查版本
+		return tr.update(schema, updates, "")
+
+	case TableRowStateNotExist:
+		rowData := NewRowDataFromSlice(schema, fields)
+		if rowData == nil {
+			return false, "invalid fields"
+		}
+
+		if tr.Data != nil && GetRowKey(schema, tr.Data) != GetRowKey(schema, rowData) {
+			return false, "invalid primary keys"
+		}
+
+		tr.Data = rowData
+		tr.State = TableRowStateValid
+		return true, ""
+
+	default:
+		return false, "row not loaded"
+	}
+}
+
 func (tr *TableRow) IncrBy(schema *TableSchema, idx int, delta int64) (bool, string) {
-	value := GetValueByIndex(schema, tr.Data, idx)
-	intV, err := strconv.ParseInt(value, 10, 64)
+	intV, msg := tr.int64At(schema, idx)
+	if msg != "" {
+		return false, msg
+	}
+
+	if len(schema.AutoMTimeFields) == 0 && !schema.Columns[idx].IsPrimaryKey {
+		//只修改一列时直接修改这一列，不需要分配idxes和values
+		pv, ok := encodePatch(schema, tr.Data[0], idx, strconv.FormatInt(intV+delta, 10))
+		if ok {
+			tr.Data = patchRow(schema, tr.Data, &pv)
+			return true, ""
+		}
+	}
+
+	idxes, values := appendMTime(schema, []int{idx}, []string{strconv.FormatInt(intV+delta, 10)})
+	return tr.patch(schema, idxes, values)
+}
+
+// int64At 读取整数列，NULL和不是整数的值返回原因
+func (tr *TableRow) int64At(schema *TableSchema, idx int) (int64, string) {
+	rv := NewRowView(schema, tr.Data)
+	if !rv.Valid() {
+		return 0, "invalid row data"
+	}
+
+	if isNullColumn(tr.Data, idx) {
+		return 0, "null value"
+	}
+
+	intV, err := rv.int64At(idx)
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	return intV, ""
+}
+
+// IncrBy2 按IncrByData同时增加多个列，Where或Guards不满足时不修改，返回false和原因
+func (tr *TableRow) IncrBy2(schema *TableSchema, data *IncrByData) (bool, string) {
+	parser, err := CreateParser(schema, "", data.Where, nil)
 	if err != nil {
 		return false, err.Error()
 	}
 
-	curr := RowData2Slice(schema, tr.Data)
-	curr[(idx<<1)+1] = strconv.FormatInt(intV+delta, 10)
+	if parser != nil && !parser.Check(tr.Data) {
+		return false, "condition not matched"
+	}
 
-	for _, i := range schema.AutoMTimeFields {
-		curr[(i<<1)+1] = time.Now().UTC().Format("2006-01-02 15:04:05")
+	if rowHeader(schema, tr.Data) == 0 {
+		return false, "invalid row data"
 	}
 
-	tr.Data = NewRowDataFromSlice(schema, curr)
-	return true, ""
+	deltas := data.ColumnDeltas()
+	nPatch := len(deltas) + len(schema.AutoMTimeFields) + 1
+	idxes := make([]int, 0, nPatch)
+	values := make([]string, 0, nPatch)
+	if schema.versioned() {
+		if data.Version == "" {
+			return false, "missing version"
+		}
+
+		next, msg := schema.nextVersion(tr.Data, data.Version)
+		if msg != "" {
+			return false, msg
+		}
+		idxes = append(idxes, schema.versionIndex)
+		values = append(values, next)
+	}
+
+	if len(deltas) == 0 {
+		return false, "invalid fields"
+	}
+
+	for _, cd := range deltas {
+		column := schema.GetColumnSchema(cd.Column)
+		if column == nil || column.IsPrimaryKey {
+			return false, "invalid fields"
+		}
+
+		intV, msg := tr.int64At(schema, column.Index)
+		if msg != "" {
+			return false, msg
+		}
+
+		idxes = append(idxes, column.Index)
+		values = append(values, strconv.FormatInt(intV+cd.Delta, 10))
+	}
+
+	for i := range data.Guards {
+		guard := &data.Guards[i]
+		column := schema.GetColumnSchema(guard.Column)
+		if column == nil || !guard.valid() {
+			return false, "invalid guard"
+		}
+
+		intV, msg := tr.int64At(schema, column.Index)
+		if msg != "" {
+			return false, msg
+		}
+
+		if !guard.check(intV + data.DeltaOf(guard.Column)) {
+			return false, "condition not matched"
+		}
+	}
+
+	idxes, values = appendMTime(schema, idxes, values)
+	return tr.patch(schema, idxes, values)
+}
+
+// Version 缓存的行版本，schema没有版本列或行数据为空时返回空字符串
+func (tr *TableRow) Version(schema *TableSchema) string {
+	if !schema.versioned() || tr.Data == nil {
+		return ""
+	}
+
+	return GetValueByIndex(schema, tr.Data, schema.versionIndex)
+}
+
+// Refresh 用数据库中读到的行刷新缓存，rowData为nil表示行已经不存在；
+// 版本列与缓存相同时不替换，返回缓存是否被修改。用于收到ErrVersionConflict之后
+func (tr *TableRow) Refresh(schema *TableSchema, rowData []byte) bool {
+	if rowData == nil {
+		if tr.State == TableRowStateNotExist && tr.Data == nil {
+			return false
+		}
+
+		tr.State = TableRowStateNotExist
+		tr.Data = nil
+		return true
+	}
+
+	if tr.State == TableRowStateValid && tr.Data != nil && schema.versioned() &&
+		tr.Version(schema) == GetValueByIndex(schema, rowData, schema.versionIndex) {
+		return false
+	}
+
+	tr.Data = rowData
+	tr.State = TableRowStateValid
+	return true
 }
 
 func (tr *TableRow) DebugInfo(schema *TableSchema) string {
@@ -48,6 +48,7 @@ func CreateFakeTableSchema(columns []FakeColumn, nPrimary int) *TableSchema {
 		NumPrimaryKeys:   nPrimary,
 		Columns:          cs,
 		m:                m,
+		parsers:          newParserCache(),
 	}
 }
 
@@ -91,6 +92,7 @@ func CreateFakeTableSchema2(columns []FakeColumn, pkIdxes []int, shardKey string
 		PrimaryKeyIndexes: pkIdxes,
 		Columns:           cs,
 		m:                 m,
+		parsers:           newParserCache(),
 	}
 }
 
@@ -137,3 +139,34 @@ func CreateMySqlTestTable2(db *MySql, tableName string, createSql string) {
 		panic(err)
 	}
 }
+
+func CreateSQLiteTestTable(db *SQLite, tableName string, columns []string, primaryKeys []string) {
+	_, err := db.Exec("DROP TABLE IF EXISTS " + tableName)
+	if err != nil {
+		panic(err)
+	}
+
+	var builder strings.Builder
+	builder.WriteString("CREATE TABLE ")
+	builder.WriteString(tableName)
+	builder.WriteString(" (")
+
+	for _, c := range columns {
+		builder.WriteString(c)
+		builder.WriteByte(',')
+	}
+
+	builder.WriteString("PRIMARY KEY ")
+	var sep byte = '('
+	for _, c := range primaryKeys {
+		builder.WriteByte(sep)
+		builder.WriteString(c)
+		sep = ','
+	}
+
+	builder.WriteString("))")
+	_, err = db.Exec(builder.String())
+	if err != nil {
+		panic(err)
+	}
+}
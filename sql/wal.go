@@ -0,0 +1,670 @@
+package sql
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WALSyncPolicy WAL写入后调用fsync的时机
+type WALSyncPolicy uint8
+
+const (
+	// WALSyncAlways 每条记录写入后fsync，机器宕机也不会丢失
+	WALSyncAlways WALSyncPolicy = iota
+	// WALSyncInterval 每隔SyncInterval fsync一次，进程崩溃不会丢失，机器宕机最多丢失一个间隔内的写请求
+	WALSyncInterval
+	// WALSyncNone 不主动fsync，由操作系统决定落盘时间
+	WALSyncNone
+)
+
+const (
+	walRecRequest byte = iota + 1
+	walRecDone
+)
+
+const (
+	walDataNone byte = iota
+	walDataFields
+	walDataIncrBy
+	walDataMulti
+)
+
+const (
+	walFlagCanMerge byte = 1 << iota
+	walFlagSync
+	walFlagMustAffect
+)
+
+// walHeaderSize 每条记录的头部：payload长度和payload的crc32
+const walHeaderSize = 8
+
+var ErrWALClosed = errors.New("wal is closed")
+
+type WALOptions struct {
+	Sync WALSyncPolicy
+	// SyncInterval WALSyncInterval的间隔，默认1秒
+	SyncInterval time.Duration
+	// MaxSize 文件超过这个大小时只保留未完成的请求重写文件，默认64MB
+	MaxSize int64
+}
+
+// WAL 写请求的预写日志。DBAccessor.Send加入写请求(Insert/Update/IncrBy/Delete)之前追加一条记录，
+// 请求执行完成(从Processor.Execute返回)时追加完成记录；启动时未完成的请求由DBAccessor.ReplayWAL重新执行。
+// 完成记录在请求执行之后写入，崩溃时可能重复执行一次，IncrBy等非幂等的请求需要注意
+type WAL struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	opts    WALOptions
+	size    int64
+	lsn     uint64
+	buf     []byte
+	dirty   bool
+	closed  bool
+	stop    chan struct{}
+	pending map[uint64][]byte
+	groups  map[*TxGroup]*walGroup
+	//OpenWAL时读到的未完成的请求，按lsn排序
+	recovered []*walRecord
+}
+
+// walGroup 事务用第一个成员的lsn标识，全部成员完成后删除
+type walGroup struct {
+	lsn   uint64
+	nDone int
+}
+
+// walRecord 解码后的请求记录，Schema只保存表名
+type walRecord struct {
+	lsn        uint64
+	command    DBCommand
+	flags      byte
+	table      string
+	shardId    int32
+	keys       []string
+	data       interface{}
+	group      uint64
+	groupNum   int
+	mustAffect bool
+}
+
+// OpenWAL 打开或者创建path的WAL，读取其中未完成的请求；文件末尾不完整或校验失败的记录(写入时崩溃)被截掉
+func OpenWAL(path string, opts WALOptions) (*WAL, error) {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 64 << 20
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	wal := &WAL{
+		path:    path,
+		file:    file,
+		opts:    opts,
+		pending: make(map[uint64][]byte),
+		groups:  make(map[*TxGroup]*walGroup),
+	}
+
+	if err = wal.load(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if opts.Sync == WALSyncInterval {
+		wal.stop = make(chan struct{})
+		go wal.syncLoop()
+	}
+
+	return wal, nil
+}
+
+func (wal *WAL) load() error {
+	data, err := io.ReadAll(wal.file)
+	if err != nil {
+		return err
+	}
+
+	records := make(map[uint64]*walRecord)
+	off := 0
+	for off+walHeaderSize <= len(data) {
+		n := int(binary.LittleEndian.Uint32(data[off:]))
+		sum := binary.LittleEndian.Uint32(data[off+4:])
+		end := off + walHeaderSize + n
+		if end > len(data) || crc32.ChecksumIEEE(data[off+walHeaderSize:end]) != sum {
+			break
+		}
+
+		payload := data[off+walHeaderSize : end]
+		rec, lsn, err := decodeWALRecord(payload)
+		if err != nil {
+			break
+		}
+
+		if lsn > wal.lsn {
+			wal.lsn = lsn
+		}
+
+		if rec == nil {
+			delete(records, lsn)
+			delete(wal.pending, lsn)
+
+		} else {
+			records[lsn] = rec
+			wal.pending[lsn] = payload
+		}
+		off = end
+	}
+
+	if off < len(data) {
+		if err = wal.file.Truncate(int64(off)); err != nil {
+			return err
+		}
+	}
+
+	if _, err = wal.file.Seek(int64(off), io.SeekStart); err != nil {
+		return err
+	}
+	wal.size = int64(off)
+
+	wal.recovered = make([]*walRecord, 0, len(records))
+	for _, rec := range records {
+		wal.recovered = append(wal.recovered, rec)
+	}
+	sort.Slice(wal.recovered, func(i, j int) bool {
+		return wal.recovered[i].lsn < wal.recovered[j].lsn
+	})
+
+	return nil
+}
+
+func (wal *WAL) syncLoop() {
+	ticker := time.NewTicker(wal.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			wal.mu.Lock()
+			if wal.dirty && !wal.closed {
+				_ = wal.sync()
+			}
+			wal.mu.Unlock()
+
+		case <-wal.stop:
+			return
+		}
+	}
+}
+
+// Append 记录一个写请求，读请求和已经记录过的请求忽略
+func (wal *WAL) Append(req *DBRequest) error {
+	if req.lsn != 0 || req.Schema == nil {
+		return nil
+	}
+
+	switch req.Command {
+	case CmdInsert, CmdDeleteSingle, CmdUpdateSingle, CmdIncrBySingle, CmdDeleteMulti, CmdUpsert:
+	default:
+		return nil
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.closed {
+		return ErrWALClosed
+	}
+
+	wal.lsn++
+	lsn := wal.lsn
+
+	var group uint64
+	if req.TxGroup != nil {
+		wg := wal.groups[req.TxGroup]
+		if wg == nil {
+			wg = &walGroup{lsn: lsn}
+			wal.groups[req.TxGroup] = wg
+		}
+		group = wg.lsn
+	}
+
+	payload, err := encodeWALRequest(nil, lsn, req, group)
+	if err != nil {
+		return err
+	}
+
+	if err = wal.write(payload); err != nil {
+		return err
+	}
+
+	req.lsn = lsn
+	wal.pending[lsn] = payload
+	return nil
+}
+
+// Done 记录请求已经执行完成
+func (wal *WAL) Done(req *DBRequest) error {
+	if req.lsn == 0 {
+		return nil
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.closed {
+		return ErrWALClosed
+	}
+
+	lsn := req.lsn
+	if _, ok := wal.pending[lsn]; !ok {
+		return nil
+	}
+
+	payload := binary.AppendUvarint([]byte{walRecDone}, lsn)
+	if err := wal.write(payload); err != nil {
+		return err
+	}
+
+	req.lsn = 0
+	delete(wal.pending, lsn)
+	if group := req.TxGroup; group != nil {
+		if wg := wal.groups[group]; wg != nil {
+			wg.nDone++
+			if wg.nDone >= group.Num {
+				delete(wal.groups, group)
+			}
+		}
+	}
+
+	return wal.compact()
+}
+
+// PendingNum 还没有完成的请求数
+func (wal *WAL) PendingNum() int {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	return len(wal.pending)
+}
+
+func (wal *WAL) Close() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.closed {
+		return nil
+	}
+
+	wal.closed = true
+	if wal.stop != nil {
+		close(wal.stop)
+	}
+
+	var err error
+	if wal.dirty {
+		err = wal.sync()
+	}
+
+	return errors.Join(err, wal.file.Close())
+}
+
+func (wal *WAL) write(payload []byte) error {
+	wal.buf = wal.buf[:0]
+	wal.buf = binary.LittleEndian.AppendUint32(wal.buf, uint32(len(payload)))
+	wal.buf = binary.LittleEndian.AppendUint32(wal.buf, crc32.ChecksumIEEE(payload))
+	wal.buf = append(wal.buf, payload...)
+
+	n, err := wal.file.Write(wal.buf)
+	wal.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	wal.dirty = true
+	if wal.opts.Sync == WALSyncAlways {
+		return wal.sync()
+	}
+
+	return nil
+}
+
+func (wal *WAL) sync() error {
+	wal.dirty = false
+	return wal.file.Sync()
+}
+
+// compact 没有未完成的请求时清空文件，文件超过MaxSize时只保留未完成的请求重写
+func (wal *WAL) compact() error {
+	if len(wal.pending) == 0 {
+		if wal.size == 0 {
+			return nil
+		}
+
+		if err := wal.file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := wal.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		wal.size = 0
+		wal.dirty = true
+		if wal.opts.Sync == WALSyncAlways {
+			return wal.sync()
+		}
+		return nil
+	}
+
+	if wal.size < wal.opts.MaxSize {
+		return nil
+	}
+
+	lsns := make([]uint64, 0, len(wal.pending))
+	for lsn := range wal.pending {
+		lsns = append(lsns, lsn)
+	}
+	sort.Slice(lsns, func(i, j int) bool { return lsns[i] < lsns[j] })
+
+	tmpPath := wal.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	for _, lsn := range lsns {
+		payload := wal.pending[lsn]
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+		buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+		buf = append(buf, payload...)
+	}
+
+	if _, err = tmp.Write(buf); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, wal.path)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	//rename之后的文件写入位置在末尾
+	_ = wal.file.Close()
+	wal.file = tmp
+	wal.size = int64(len(buf))
+	wal.dirty = false
+	if dir, err := os.Open(filepath.Dir(wal.path)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+
+	return nil
+}
+
+// records 取出OpenWAL时读到的未完成的请求
+func (wal *WAL) records() []*walRecord {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	recs := wal.recovered
+	wal.recovered = nil
+	return recs
+}
+
+func encodeWALRequest(buf []byte, lsn uint64, req *DBRequest, group uint64) ([]byte, error) {
+	var flags byte
+	if req.CanMerge {
+		flags |= walFlagCanMerge
+	}
+	if req.Sync {
+		flags |= walFlagSync
+	}
+	if req.TxGroup != nil && req.TxGroup.MustAffect {
+		flags |= walFlagMustAffect
+	}
+
+	buf = append(buf, walRecRequest)
+	buf = binary.AppendUvarint(buf, lsn)
+	buf = append(buf, byte(req.Command), flags)
+	buf = appendWALString(buf, req.Schema.Name)
+	buf = binary.AppendUvarint(buf, uint64(req.ShardId))
+	buf = appendWALStrings(buf, req.Keys)
+
+	buf = binary.AppendUvarint(buf, group)
+	if group != 0 {
+		buf = binary.AppendUvarint(buf, uint64(req.TxGroup.Num))
+	}
+
+	switch data := req.Data.(type) {
+	case nil:
+		buf = append(buf, walDataNone)
+
+	case []string:
+		buf = append(buf, walDataFields)
+		buf = appendWALStrings(buf, data)
+
+	case *IncrByData:
+		buf = append(buf, walDataIncrBy)
+		buf = appendWALString(buf, data.Column)
+		buf = binary.AppendVarint(buf, data.Delta)
+		buf = appendWALString(buf, data.Where)
+		buf = binary.AppendUvarint(buf, uint64(len(data.Deltas)))
+		for _, cd := range data.Deltas {
+			buf = appendWALString(buf, cd.Column)
+			buf = binary.AppendVarint(buf, cd.Delta)
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(data.Guards)))
+		for _, guard := range data.Guards {
+			buf = appendWALString(buf, guard.Column)
+			buf = appendWALString(buf, guard.Op)
+			buf = binary.AppendVarint(buf, guard.Value)
+		}
+		buf = appendWALString(buf, data.Version)
+
+	case *MultiRequestData:
+		buf = append(buf, walDataMulti)
+		buf = appendWALString(buf, data.Where)
+		buf = appendWALStrings(buf, data.Params)
+
+	default:
+		return nil, fmt.Errorf("wal: unsupported request data %T", req.Data)
+	}
+
+	return buf, nil
+}
+
+// decodeWALRecord 完成记录返回nil
+func decodeWALRecord(payload []byte) (*walRecord, uint64, error) {
+	d := &walDecoder{buf: payload}
+	typ := d.byte()
+	lsn := d.uvarint()
+	if typ == walRecDone {
+		return nil, lsn, d.err
+	}
+
+	if typ != walRecRequest {
+		return nil, 0, fmt.Errorf("wal: unknown record type %d", typ)
+	}
+
+	rec := &walRecord{lsn: lsn}
+	rec.command = DBCommand(d.byte())
+	rec.flags = d.byte()
+	rec.table = d.string()
+	rec.shardId = int32(d.uvarint())
+	rec.keys = d.strings()
+	if rec.group = d.uvarint(); rec.group != 0 {
+		rec.groupNum = int(d.uvarint())
+	}
+	rec.mustAffect = rec.flags&walFlagMustAffect != 0
+
+	switch d.byte() {
+	case walDataNone:
+
+	case walDataFields:
+		rec.data = d.strings()
+
+	case walDataIncrBy:
+		data := &IncrByData{}
+		data.Column = d.string()
+		data.Delta = d.varint()
+		data.Where = d.string()
+		if n := d.count(); n > 0 {
+			data.Deltas = make([]ColumnDelta, n)
+			for i := range data.Deltas {
+				data.Deltas[i].Column = d.string()
+				data.Deltas[i].Delta = d.varint()
+			}
+		}
+		if n := d.count(); n > 0 {
+			data.Guards = make([]IncrByGuard, n)
+			for i := range data.Guards {
+				data.Guards[i].Column = d.string()
+				data.Guards[i].Op = d.string()
+				data.Guards[i].Value = d.varint()
+			}
+		}
+		data.Version = d.string()
+		rec.data = data
+
+	case walDataMulti:
+		data := &MultiRequestData{}
+		data.Where = d.string()
+		data.Params = d.strings()
+		rec.data = data
+
+	default:
+		return nil, 0, errors.New("wal: unknown request data")
+	}
+
+	if d.err != nil {
+		return nil, 0, d.err
+	}
+
+	return rec, lsn, nil
+}
+
+func appendWALString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendWALStrings(buf []byte, ss []string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(ss)))
+	for _, s := range ss {
+		buf = appendWALString(buf, s)
+	}
+	return buf
+}
+
+type walDecoder struct {
+	buf []byte
+	err error
+}
+
+var errWALShort = errors.New("wal: short record")
+
+func (d *walDecoder) byte() byte {
+	if d.err != nil || len(d.buf) == 0 {
+		d.err = errWALShort
+		return 0
+	}
+
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *walDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errWALShort
+		return 0
+	}
+
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *walDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errWALShort
+		return 0
+	}
+
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *walDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+
+	if uint64(len(d.buf)) < n {
+		d.err = errWALShort
+		return ""
+	}
+
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+// count 读取元素个数，每个元素至少占一个字节
+func (d *walDecoder) count() int {
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.buf)) {
+		d.err = errWALShort
+		return 0
+	}
+
+	return int(n)
+}
+
+func (d *walDecoder) strings() []string {
+	n := d.count()
+	if d.err != nil {
+		return nil
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	ss := make([]string, n)
+	for i := range ss {
+		ss[i] = d.string()
+	}
+	return ss
+}
+
+// walRowKey 同一行的请求在重放时使用同一个RowContext
+func walRowKey(rec *walRecord) string {
+	return rec.table + "\x00" + strings.Join(rec.keys, "\x00")
+}
@@ -0,0 +1,183 @@
+package sql
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_Replay(t *testing.T) {
+	schema := newTestSchema()
+	path := filepath.Join(t.TempDir(), "db.wal")
+
+	//写入WAL之后崩溃，请求没有执行
+	wal, err := OpenWAL(path, WALOptions{Sync: WALSyncAlways})
+	require.NoError(t, err)
+	rc := NewRowContext()
+	reqs := []*DBRequest{
+		newTestRequest(schema, CmdInsert, rc, []string{"1", "1"}, []string{"uid", "1", "id", "1", "gold", "10"}),
+		newTestRequest(schema, CmdIncrBySingle, rc, []string{"1", "1"}, &IncrByData{Column: "gold", Delta: 5}),
+		newTestRequest(schema, CmdSelectSingle, rc, []string{"1", "1"}, nil),
+		newTestRequest(schema, CmdInsert, NewRowContext(), []string{"1", "2"}, []string{"uid", "1", "id", "2"}),
+		newTestRequest(schema, CmdDeleteMulti, NewRowContext(), []string{"1"},
+			&MultiRequestData{Where: "`uid`=? AND `gold`>?", Params: []string{"1", "100"}}),
+	}
+	for _, req := range reqs {
+		require.NoError(t, wal.Append(req))
+	}
+	//已经完成的请求不会重放
+	require.NoError(t, wal.Done(reqs[3]))
+	require.Equal(t, 3, wal.PendingNum())
+	require.NoError(t, wal.Close())
+
+	wal, err = OpenWAL(path, WALOptions{Sync: WALSyncInterval})
+	require.NoError(t, err)
+	defer wal.Close()
+
+	driver := NewDBStub()
+	driver.SetFakeSchemaReply(schema, nil)
+	rtn := make(chan *DBRequest, 16)
+	dba := NewDBAccessor(driver, make(chan *DBRequest, 16), rtn)
+	dba.SetWAL(wal)
+	n, err := dba.ReplayWAL(NewTableSchemaManager(driver))
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	//Parser没有记录到WAL，重放时重新编译
+	require.NotNil(t, dba.replay[2].Data.(*MultiRequestData).Parser)
+
+	dba.Run()
+	for i := 0; i < n; i++ {
+		req := <-rtn
+		require.True(t, req.Replayed)
+	}
+
+	_, err = dba.Stop(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, wal.PendingNum())
+
+	reply := driver.SelectSingle(schema, "1", []string{"1", "1"})
+	require.Equal(t, "15", GetValueByIndex(schema, reply.Data.([]byte), 3))
+	reply = driver.SelectSingle(schema, "1", []string{"1", "2"})
+	require.Nil(t, reply.Data)
+
+	//全部完成后文件被清空
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+}
+
+func TestWAL_TornTail(t *testing.T) {
+	schema := newTestSchema()
+	path := filepath.Join(t.TempDir(), "db.wal")
+
+	wal, err := OpenWAL(path, WALOptions{Sync: WALSyncNone})
+	require.NoError(t, err)
+	group := NewTxGroup(2, true)
+	for i := 0; i < 2; i++ {
+		req := newTestRequest(schema, CmdUpdateSingle, NewRowContext(), []string{"1", strconv.Itoa(i)}, []string{"gold", "1"})
+		req.TxGroup = group
+		require.NoError(t, wal.Append(req))
+	}
+	require.NoError(t, wal.Append(newTestRequest(schema, CmdDeleteMulti, NewRowContext(), []string{"1"},
+		&MultiRequestData{Where: "`gold`>?", Params: []string{"3"}})))
+	require.NoError(t, wal.Close())
+
+	//最后一条记录只写入了一部分
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-3))
+
+	wal, err = OpenWAL(path, WALOptions{})
+	require.NoError(t, err)
+	defer wal.Close()
+
+	recs := wal.records()
+	require.Len(t, recs, 2)
+	require.Equal(t, recs[0].lsn, recs[1].group)
+	require.Equal(t, 2, recs[1].groupNum)
+	require.True(t, recs[1].mustAffect)
+	require.Equal(t, []string{"gold", "1"}, recs[1].data)
+
+	//新的记录接在截断的位置之后
+	req := newTestRequest(schema, CmdDeleteSingle, NewRowContext(), []string{"1", "9"}, nil)
+	require.NoError(t, wal.Append(req))
+	require.Equal(t, uint64(3), req.lsn)
+}
+
+func TestWAL_Compact(t *testing.T) {
+	schema := newTestSchema()
+	path := filepath.Join(t.TempDir(), "db.wal")
+
+	wal, err := OpenWAL(path, WALOptions{Sync: WALSyncNone, MaxSize: 256})
+	require.NoError(t, err)
+
+	keep := newTestRequest(schema, CmdIncrBySingle, NewRowContext(), []string{"1", "0"}, &IncrByData{Column: "gold", Delta: -7,
+		Deltas: []ColumnDelta{{"exp", 7}}, Guards: []IncrByGuard{{Column: "gold", Op: ">=", Value: 0}}})
+	require.NoError(t, wal.Append(keep))
+	for i := 1; i < 32; i++ {
+		req := newTestRequest(schema, CmdUpdateSingle, NewRowContext(), []string{"1", strconv.Itoa(i)}, []string{"gold", "1"})
+		require.NoError(t, wal.Append(req))
+		require.NoError(t, wal.Done(req))
+	}
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Less(t, info.Size(), int64(256))
+	require.NoError(t, wal.Close())
+
+	wal, err = OpenWAL(path, WALOptions{})
+	require.NoError(t, err)
+	defer wal.Close()
+
+	recs := wal.records()
+	require.Len(t, recs, 1)
+	require.Equal(t, &IncrByData{Column: "gold", Delta: -7,
+		Deltas: []ColumnDelta{{"exp", 7}}, Guards: []IncrByGuard{{Column: "gold", Op: ">=", Value: 0}}}, recs[0].data)
+}
+
+func TestDBAccessor_Send(t *testing.T) {
+	schema := newTestSchema()
+	path := filepath.Join(t.TempDir(), "db.wal")
+
+	wal, err := OpenWAL(path, WALOptions{Sync: WALSyncAlways})
+	require.NoError(t, err)
+	req := make(chan *DBRequest, 1)
+	dba := NewDBAccessor(NewDBStub(), req, make(chan *DBRequest, 16))
+	dba.SetWAL(wal)
+
+	//Send返回时已经记录，不需要等待DBAccessor读取
+	insert := newTestRequest(schema, CmdInsert, NewRowContext(), []string{"1", "1"}, []string{"uid", "1", "id", "1"})
+	require.NoError(t, dba.Send(context.Background(), insert))
+	require.NotZero(t, insert.lsn)
+	require.Equal(t, 1, wal.PendingNum())
+
+	//没有加入的请求标记为完成
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	update := newTestRequest(schema, CmdUpdateSingle, NewRowContext(), []string{"1", "1"}, []string{"gold", "1"})
+	require.ErrorIs(t, dba.Send(ctx, update), context.Canceled)
+	require.Equal(t, 1, wal.PendingNum())
+
+	//WHERE不能编译的请求留在WAL中
+	bad := newTestRequest(schema, CmdDeleteMulti, NewRowContext(), []string{"1"}, &MultiRequestData{Where: "`nope`=?", Params: []string{"1"}})
+	require.NoError(t, wal.Append(bad))
+	require.NoError(t, wal.Close())
+
+	wal, err = OpenWAL(path, WALOptions{})
+	require.NoError(t, err)
+	defer wal.Close()
+
+	driver := NewDBStub()
+	driver.SetFakeSchemaReply(schema, nil)
+	dba = NewDBAccessor(driver, make(chan *DBRequest), make(chan *DBRequest))
+	dba.SetWAL(wal)
+	n, err := dba.ReplayWAL(NewTableSchemaManager(driver))
+	require.Error(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, CmdInsert, dba.replay[0].Command)
+	require.Equal(t, 2, wal.PendingNum())
+}